@@ -0,0 +1,302 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"math"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"concurrent-subscriptions/data"
+)
+
+// Pagination defaults for API lists
+const (
+	defaultPerPage = 20
+	maxPerPage     = 100
+)
+
+type contextKey string
+
+// apiRequestKey marks requests made to /api/v1, which always get JSON back
+const apiRequestKey contextKey = "api_request"
+
+// APIRequest marks every request through it as an API request, so handlers
+// shared with the HTML pages respond with JSON whatever the Accept header says
+func (app *Config) APIRequest(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := context.WithValue(r.Context(), apiRequestKey, true)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// wantsJSON reports whether the response to r should be JSON rather than
+// HTML: always for API requests, and otherwise when the Accept header ranks
+// application/json above text/html. Browsers and curl, which accept both
+// equally, get HTML.
+func wantsJSON(r *http.Request) bool {
+	if api, _ := r.Context().Value(apiRequestKey).(bool); api {
+		return true
+	}
+
+	return acceptQuality(r, "application/json") > acceptQuality(r, "text/html")
+}
+
+// acceptQuality returns the q value the Accept header gives mediaType, taken
+// from the most specific entry that matches it, or 0 if none does
+func acceptQuality(r *http.Request, mediaType string) float64 {
+	best, bestSpecificity := 0.0, -1
+
+	for _, part := range strings.Split(r.Header.Get("Accept"), ",") {
+		accepted, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+
+		specificity := -1
+		switch {
+		case accepted == mediaType:
+			specificity = 2
+		case accepted == strings.SplitN(mediaType, "/", 2)[0]+"/*":
+			specificity = 1
+		case accepted == "*/*":
+			specificity = 0
+		}
+		if specificity <= bestSpecificity {
+			continue
+		}
+
+		q := 1.0
+		if v, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(v, 64); err != nil {
+				q = 0
+			}
+		}
+
+		best, bestSpecificity = q, specificity
+	}
+
+	return best
+}
+
+// APIError is the body of every JSON error response
+type APIError struct {
+	Error APIErrorDetail `json:"error"`
+}
+
+// APIErrorDetail describes what went wrong. Code is stable and meant for
+// programs; Message is meant for people and may change.
+type APIErrorDetail struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// writeJSONError writes a JSON error envelope
+func writeJSONError(w http.ResponseWriter, status int, code, message string) {
+	writeJSON(w, status, APIError{Error: APIErrorDetail{Code: code, Message: message}})
+}
+
+// failRequest reports a request that couldn't be completed. API clients get a
+// JSON error with status and code; browsers get message flashed as kind
+// ("error" or "warning") and are redirected to redirectTo.
+func (app *Config) failRequest(w http.ResponseWriter, r *http.Request, status int, code, kind, message, redirectTo string) {
+	if wantsJSON(r) {
+		writeJSONError(w, status, code, message)
+		return
+	}
+
+	app.Session.Put(r.Context(), kind, message)
+	http.Redirect(w, r, redirectTo, http.StatusSeeOther)
+}
+
+// serverError logs err and responds 500, as JSON if the client wants it
+func (app *Config) serverError(w http.ResponseWriter, r *http.Request, err error) {
+	app.logError(r, err)
+
+	if wantsJSON(r) {
+		writeJSONError(w, http.StatusInternalServerError, "internal_error", "Something went wrong on our side")
+		return
+	}
+
+	http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+}
+
+// readInput returns the fields posted in r: those of a JSON object of strings,
+// such as {"email": "...", "password": "..."}, if that is what was sent, or the form
+func readInput(w http.ResponseWriter, r *http.Request) (url.Values, error) {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType != "application/json" {
+		if err := r.ParseForm(); err != nil {
+			return nil, err
+		}
+		return r.PostForm, nil
+	}
+
+	var fields map[string]string
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&fields); err != nil {
+		return nil, err
+	}
+
+	input := make(url.Values, len(fields))
+	for name, value := range fields {
+		input.Set(name, value)
+	}
+
+	return input, nil
+}
+
+// APINotFound responds to unknown API routes with a JSON error
+func APINotFound(w http.ResponseWriter, r *http.Request) {
+	writeJSONError(w, http.StatusNotFound, "not_found", "No such endpoint")
+}
+
+// APIMethodNotAllowed responds to API routes called with the wrong method with a JSON error
+func APIMethodNotAllowed(w http.ResponseWriter, r *http.Request) {
+	writeJSONError(w, http.StatusMethodNotAllowed, "method_not_allowed", "Method not allowed")
+}
+
+// Page describes one page of a list and where it sits in the whole list
+type Page struct {
+	Page       int `json:"page"`
+	PerPage    int `json:"per_page"`
+	Total      int `json:"total"`
+	TotalPages int `json:"total_pages"`
+}
+
+// PagedResponse is the body of a JSON list response
+type PagedResponse struct {
+	Data any  `json:"data"`
+	Meta Page `json:"meta"`
+}
+
+// DataResponse is the body of a JSON response holding one object
+type DataResponse struct {
+	Data any `json:"data"`
+}
+
+var errInvalidPage = errors.New("page and per_page must be positive whole numbers")
+
+// parsePage reads the page and per_page query parameters. Both are optional;
+// per_page is capped at maxPerPage.
+func parsePage(r *http.Request) (page, perPage int, err error) {
+	page, perPage = 1, defaultPerPage
+
+	if v := r.URL.Query().Get("page"); v != "" {
+		if page, err = strconv.Atoi(v); err != nil || page < 1 {
+			return 0, 0, errInvalidPage
+		}
+	}
+
+	if v := r.URL.Query().Get("per_page"); v != "" {
+		if perPage, err = strconv.Atoi(v); err != nil || perPage < 1 {
+			return 0, 0, errInvalidPage
+		}
+	}
+	if perPage > maxPerPage {
+		perPage = maxPerPage
+	}
+
+	return page, perPage, nil
+}
+
+// pageOffset returns how many items come before page in a list of perPage
+// items a page. A page before the first is taken to be the first, and the
+// offset of a huge page is capped at math.MaxInt rather than overflowing.
+func pageOffset(page, perPage int) int {
+	if page < 1 || perPage < 1 {
+		return 0
+	}
+	if page-1 > math.MaxInt/perPage {
+		return math.MaxInt
+	}
+	return (page - 1) * perPage
+}
+
+// paginate returns the bounds of one page of a list of total items, and the
+// page's description. A page before the first is taken to be the first, and a
+// page past the last is empty, however far past it is.
+func paginate(total, page, perPage int) (start, end int, p Page) {
+	if perPage < 1 {
+		perPage = defaultPerPage
+	}
+	if page < 1 {
+		page = 1
+	}
+
+	start = min(pageOffset(page, perPage), total)
+	end = start + perPage
+	if end > total {
+		end = total
+	}
+
+	pages := (total + perPage - 1) / perPage
+	if pages < 1 {
+		pages = 1
+	}
+
+	return start, end, Page{Page: page, PerPage: perPage, Total: total, TotalPages: pages}
+}
+
+// APIPlan is the JSON representation of a plan
+type APIPlan struct {
+	ID          int       `json:"id"`
+	Name        string    `json:"name"`
+	AmountCents int       `json:"amount_cents"`
+	Amount      string    `json:"amount"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+func newAPIPlan(p *data.Plan) *APIPlan {
+	if p == nil {
+		return nil
+	}
+
+	return &APIPlan{
+		ID:          p.ID,
+		Name:        p.PlanName,
+		AmountCents: p.PlanAmount,
+		Amount:      p.AmountForDisplay(),
+		CreatedAt:   p.CreatedAt,
+		UpdatedAt:   p.UpdatedAt,
+	}
+}
+
+// APIUser is the JSON representation of a user. It leaves out the password hash.
+type APIUser struct {
+	ID        int       `json:"id"`
+	Email     string    `json:"email"`
+	FirstName string    `json:"first_name"`
+	LastName  string    `json:"last_name"`
+	IsAdmin   bool      `json:"is_admin"`
+	CreatedAt time.Time `json:"created_at"`
+	Plan      *APIPlan  `json:"plan"`
+}
+
+func newAPIUser(u *data.User) APIUser {
+	return APIUser{
+		ID:        u.ID,
+		Email:     u.Email,
+		FirstName: u.FirstName,
+		LastName:  u.LastName,
+		IsAdmin:   u.IsAdmin == 1,
+		CreatedAt: u.CreatedAt,
+		Plan:      newAPIPlan(u.Plan),
+	}
+}
+
+// Profile returns the logged in user, with their current plan, if any
+func (app *Config) Profile(w http.ResponseWriter, r *http.Request) {
+	user, err := app.Models.User.GetOne(r.Context(), app.Session.GetInt(r.Context(), "user_id"))
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, DataResponse{Data: newAPIUser(user)})
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestPaginate(t *testing.T) {
+	tests := []struct {
+		name                string
+		total, page, per    int
+		start, end          int
+		wantPage, wantPages int
+	}{
+		{"first page", 45, 1, 20, 0, 20, 1, 3},
+		{"last partial page", 45, 3, 20, 40, 45, 3, 3},
+		{"exactly full", 40, 2, 20, 20, 40, 2, 2},
+		{"past the end", 45, 4, 20, 45, 45, 4, 3},
+		{"page zero", 45, 0, 20, 0, 20, 1, 3},
+		{"negative page", 45, -3, 20, 0, 20, 1, 3},
+		{"huge page", 45, math.MaxInt64/2 + 1, 20, 45, 45, math.MaxInt64/2 + 1, 3},
+		{"max page", 45, math.MaxInt, 20, 45, 45, math.MaxInt, 3},
+		{"empty list", 0, 1, 20, 0, 0, 1, 1},
+		{"zero per page", 45, 1, 0, 0, 20, 1, 3},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			start, end, p := paginate(tt.total, tt.page, tt.per)
+			if start != tt.start || end != tt.end {
+				t.Errorf("got [%d:%d], want [%d:%d]", start, end, tt.start, tt.end)
+			}
+			if p.Page != tt.wantPage || p.TotalPages != tt.wantPages || p.Total != tt.total {
+				t.Errorf("got %+v, want page %d of %d, total %d", p, tt.wantPage, tt.wantPages, tt.total)
+			}
+		})
+	}
+}
+
+func TestPageOffset(t *testing.T) {
+	tests := []struct {
+		page, perPage, want int
+	}{
+		{1, 20, 0},
+		{3, 20, 40},
+		{0, 20, 0},
+		{-5, 20, 0},
+		{2, 0, 0},
+		{math.MaxInt64/20 + 1, 20, math.MaxInt64 / 20 * 20},
+		{math.MaxInt64/20 + 2, 20, math.MaxInt},
+		{math.MaxInt, 20, math.MaxInt},
+	}
+
+	for _, tt := range tests {
+		if got := pageOffset(tt.page, tt.perPage); got != tt.want {
+			t.Errorf("pageOffset(%d, %d) = %d, want %d", tt.page, tt.perPage, got, tt.want)
+		}
+	}
+}
+
+func TestWantsJSON(t *testing.T) {
+	tests := []struct {
+		accept string
+		api    bool
+		want   bool
+	}{
+		{"", false, false},
+		{"", true, true},
+		{"text/html", true, true},
+		{"application/json", false, true},
+		{"text/html", false, false},
+		{"*/*", false, false},
+		{"text/html,application/json", false, false},
+		{"text/html;q=0.9, application/json", false, true},
+		{"application/json;q=0.5, text/html", false, false},
+		{"application/*", false, true},
+		{"application/*, text/html;q=0.1", false, true},
+		{"application/json;q=0, */*", false, false},
+		{"application/json;q=nonsense, text/html;q=0.1", false, false},
+		{"text/html;q=0.2, */*;q=0.8", false, true},
+		{"not a media type, application/json", false, true},
+	}
+
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		if tt.accept != "" {
+			r.Header.Set("Accept", tt.accept)
+		}
+		if tt.api {
+			r = r.WithContext(context.WithValue(r.Context(), apiRequestKey, true))
+		}
+
+		if got := wantsJSON(r); got != tt.want {
+			t.Errorf("Accept %q, API request %v: got %v, want %v", tt.accept, tt.api, got, tt.want)
+		}
+	}
+}
+
+func TestAPIPlansPages(t *testing.T) {
+	app := newTestApp(t)
+	c := newTestClient(t, app)
+
+	tests := []struct {
+		query  string
+		status int
+		plans  int
+	}{
+		{"", http.StatusOK, 2},
+		{"?per_page=1&page=2", http.StatusOK, 1},
+		{"?page=3", http.StatusOK, 0},
+		{"?page=4611686018427387904", http.StatusOK, 0},
+		{"?page=0", http.StatusBadRequest, 0},
+		{"?per_page=-1", http.StatusBadRequest, 0},
+	}
+
+	for _, tt := range tests {
+		res, body := c.get("/api/v1/plans" + tt.query)
+		if res.StatusCode != tt.status {
+			t.Errorf("%q: got %d: %s, want %d", tt.query, res.StatusCode, body, tt.status)
+			continue
+		}
+		if tt.status != http.StatusOK {
+			continue
+		}
+
+		var list struct {
+			Data []APIPlan `json:"data"`
+		}
+		if err := json.Unmarshal([]byte(body), &list); err != nil {
+			t.Fatal(err)
+		}
+		if len(list.Data) != tt.plans {
+			t.Errorf("%q: got %d plans, want %d", tt.query, len(list.Data), tt.plans)
+		}
+	}
+}
@@ -3,18 +3,31 @@ package main
 import (
 	"concurrent-subscriptions/data"
 	"database/sql"
-	"log"
+	"log/slog"
 	"sync"
 
 	"github.com/alexedwards/scs/v2"
+	"github.com/gomodule/redigo/redis"
 )
 
 type Config struct {
-	Session  *scs.SessionManager
-	DB       *sql.DB
-	InfoLog  *log.Logger
-	ErrorLog *log.Logger
-	Wait     *sync.WaitGroup
-	Models   data.Models
-	Mailer   Mail
+	Session   *scs.SessionManager
+	DB        *sql.DB
+	Redis     *redis.Pool
+	Log       *slog.Logger
+	Wait      *sync.WaitGroup
+	Models    data.Models
+	Mailer    Mail
+	Signer    *Signer
+	Secrets   *SecretBox
+	Templates *Templates
+	Settings  Settings
+	Metrics   *Metrics
+
+	LoginLimiter *LoginLimiter
+
+	// backgroundMu guards backgroundClosed, which stopBackground sets at
+	// shutdown so runInBackground never adds to Wait while it is being waited on
+	backgroundMu     sync.Mutex
+	backgroundClosed bool
 }
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"net/mail"
+	"net/url"
+	"strings"
+)
+
+// Form holds the values of a posted form and any validation errors for its fields
+type Form struct {
+	Values url.Values
+	Errors FormErrors
+}
+
+// FormErrors maps a field name to the validation messages for that field
+type FormErrors map[string][]string
+
+// Add appends a validation message for the given field
+func (e FormErrors) Add(field, message string) {
+	e[field] = append(e[field], message)
+}
+
+// Get returns the first validation message for the given field, if any
+func (e FormErrors) Get(field string) string {
+	msgs := e[field]
+	if len(msgs) == 0 {
+		return ""
+	}
+
+	return msgs[0]
+}
+
+// NewForm returns a Form populated with the given values
+func NewForm(values url.Values) *Form {
+	return &Form{
+		Values: values,
+		Errors: FormErrors{},
+	}
+}
+
+// Get returns the trimmed value of a form field
+func (f *Form) Get(field string) string {
+	return strings.TrimSpace(f.Values.Get(field))
+}
+
+// Required checks that every one of the given fields has a non-blank value
+func (f *Form) Required(fields ...string) {
+	for _, field := range fields {
+		if f.Get(field) == "" {
+			f.Errors.Add(field, "This field cannot be blank")
+		}
+	}
+}
+
+// IsEmail checks that the given field holds a valid email address
+func (f *Form) IsEmail(field string) {
+	value := f.Get(field)
+	if value == "" {
+		return
+	}
+
+	addr, err := mail.ParseAddress(value)
+	if err != nil || addr.Address != value {
+		f.Errors.Add(field, "Invalid email address")
+	}
+}
+
+// MinLength checks that the given field is at least n characters long
+func (f *Form) MinLength(field string, n int) {
+	value := f.Values.Get(field)
+	if value == "" {
+		return
+	}
+
+	if len([]rune(value)) < n {
+		f.Errors.Add(field, "This field is too short")
+	}
+}
+
+// Matches checks that two fields hold the same value
+func (f *Form) Matches(field, other, message string) {
+	if f.Values.Get(field) != f.Values.Get(other) {
+		f.Errors.Add(other, message)
+	}
+}
+
+// Valid returns true if the form has no validation errors
+func (f *Form) Valid() bool {
+	return len(f.Errors) == 0
+}
@@ -1,6 +1,20 @@
 package main
 
-import "net/http"
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"concurrent-subscriptions/data"
+)
 
 // HomePage handles the GET request to /
 func (app *Config) HomePage(w http.ResponseWriter, r *http.Request) {
@@ -12,63 +26,208 @@ func (app *Config) LoginPage(w http.ResponseWriter, r *http.Request) {
 	app.render(w, r, "login.page.gohtml", nil)
 }
 
-// PostLoginPage handles the POST request to /login
+// PostLoginPage handles the POST request to /login. API clients post the same
+// fields to /api/v1/login, as a form or a JSON object, and get JSON back: their
+// profile once they are logged in, or an error. The error code
+// second_factor_required means the password was right and the code from the
+// user's authenticator app must be posted to /api/v1/login/2fa next.
 func (app *Config) PostLoginPage(w http.ResponseWriter, r *http.Request) {
 	_ = app.Session.RenewToken(r.Context())
 
 	// parse form post
-	err := r.ParseForm()
+	input, err := readInput(w, r)
 	if err != nil {
-		app.Session.Put(r.Context(), "error", "Invalid form post")
-		app.ErrorLog.Println(err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		app.logError(r, err)
+		app.failRequest(w, r, http.StatusBadRequest, "invalid_request", "error", "Invalid form post", "/login")
 		return
 	}
 
 	// get form values
-	email := r.PostForm.Get("email")
-	password := r.PostForm.Get("password")
+	email := input.Get("email")
+	password := input.Get("password")
+	ip := app.clientIP(r)
 
-	// authenticate user
-	user, err := app.Models.User.GetByEmail(email)
+	// refuse to even check the password while the client or account is throttled
+	wait, err := app.LoginLimiter.Blocked(ip, email)
 	if err != nil {
-		app.Session.Put(r.Context(), "error", "Invalid login credentials")
-		app.ErrorLog.Println(err)
-		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		app.loginUnavailable(w, r, err)
+		return
+	}
+	if wait > 0 {
+		app.auditLogin(r, email, "throttled", 0)
+		app.loginThrottled(w, r, wait)
+		return
+	}
+
+	// authenticate user. An unknown email and a wrong password take the same
+	// time and get the same response, so neither reveals whether the account exists.
+	user, err := app.Models.User.GetByEmail(r.Context(), email)
+	if err != nil {
+		data.DummyPasswordCheck(password)
+
+		outcome := "unknown_email"
+		if !errors.Is(err, sql.ErrNoRows) {
+			outcome = "error"
+			app.logError(r, err)
+		}
+
+		app.loginFailed(r.Context(), ip, email, nil)
+		app.auditLogin(r, email, outcome, 0)
+		app.failRequest(w, r, http.StatusUnauthorized, "invalid_credentials", "error", "Invalid login credentials", "/login")
 		return
 	}
 
 	// check password
 	validPassword, err := user.PasswordMatches(password)
 	if err != nil {
-		app.Session.Put(r.Context(), "error", "Invalid login credentials")
-		app.ErrorLog.Println(err)
-		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		app.logError(r, err)
+		app.auditLogin(r, email, "error", user.ID)
+		app.failRequest(w, r, http.StatusUnauthorized, "invalid_credentials", "error", "Invalid login credentials", "/login")
 		return
 	}
 
 	if !validPassword {
-		msg := Message{
-			To:      email,
-			Subject: "Invalid login attempt",
-			Data:    "Invalid login attempt",
+		app.loginFailed(r.Context(), ip, email, user)
+		app.auditLogin(r, email, "bad_password", user.ID)
+		app.failRequest(w, r, http.StatusUnauthorized, "invalid_credentials", "error", "Invalid login credentials", "/login")
+		return
+	}
+
+	// only the owner of the account gets this far, so it is safe to say why
+	if user.Disabled() {
+		app.auditLogin(r, email, "disabled", user.ID)
+		app.failRequest(w, r, http.StatusForbidden, "account_disabled", "error",
+			"This account has been disabled. Please contact us if you think this is a mistake.", "/login")
+		return
+	}
+
+	if user.Active == 0 {
+		app.auditLogin(r, email, "inactive", user.ID)
+		app.failRequest(w, r, http.StatusForbidden, "inactive_account", "warning",
+			"Please activate your account using the link we emailed you before logging in.", "/login")
+		return
+	}
+
+	// users with two-factor authentication have one more step before they are logged in
+	tf, err := app.Models.TwoFactor.Get(r.Context(), user.ID)
+	if err != nil {
+		app.logError(r, err)
+		app.auditLogin(r, email, "error", user.ID)
+		app.failRequest(w, r, http.StatusInternalServerError, "internal_error", "error", "Unable to log you in", "/login")
+		return
+	}
+
+	if tf.Enabled == 1 {
+		app.auditLogin(r, email, "second_factor_required", user.ID)
+		app.Session.Put(r.Context(), "2fa_user_id", user.ID)
+		app.Session.Put(r.Context(), "2fa_started_at", time.Now().Unix())
+		if wantsJSON(r) {
+			writeJSONError(w, http.StatusUnauthorized, "second_factor_required", "Enter the code from your authenticator app")
+			return
 		}
-		app.sendEmail(msg)
-		app.Session.Put(r.Context(), "error", "Invalid login credentials")
-		app.ErrorLog.Println(err)
-		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		http.Redirect(w, r, "/login/2fa", http.StatusSeeOther)
 		return
 	}
 
+	app.auditLogin(r, email, "success", user.ID)
+	app.logIn(w, r, user, tf)
+}
+
+// logIn adds the user to the session and sends them on to the home page, or,
+// for an administrator who hasn't enrolled in two-factor authentication yet,
+// to the enrollment page. The account's failed login count is only reset here,
+// once every step has passed, so a password alone can't clear it.
+func (app *Config) logIn(w http.ResponseWriter, r *http.Request, user *data.User, tf *data.TwoFactor) {
+	if err := app.LoginLimiter.Succeed(user.Email); err != nil {
+		app.Log.ErrorContext(r.Context(), "Error resetting login throttle", "error", err)
+	}
+
+	_ = app.Session.RenewToken(r.Context())
+
 	// add user id to session
 	app.Session.Put(r.Context(), "user_id", user.ID)
-	app.Session.Put(r.Context(), "user", user)
+	app.Session.Put(r.Context(), "user", *user)
+
+	// API clients get their profile; AdminOnly still keeps an administrator
+	// out of the admin pages until they have set up two-factor authentication
+	if wantsJSON(r) {
+		writeJSON(w, http.StatusOK, DataResponse{Data: newAPIUser(user)})
+		return
+	}
+
+	if user.IsAdmin == 1 && tf.Enabled != 1 {
+		app.Session.Put(r.Context(), "warning", "Administrators must set up two-factor authentication")
+		http.Redirect(w, r, "/members/2fa/setup", http.StatusSeeOther)
+		return
+	}
 
 	// flash successful login
 	app.Session.Put(r.Context(), "flash", "Login successful")
 	// redirect to home
 	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+// loginThrottled tells a client it has to wait before trying to log in again
+func (app *Config) loginThrottled(w http.ResponseWriter, r *http.Request, wait time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	app.failRequest(w, r, http.StatusTooManyRequests, "too_many_attempts", "error",
+		fmt.Sprintf("Too many failed login attempts. Please try again in %s.", roundUpMinutes(wait)), "/login")
+}
+
+// loginUnavailable refuses a login because the throttle couldn't be checked.
+// Letting it through instead would lift the limits whenever Redis is down.
+func (app *Config) loginUnavailable(w http.ResponseWriter, r *http.Request, err error) {
+	app.Log.ErrorContext(r.Context(), "Error checking login throttle", "error", err)
+	app.failRequest(w, r, http.StatusServiceUnavailable, "unavailable", "error",
+		"Logging in is unavailable right now. Please try again shortly.", "/login")
+}
+
+// loginFailed counts a failed login against the client and the account. When
+// that locks the account, the owner is told about it, at most once per window.
+func (app *Config) loginFailed(ctx context.Context, ip, email string, user *data.User) {
+	locked, err := app.LoginLimiter.Fail(ip, email)
+	if err != nil {
+		app.Log.ErrorContext(ctx, "Error recording failed login", "error", err)
+		return
+	}
+
+	if !locked || user == nil {
+		return
+	}
+
+	notify, err := app.LoginLimiter.ShouldNotify(email)
+	if err != nil {
+		app.Log.ErrorContext(ctx, "Error recording lockout notification", "error", err)
+		return
+	}
+
+	if notify {
+		msg := Message{
+			To:       user.Email,
+			Subject:  "Your account has been temporarily locked",
+			Template: "mail",
+			Data: fmt.Sprintf("There were several failed attempts to log in to your account, so it has been locked for %s. "+
+				"If this wasn't you, you may want to reset your password.", roundUpMinutes(app.LoginLimiter.LockoutFor)),
+		}
+		if err := app.TrySend(ctx, msg); err != nil {
+			app.Log.ErrorContext(ctx, "Error emailing lockout notice", "error", err)
+		}
+	}
+}
 
+// auditLogin writes one structured audit line for the outcome of a login attempt
+func (app *Config) auditLogin(r *http.Request, email, outcome string, userID int) {
+	app.Log.InfoContext(r.Context(), "audit", "event", "login",
+		"outcome", outcome, "user_id", userID, "email", email, "ip", app.clientIP(r), "user_agent", r.UserAgent())
+}
+
+// roundUpMinutes describes a wait as a whole number of minutes, rounded up
+func roundUpMinutes(d time.Duration) string {
+	minutes := int((d + time.Minute - 1) / time.Minute)
+	if minutes == 1 {
+		return "1 minute"
+	}
+	return fmt.Sprintf("%d minutes", minutes)
 }
 
 // Logout logs the user out
@@ -89,22 +248,327 @@ func (app *Config) RegisterPage(w http.ResponseWriter, r *http.Request) {
 	app.render(w, r, "register.page.gohtml", nil)
 }
 
+// PostRegisterPage handles the POST request to /register
 func (app *Config) PostRegisterPage(w http.ResponseWriter, r *http.Request) {
-	// create a new user
+	err := r.ParseForm()
+	if err != nil {
+		app.logError(r, err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// validate form
+	form := NewForm(r.PostForm)
+	form.Required("email", "password", "verify-password", "first-name", "last-name")
+	form.IsEmail("email")
+	form.MinLength("password", 8)
+	form.Matches("password", "verify-password", "Passwords do not match")
+
+	email := data.NormalizeEmail(form.Get("email"))
+
+	if form.Valid() {
+		// make sure the email is not already taken. Insert checks again, as
+		// someone else may register it between the two.
+		_, err := app.Models.User.GetByEmail(r.Context(), email)
+		switch {
+		case err == nil:
+			form.Errors.Add("email", "An account with this email address already exists")
+		case !errors.Is(err, sql.ErrNoRows):
+			app.logError(r, err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if !form.Valid() {
+		app.renderRegisterErrors(w, r, form)
+		return
+	}
+
+	// create a new, inactive user
+	u := data.User{
+		Email:     email,
+		FirstName: form.Get("first-name"),
+		LastName:  form.Get("last-name"),
+		Password:  form.Values.Get("password"),
+		Active:    0,
+		IsAdmin:   0,
+	}
+
+	_, err = app.Models.User.Insert(r.Context(), u)
+	if errors.Is(err, data.ErrDuplicateEmail) {
+		form.Errors.Add("email", "An account with this email address already exists")
+		app.renderRegisterErrors(w, r, form)
+		return
+	}
+	if err != nil {
+		app.Session.Put(r.Context(), "error", "Unable to create user")
+		app.logError(r, err)
+		http.Redirect(w, r, "/register", http.StatusSeeOther)
+		return
+	}
 
 	// send an activation email to the user
+	if err := app.sendActivationEmail(r.Context(), u); err != nil {
+		app.logError(r, err)
+	}
 
-	// subscribe the user to an account
+	app.Session.Put(r.Context(), "flash", "Account created. Check your email to activate it.")
+	http.Redirect(w, r, "/login", http.StatusSeeOther)
 }
 
+// renderRegisterErrors shows the registration form again with its errors
+func (app *Config) renderRegisterErrors(w http.ResponseWriter, r *http.Request, form *Form) {
+	// never send the passwords back to the browser
+	form.Values.Del("password")
+	form.Values.Del("verify-password")
+
+	app.Session.Put(r.Context(), "error", "Please correct the errors below")
+	app.render(w, r, "register.page.gohtml", &TemplateData{
+		Form: form,
+	})
+}
+
+// activationLinkTTL is how long an emailed activation link stays valid
+const activationLinkTTL = 24 * time.Hour
+
 // ActivateAccount activates a user account
 func (app *Config) ActivateAccount(w http.ResponseWriter, r *http.Request) {
 	// validate url
+	email := r.URL.Query().Get("email")
+	if err := app.Signer.VerifyURL(r.RequestURI); err != nil {
+		msg := "This activation link is invalid."
+		if errors.Is(err, ErrExpiredSignature) {
+			msg = "This activation link has expired."
+		}
+		app.renderActivationFailed(w, r, email, msg)
+		return
+	}
 
-	// generate an invoice
+	// activate the account
+	u, err := app.Models.User.GetByEmail(r.Context(), email)
+	if err != nil {
+		app.logError(r, err)
+		app.renderActivationFailed(w, r, email, "No account was found for this activation link.")
+		return
+	}
+
+	if u.Active == 1 {
+		app.Session.Put(r.Context(), "flash", "Your account is already active. Please log in.")
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	// an account an administrator deactivated stays that way until they activate it again
+	if u.Disabled() {
+		app.Session.Put(r.Context(), "error", "This account has been disabled. Please contact us if you think this is a mistake.")
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	u.Active = 1
+	if err := app.Models.User.Update(r.Context(), *u); err != nil {
+		app.Session.Put(r.Context(), "error", "Unable to activate your account")
+		app.logError(r, err)
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+
+	app.Session.Put(r.Context(), "flash", "Account activated. You can now log in.")
+	http.Redirect(w, r, "/login", http.StatusSeeOther)
+}
+
+// PostResendActivation handles the POST request to /activate/resend
+func (app *Config) PostResendActivation(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		app.logError(r, err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// only accounts waiting for their email to be confirmed get a new link, but
+	// the response is the same either way so this can't be used to discover
+	// which emails are registered, or which accounts are disabled
+	u, err := app.Models.User.GetByEmail(r.Context(), r.PostForm.Get("email"))
+	if err == nil && u.Active == 0 && !u.Disabled() {
+		if err := app.sendActivationEmail(r.Context(), *u); err != nil {
+			app.logError(r, err)
+		}
+	} else if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		app.logError(r, err)
+	}
+
+	app.Session.Put(r.Context(), "flash", "If that account needs activating, a new activation email is on its way.")
+	http.Redirect(w, r, "/login", http.StatusSeeOther)
+}
+
+// renderActivationFailed shows why an activation link was rejected, with a form to request a new one
+func (app *Config) renderActivationFailed(w http.ResponseWriter, r *http.Request, email, reason string) {
+	form := NewForm(url.Values{})
+	form.Values.Set("email", email)
+
+	app.render(w, r, "activation-failed.page.gohtml", &TemplateData{
+		StringMap: map[string]string{"reason": reason},
+		Form:      form,
+	})
+}
+
+// sendActivationEmail emails the user a signed link to /activate
+func (app *Config) sendActivationEmail(ctx context.Context, u data.User) error {
+	link, err := app.Signer.SignURL(
+		fmt.Sprintf("%s/activate?email=%s", app.Settings.AppURL, url.QueryEscape(u.Email)),
+		activationLinkTTL,
+	)
+	if err != nil {
+		return err
+	}
+
+	msg := Message{
+		To:       u.Email,
+		Subject:  "Activate your account",
+		Template: "confirmation-email",
+		Data:     link,
+	}
+	return app.sendEmail(ctx, msg)
+}
+
+// ChooseSubscription displays the plans available to a logged in user. API
+// clients get the plans as a paginated JSON list instead, and don't need to
+// be logged in.
+func (app *Config) ChooseSubscription(w http.ResponseWriter, r *http.Request) {
+	w.Header().Add("Vary", "Accept")
+
+	plans, err := app.Models.Plan.GetAll(r.Context())
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	if wantsJSON(r) {
+		page, perPage, err := parsePage(r)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid_page", err.Error())
+			return
+		}
+
+		start, end, meta := paginate(len(plans), page, perPage)
+		list := make([]*APIPlan, 0, end-start)
+		for _, plan := range plans[start:end] {
+			list = append(list, newAPIPlan(plan))
+		}
+
+		writeJSON(w, http.StatusOK, PagedResponse{Data: list, Meta: meta})
+		return
+	}
+
+	user, err := app.Models.User.GetOne(r.Context(), app.Session.GetInt(r.Context(), "user_id"))
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	dataMap := make(map[string]any)
+	dataMap["plans"] = plans
+
+	app.render(w, r, "plans.page.gohtml", &TemplateData{
+		Data: dataMap,
+		User: user,
+	})
+}
+
+// SubscribeToPlan subscribes the logged in user to a plan, or switches their
+// current plan. Browsers post the plan as the form field id and are
+// redirected back to the plans page; API clients may instead send a JSON body
+// such as {"plan_id": 2} and get their updated profile back.
+func (app *Config) SubscribeToPlan(w http.ResponseWriter, r *http.Request) {
+	w.Header().Add("Vary", "Accept")
+
+	// get the plan chosen
+	planID, err := requestedPlanID(w, r)
+	if err != nil {
+		app.failRequest(w, r, http.StatusBadRequest, "invalid_plan", "error", "Invalid plan", "/members/plans")
+		return
+	}
 
-	// send an email with the plan attachments
+	plan, err := app.Models.Plan.GetOne(r.Context(), planID)
+	if errors.Is(err, sql.ErrNoRows) {
+		app.failRequest(w, r, http.StatusNotFound, "plan_not_found", "error", "Unable to find plan", "/members/plans")
+		return
+	}
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
 
-	// send an email to the user with the invoice
+	// get the user
+	user, err := app.Models.User.GetOne(r.Context(), app.Session.GetInt(r.Context(), "user_id"))
+	if err != nil {
+		app.logError(r, err)
+		app.failRequest(w, r, http.StatusUnauthorized, "unauthorized", "error", "Unable to find user", "/login")
+		return
+	}
 
+	if user.Plan != nil && user.Plan.ID == plan.ID {
+		app.failRequest(w, r, http.StatusConflict, "already_subscribed", "warning", "You are already subscribed to the "+plan.PlanName, "/members/plans")
+		return
+	}
+
+	// subscribe the user to the plan
+	err = app.Models.Plan.SubscribeUserToPlan(r.Context(), *user, *plan)
+	if err != nil {
+		app.logError(r, err)
+		app.failRequest(w, r, http.StatusInternalServerError, "subscribe_failed", "error", "Error subscribing to plan", "/members/plans")
+		return
+	}
+
+	// refresh the user held in the session
+	user.Plan = plan
+	app.Session.Put(r.Context(), "user", *user)
+
+	// confirm the subscription, then send the invoice and manual separately
+	app.sendConfirmation(r.Context(), *user, *plan)
+	app.generateInvoice(r.Context(), *user, *plan)
+
+	app.sendManual(r.Context(), *user, *plan)
+
+	if wantsJSON(r) {
+		writeJSON(w, http.StatusOK, DataResponse{Data: newAPIUser(user)})
+		return
+	}
+
+	app.Session.Put(r.Context(), "flash", "Subscribed to the "+plan.PlanName+"!")
+	http.Redirect(w, r, "/members/plans", http.StatusSeeOther)
+}
+
+// requestedPlanID reads the plan a user asked to subscribe to, from a JSON
+// body with a plan_id field or from the form field id
+func requestedPlanID(w http.ResponseWriter, r *http.Request) (int, error) {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType == "application/json" {
+		var body struct {
+			PlanID int `json:"plan_id"`
+		}
+		dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20))
+		if err := dec.Decode(&body); err != nil {
+			return 0, err
+		}
+		return validPlanID(body.PlanID, nil)
+	}
+
+	if err := r.ParseForm(); err != nil {
+		return 0, err
+	}
+
+	return validPlanID(strconv.Atoi(r.PostForm.Get("id")))
+}
+
+var errInvalidPlanID = errors.New("plan id must be a positive whole number")
+
+// validPlanID passes id and err on, unless id can't be the ID of a plan
+func validPlanID(id int, err error) (int, error) {
+	if err == nil && id <= 0 {
+		err = errInvalidPlanID
+	}
+	return id, err
 }
@@ -0,0 +1,433 @@
+package main
+
+import (
+	"concurrent-subscriptions/data"
+	"database/sql"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// adminUsersPerPage is how many users are listed on each page of the admin user list
+const adminUsersPerPage = 20
+
+// AdminUsersPage lists users, optionally filtered by the search term q, one page at a time
+func (app *Config) AdminUsersPage(w http.ResponseWriter, r *http.Request) {
+	term := r.URL.Query().Get("q")
+
+	page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+
+	users, total, err := app.Models.User.Search(r.Context(), term, adminUsersPerPage, pageOffset(page, adminUsersPerPage))
+	if err != nil {
+		app.logError(r, err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	_, _, p := paginate(total, page, adminUsersPerPage)
+
+	dataMap := make(map[string]any)
+	dataMap["users"] = users
+	dataMap["q"] = term
+	dataMap["total"] = total
+	dataMap["page"] = p.Page
+	dataMap["pages"] = p.TotalPages
+	if p.Page > 1 {
+		dataMap["prev"] = min(p.Page-1, p.TotalPages)
+	}
+	if p.Page < p.TotalPages {
+		dataMap["next"] = p.Page + 1
+	}
+
+	app.render(w, r, "admin-users.page.gohtml", &TemplateData{Data: dataMap})
+}
+
+// AdminUserPage shows the form for editing one user
+func (app *Config) AdminUserPage(w http.ResponseWriter, r *http.Request) {
+	user, ok := app.adminLoadUser(w, r)
+	if !ok {
+		return
+	}
+
+	form := NewForm(url.Values{})
+	form.Values.Set("email", user.Email)
+	form.Values.Set("first-name", user.FirstName)
+	form.Values.Set("last-name", user.LastName)
+	if user.Active == 1 {
+		form.Values.Set("active", "1")
+	}
+	if user.IsAdmin == 1 {
+		form.Values.Set("is-admin", "1")
+	}
+
+	app.renderAdminUser(w, r, user, form)
+}
+
+// PostAdminUser saves changes to a user's details and flags
+func (app *Config) PostAdminUser(w http.ResponseWriter, r *http.Request) {
+	user, ok := app.adminLoadUser(w, r)
+	if !ok {
+		return
+	}
+
+	err := r.ParseForm()
+	if err != nil {
+		app.logError(r, err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	form := NewForm(r.PostForm)
+	form.Required("email", "first-name", "last-name")
+	form.IsEmail("email")
+
+	email := data.NormalizeEmail(form.Get("email"))
+	if form.Errors.Get("email") == "" && email != user.Email {
+		found, err := app.Models.User.GetByEmail(r.Context(), email)
+		switch {
+		case err == nil && found.ID != user.ID:
+			form.Errors.Add("email", "Another account already uses this email address")
+		case err == nil:
+			// only the case of the user's own address changed
+		case !errors.Is(err, sql.ErrNoRows):
+			app.logError(r, err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	// an administrator can't lock themselves out
+	if user.ID == app.Session.GetInt(r.Context(), "user_id") {
+		if form.Get("active") != "1" {
+			form.Errors.Add("active", "You can't deactivate your own account")
+		}
+		if form.Get("is-admin") != "1" {
+			form.Errors.Add("is-admin", "You can't remove your own administrator access")
+		}
+	}
+
+	if !form.Valid() {
+		app.Session.Put(r.Context(), "error", "Please correct the errors below")
+		app.renderAdminUser(w, r, user, form)
+		return
+	}
+
+	wasActive := user.Active == 1
+	wasAdmin := user.IsAdmin == 1
+
+	user.Email = email
+	user.FirstName = form.Get("first-name")
+	user.LastName = form.Get("last-name")
+	// an account deactivated here is disabled, so the user can't activate it
+	// again with an activation link; activating it here lifts that
+	user.Active = 0
+	if form.Get("active") == "1" {
+		user.Active = 1
+		user.DisabledAt = nil
+	} else if !user.Disabled() {
+		now := time.Now()
+		user.DisabledAt = &now
+	}
+	user.IsAdmin = 0
+	if form.Get("is-admin") == "1" {
+		user.IsAdmin = 1
+	}
+
+	err = app.Models.User.Update(r.Context(), *user)
+	if errors.Is(err, data.ErrDuplicateEmail) {
+		form.Errors.Add("email", "Another account already uses this email address")
+		app.Session.Put(r.Context(), "error", "Please correct the errors below")
+		app.renderAdminUser(w, r, user, form)
+		return
+	}
+	if err != nil {
+		app.logError(r, err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	// a deactivated or demoted user is logged out everywhere, as AdminOnly
+	// trusts the user held in the session
+	if (wasActive && user.Active == 0) || (wasAdmin && user.IsAdmin == 0) {
+		if err := app.revokeSessions(r.Context(), user.ID, ""); err != nil {
+			app.Log.ErrorContext(r.Context(), "Error revoking sessions", "error", err)
+		}
+	}
+
+	app.refreshSessionUser(r, user.ID)
+
+	app.Log.InfoContext(r.Context(), "audit", "event", "admin_user_updated",
+		"admin_id", app.Session.GetInt(r.Context(), "user_id"), "user_id", user.ID, "active", user.Active, "is_admin", user.IsAdmin)
+
+	app.Session.Put(r.Context(), "flash", "User saved")
+	http.Redirect(w, r, fmt.Sprintf("/admin/users/%d", user.ID), http.StatusSeeOther)
+}
+
+// PostAdminUserPlan moves a user onto a different plan. No invoice is sent;
+// this is for corrections made by staff, not purchases.
+func (app *Config) PostAdminUserPlan(w http.ResponseWriter, r *http.Request) {
+	user, ok := app.adminLoadUser(w, r)
+	if !ok {
+		return
+	}
+
+	err := r.ParseForm()
+	if err != nil {
+		app.logError(r, err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	planID, _ := strconv.Atoi(r.PostForm.Get("plan"))
+	plan, err := app.Models.Plan.GetOne(r.Context(), planID)
+	if err != nil {
+		app.Session.Put(r.Context(), "error", "Unable to find plan")
+		http.Redirect(w, r, fmt.Sprintf("/admin/users/%d", user.ID), http.StatusSeeOther)
+		return
+	}
+
+	if err := app.Models.Plan.SubscribeUserToPlan(r.Context(), *user, *plan); err != nil {
+		app.logError(r, err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	app.refreshSessionUser(r, user.ID)
+
+	app.Log.InfoContext(r.Context(), "audit", "event", "admin_plan_assigned",
+		"admin_id", app.Session.GetInt(r.Context(), "user_id"), "user_id", user.ID, "plan_id", plan.ID)
+
+	app.Session.Put(r.Context(), "flash", fmt.Sprintf("Moved %s to the %s", user.Email, plan.PlanName))
+	http.Redirect(w, r, fmt.Sprintf("/admin/users/%d", user.ID), http.StatusSeeOther)
+}
+
+// PostAdminDeleteUser deletes a user and logs them out everywhere
+func (app *Config) PostAdminDeleteUser(w http.ResponseWriter, r *http.Request) {
+	user, ok := app.adminLoadUser(w, r)
+	if !ok {
+		return
+	}
+
+	if user.ID == app.Session.GetInt(r.Context(), "user_id") {
+		app.Session.Put(r.Context(), "error", "You can't delete your own account")
+		http.Redirect(w, r, fmt.Sprintf("/admin/users/%d", user.ID), http.StatusSeeOther)
+		return
+	}
+
+	err := app.Models.User.DeleteByID(r.Context(), user.ID)
+	if errors.Is(err, data.ErrUserHasInvoices) {
+		app.Session.Put(r.Context(), "error", "Invoices are kept for every user who has been billed, so this user can't be deleted. Deactivate them instead.")
+		http.Redirect(w, r, fmt.Sprintf("/admin/users/%d", user.ID), http.StatusSeeOther)
+		return
+	}
+	if err != nil {
+		app.logError(r, err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	if err := app.revokeSessions(r.Context(), user.ID, ""); err != nil {
+		app.Log.ErrorContext(r.Context(), "Error revoking sessions", "error", err)
+	}
+
+	app.Log.InfoContext(r.Context(), "audit", "event", "admin_user_deleted",
+		"admin_id", app.Session.GetInt(r.Context(), "user_id"), "user_id", user.ID, "email", user.Email)
+
+	app.Session.Put(r.Context(), "flash", fmt.Sprintf("Deleted %s", user.Email))
+	http.Redirect(w, r, "/admin/users", http.StatusSeeOther)
+}
+
+// AdminPlansPage lists every plan
+func (app *Config) AdminPlansPage(w http.ResponseWriter, r *http.Request) {
+	plans, err := app.Models.Plan.GetAll(r.Context())
+	if err != nil {
+		app.logError(r, err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	dataMap := make(map[string]any)
+	dataMap["plans"] = plans
+
+	app.render(w, r, "admin-plans.page.gohtml", &TemplateData{Data: dataMap})
+}
+
+// AdminPlanPage shows the form for creating a plan, or for editing one when the URL has an id
+func (app *Config) AdminPlanPage(w http.ResponseWriter, r *http.Request) {
+	form := NewForm(url.Values{})
+
+	var plan *data.Plan
+	if chi.URLParam(r, "id") != "" {
+		var ok bool
+		plan, ok = app.adminLoadPlan(w, r)
+		if !ok {
+			return
+		}
+
+		form.Values.Set("plan-name", plan.PlanName)
+		form.Values.Set("plan-amount", fmt.Sprintf("%.2f", float64(plan.PlanAmount)/100))
+	}
+
+	app.renderAdminPlan(w, r, plan, form)
+}
+
+// PostAdminPlan creates a plan, or saves changes to one when the URL has an id
+func (app *Config) PostAdminPlan(w http.ResponseWriter, r *http.Request) {
+	var plan *data.Plan
+	if chi.URLParam(r, "id") != "" {
+		var ok bool
+		plan, ok = app.adminLoadPlan(w, r)
+		if !ok {
+			return
+		}
+	}
+
+	err := r.ParseForm()
+	if err != nil {
+		app.logError(r, err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	form := NewForm(r.PostForm)
+	form.Required("plan-name", "plan-amount")
+
+	amount, err := parseCents(form.Get("plan-amount"))
+	if err != nil && form.Errors.Get("plan-amount") == "" {
+		form.Errors.Add("plan-amount", "Enter a price in dollars, such as 10.00")
+	}
+
+	if !form.Valid() {
+		app.Session.Put(r.Context(), "error", "Please correct the errors below")
+		app.renderAdminPlan(w, r, plan, form)
+		return
+	}
+
+	if plan == nil {
+		id, err := app.Models.Plan.Insert(r.Context(), data.Plan{
+			PlanName:   form.Get("plan-name"),
+			PlanAmount: amount,
+		})
+		if err != nil {
+			app.logError(r, err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+
+		app.Log.InfoContext(r.Context(), "audit", "event", "admin_plan_created",
+			"admin_id", app.Session.GetInt(r.Context(), "user_id"), "plan_id", id)
+		app.Session.Put(r.Context(), "flash", "Plan created")
+		http.Redirect(w, r, "/admin/plans", http.StatusSeeOther)
+		return
+	}
+
+	plan.PlanName = form.Get("plan-name")
+	plan.PlanAmount = amount
+	if err := app.Models.Plan.Update(r.Context(), *plan); err != nil {
+		app.logError(r, err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	app.Log.InfoContext(r.Context(), "audit", "event", "admin_plan_updated",
+		"admin_id", app.Session.GetInt(r.Context(), "user_id"), "plan_id", plan.ID)
+	app.Session.Put(r.Context(), "flash", "Plan saved")
+	http.Redirect(w, r, "/admin/plans", http.StatusSeeOther)
+}
+
+// adminLoadUser returns the user named by the id in the URL. If there isn't
+// one it responds with a redirect or an error and returns false.
+func (app *Config) adminLoadUser(w http.ResponseWriter, r *http.Request) (*data.User, bool) {
+	id, _ := strconv.Atoi(chi.URLParam(r, "id"))
+
+	user, err := app.Models.User.GetOne(r.Context(), id)
+	if err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			app.logError(r, err)
+		}
+		app.Session.Put(r.Context(), "error", "Unable to find user")
+		http.Redirect(w, r, "/admin/users", http.StatusSeeOther)
+		return nil, false
+	}
+
+	return user, true
+}
+
+// adminLoadPlan returns the plan named by the id in the URL. If there isn't
+// one it responds with a redirect and returns false.
+func (app *Config) adminLoadPlan(w http.ResponseWriter, r *http.Request) (*data.Plan, bool) {
+	id, _ := strconv.Atoi(chi.URLParam(r, "id"))
+
+	plan, err := app.Models.Plan.GetOne(r.Context(), id)
+	if err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			app.logError(r, err)
+		}
+		app.Session.Put(r.Context(), "error", "Unable to find plan")
+		http.Redirect(w, r, "/admin/plans", http.StatusSeeOther)
+		return nil, false
+	}
+
+	return plan, true
+}
+
+// renderAdminUser renders the user edit page, with the plans the user can be moved to
+func (app *Config) renderAdminUser(w http.ResponseWriter, r *http.Request, user *data.User, form *Form) {
+	plans, err := app.Models.Plan.GetAll(r.Context())
+	if err != nil {
+		app.logError(r, err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	dataMap := make(map[string]any)
+	dataMap["user"] = user
+	dataMap["plans"] = plans
+	dataMap["self"] = user.ID == app.Session.GetInt(r.Context(), "user_id")
+
+	app.render(w, r, "admin-user.page.gohtml", &TemplateData{Data: dataMap, Form: form})
+}
+
+// renderAdminPlan renders the plan form; plan is nil when creating a new plan
+func (app *Config) renderAdminPlan(w http.ResponseWriter, r *http.Request, plan *data.Plan, form *Form) {
+	dataMap := make(map[string]any)
+	dataMap["plan"] = plan
+
+	app.render(w, r, "admin-plan.page.gohtml", &TemplateData{Data: dataMap, Form: form})
+}
+
+// refreshSessionUser reloads the user stored in the session if it belongs to
+// userID, so an administrator editing their own account sees the change at once
+func (app *Config) refreshSessionUser(r *http.Request, userID int) {
+	if app.Session.GetInt(r.Context(), "user_id") != userID {
+		return
+	}
+
+	user, err := app.Models.User.GetOne(r.Context(), userID)
+	if err != nil {
+		app.logError(r, err)
+		return
+	}
+
+	app.Session.Put(r.Context(), "user", *user)
+}
+
+// parseCents converts a price in dollars, such as "10" or "10.50", to cents
+func parseCents(s string) (int, error) {
+	dollars, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, err
+	}
+
+	if dollars < 0 || math.IsInf(dollars, 0) || math.IsNaN(dollars) || dollars > math.MaxInt32/100 {
+		return 0, errors.New("amount out of range")
+	}
+
+	return int(math.Round(dollars * 100)), nil
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestAdminEditUser(t *testing.T) {
+	app := newTestApp(t)
+	_, code := addAdmin(t, app, "admin@example.com", "correct horse")
+	user := addUser(t, app, "alice@example.com", "correct horse")
+	addUser(t, app, "bob@example.com", "correct horse")
+
+	c := newTestClient(t, app)
+	c.logInWithCode("admin@example.com", "correct horse", code)
+
+	form := func(email, firstName string) url.Values {
+		return url.Values{
+			"email":      {email},
+			"first-name": {firstName},
+			"last-name":  {"User"},
+			"active":     {"1"},
+		}
+	}
+
+	tests := []struct {
+		name    string
+		form    url.Values
+		saved   bool
+		email   string
+		errText string
+	}{
+		{"email unchanged", form("alice@example.com", "Alice"), true, "alice@example.com", ""},
+		{"email in another case", form("ALICE@Example.com", "Alicia"), true, "alice@example.com", ""},
+		{"new email", form("Carol@Example.com", "Carol"), true, "carol@example.com", ""},
+		{"email taken", form("bob@example.com", "Bob"), false, "carol@example.com", "already uses this email"},
+		{"email taken in another case", form("BOB@example.com", "Bob"), false, "carol@example.com", "already uses this email"},
+	}
+
+	path := fmt.Sprintf("/admin/users/%d", user.ID)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res, body := c.postForm(path, tt.form)
+
+			if tt.saved {
+				if res.StatusCode != http.StatusSeeOther || res.Header.Get("Location") != path {
+					t.Fatalf("got %d to %q, want 303 to %s", res.StatusCode, res.Header.Get("Location"), path)
+				}
+			} else {
+				if res.StatusCode != http.StatusOK {
+					t.Fatalf("got %d, want the form shown again", res.StatusCode)
+				}
+				if !strings.Contains(body, tt.errText) {
+					t.Errorf("form doesn't say %q", tt.errText)
+				}
+			}
+
+			stored, err := app.Models.User.GetOne(context.Background(), user.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if stored.Email != tt.email {
+				t.Errorf("stored email %q, want %q", stored.Email, tt.email)
+			}
+			if tt.saved && stored.FirstName != tt.form.Get("first-name") {
+				t.Errorf("stored first name %q, want %q", stored.FirstName, tt.form.Get("first-name"))
+			}
+		})
+	}
+}
+
+func TestAdminUsersPages(t *testing.T) {
+	app := newTestApp(t)
+	_, code := addAdmin(t, app, "admin@example.com", "correct horse")
+	for i := 0; i < adminUsersPerPage+5; i++ {
+		addUser(t, app, fmt.Sprintf("user%d@example.com", i), "correct horse")
+	}
+
+	c := newTestClient(t, app)
+	c.logInWithCode("admin@example.com", "correct horse", code)
+
+	tests := []struct {
+		query   string
+		heading string
+		users   int
+	}{
+		{"", "Page 1 of 2", adminUsersPerPage},
+		{"?page=2", "Page 2 of 2", 6},
+		{"?page=0", "Page 1 of 2", adminUsersPerPage},
+		{"?page=-1", "Page 1 of 2", adminUsersPerPage},
+		{"?page=4611686018427387904", "Page 4611686018427387904 of 2", 0},
+		{"?page=nonsense", "Page 1 of 2", adminUsersPerPage},
+	}
+
+	for _, tt := range tests {
+		res, body := c.get("/admin/users" + tt.query)
+		if res.StatusCode != http.StatusOK {
+			t.Errorf("%q: got %d, want 200", tt.query, res.StatusCode)
+			continue
+		}
+		if !strings.Contains(body, tt.heading) {
+			t.Errorf("%q: page doesn't say %q", tt.query, tt.heading)
+		}
+		if n := strings.Count(body, `href="/admin/users/`); n != tt.users {
+			t.Errorf("%q: lists %d users, want %d", tt.query, n, tt.users)
+		}
+	}
+}
+
+func TestAdminDisableUser(t *testing.T) {
+	app := newTestApp(t)
+	_, code := addAdmin(t, app, "admin@example.com", "correct horse")
+	alice := addUser(t, app, "alice@example.com", "correct horse")
+
+	// bob registered but hasn't confirmed his email yet
+	bob := addUser(t, app, "bob@example.com", "correct horse")
+	bob.Active = 0
+	if err := app.Models.User.Update(context.Background(), *bob); err != nil {
+		t.Fatal(err)
+	}
+
+	admin := newTestClient(t, app)
+	admin.logInWithCode("admin@example.com", "correct horse", code)
+
+	path := fmt.Sprintf("/admin/users/%d", alice.ID)
+	form := url.Values{"email": {"alice@example.com"}, "first-name": {"Test"}, "last-name": {"User"}}
+	if res, _ := admin.postForm(path, form); res.StatusCode != http.StatusSeeOther {
+		t.Fatalf("deactivating: got %d, want 303", res.StatusCode)
+	}
+
+	stored, err := app.Models.User.GetOne(context.Background(), alice.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.Active != 0 || !stored.Disabled() {
+		t.Fatalf("after deactivating: active %d, disabled %v, want inactive and disabled", stored.Active, stored.Disabled())
+	}
+
+	activate := func(t *testing.T, email string) {
+		t.Helper()
+
+		link, err := app.Signer.SignURL(app.Settings.AppURL+"/activate?email="+url.QueryEscape(email), activationLinkTTL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		newTestClient(t, app).get(strings.TrimPrefix(link, app.Settings.AppURL))
+	}
+
+	isActive := func(t *testing.T, id int) bool {
+		t.Helper()
+
+		user, err := app.Models.User.GetOne(context.Background(), id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return user.Active == 1
+	}
+
+	t.Run("disabled", func(t *testing.T) {
+		c := newTestClient(t, app)
+		queued := len(outbox(app).Messages())
+
+		c.postForm("/activate/resend", url.Values{"email": {"alice@example.com"}})
+		if n := len(outbox(app).Messages()); n != queued {
+			t.Errorf("queued %d activation emails for a disabled account", n-queued)
+		}
+
+		activate(t, "alice@example.com")
+		if isActive(t, alice.ID) {
+			t.Fatal("an activation link activated a disabled account")
+		}
+
+		res, body := c.postJSON("/api/v1/login", map[string]string{"email": "alice@example.com", "password": "correct horse"})
+		if res.StatusCode != http.StatusForbidden || !strings.Contains(body, `"code":"account_disabled"`) {
+			t.Errorf("login: got %d: %s, want 403 account_disabled", res.StatusCode, body)
+		}
+	})
+
+	t.Run("unconfirmed", func(t *testing.T) {
+		c := newTestClient(t, app)
+		queued := len(outbox(app).Messages())
+
+		c.postForm("/activate/resend", url.Values{"email": {"bob@example.com"}})
+		if n := len(outbox(app).Messages()); n != queued+1 {
+			t.Errorf("queued %d emails, want 1 activation email", n-queued)
+		}
+
+		activate(t, "bob@example.com")
+		if !isActive(t, bob.ID) {
+			t.Error("the activation link didn't activate an unconfirmed account")
+		}
+	})
+
+	t.Run("enabled again", func(t *testing.T) {
+		form.Set("active", "1")
+		if res, _ := admin.postForm(path, form); res.StatusCode != http.StatusSeeOther {
+			t.Fatalf("activating: got %d, want 303", res.StatusCode)
+		}
+
+		stored, err := app.Models.User.GetOne(context.Background(), alice.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stored.Active != 1 || stored.Disabled() {
+			t.Fatalf("after activating: active %d, disabled %v, want active and not disabled", stored.Active, stored.Disabled())
+		}
+
+		newTestClient(t, app).logIn("alice@example.com", "correct horse")
+	})
+}
+
+func TestAdminDeleteUser(t *testing.T) {
+	app := newTestApp(t)
+	_, code := addAdmin(t, app, "admin@example.com", "correct horse")
+	alice := addUser(t, app, "alice@example.com", "correct horse")
+	bob := addUser(t, app, "bob@example.com", "correct horse")
+
+	// alice has been billed, so her invoices must outlive any attempt to delete her
+	if _, err := app.createInvoice(context.Background(), *alice, testPlans[0]); err != nil {
+		t.Fatal(err)
+	}
+
+	admin := newTestClient(t, app)
+	admin.logInWithCode("admin@example.com", "correct horse", code)
+
+	path := fmt.Sprintf("/admin/users/%d", alice.ID)
+	res, _ := admin.postForm(path+"/delete", nil)
+	if res.StatusCode != http.StatusSeeOther || res.Header.Get("Location") != path {
+		t.Fatalf("got %d to %q, want 303 to %s", res.StatusCode, res.Header.Get("Location"), path)
+	}
+	if _, body := admin.get(path); !strings.Contains(body, "Deactivate them instead") {
+		t.Error("the page doesn't say why the user wasn't deleted")
+	}
+	if _, err := app.Models.User.GetOne(context.Background(), alice.ID); err != nil {
+		t.Errorf("user with invoices was deleted: %v", err)
+	}
+	if invoices, _ := app.Models.Invoice.GetAllForUser(context.Background(), alice.ID); len(invoices) != 1 {
+		t.Errorf("got %d invoices, want 1", len(invoices))
+	}
+
+	res, _ = admin.postForm(fmt.Sprintf("/admin/users/%d/delete", bob.ID), nil)
+	if res.StatusCode != http.StatusSeeOther || res.Header.Get("Location") != "/admin/users" {
+		t.Fatalf("got %d to %q, want 303 to /admin/users", res.StatusCode, res.Header.Get("Location"))
+	}
+	if _, err := app.Models.User.GetOne(context.Background(), bob.ID); err == nil {
+		t.Error("user without invoices wasn't deleted")
+	}
+}
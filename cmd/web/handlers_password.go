@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// passwordResetTTL is how long an emailed password reset link stays valid
+const passwordResetTTL = time.Hour
+
+// ForgotPasswordPage displays the form to request a password reset link
+func (app *Config) ForgotPasswordPage(w http.ResponseWriter, r *http.Request) {
+	app.render(w, r, "forgot-password.page.gohtml", nil)
+}
+
+// PostForgotPassword emails a password reset link to the address given, if it belongs to an account
+func (app *Config) PostForgotPassword(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		app.logError(r, err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	form := NewForm(r.PostForm)
+	form.Required("email")
+	form.IsEmail("email")
+	if !form.Valid() {
+		app.render(w, r, "forgot-password.page.gohtml", &TemplateData{Form: form})
+		return
+	}
+
+	// the response is the same whether or not the account exists, or the
+	// request is throttled, so this form can't be used to discover which
+	// emails are registered or to flood an inbox
+	email := form.Get("email")
+	ip := app.clientIP(r)
+	allowed, err := app.LoginLimiter.AllowReset(ip, email)
+	if err != nil {
+		app.Log.ErrorContext(r.Context(), "Error checking password reset throttle", "error", err)
+	}
+	if !allowed {
+		app.Log.WarnContext(r.Context(), "Password reset throttled", "email", email, "ip", ip)
+		app.Session.Put(r.Context(), "flash", "If an account exists for that address, a password reset link is on its way.")
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	user, err := app.Models.User.GetByEmail(r.Context(), email)
+	switch {
+	case err == nil:
+		if err := app.sendPasswordResetEmail(r.Context(), user.ID, user.Email); err != nil {
+			app.logError(r, err)
+		}
+	case !errors.Is(err, sql.ErrNoRows):
+		app.logError(r, err)
+	}
+
+	app.Session.Put(r.Context(), "flash", "If an account exists for that address, a password reset link is on its way.")
+	http.Redirect(w, r, "/login", http.StatusSeeOther)
+}
+
+// ResetPasswordPage displays the form to choose a new password, if the reset token is valid
+func (app *Config) ResetPasswordPage(w http.ResponseWriter, r *http.Request) {
+	token := r.URL.Query().Get("token")
+
+	_, err := app.Models.PasswordReset.GetValid(r.Context(), token)
+	if err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			app.logError(r, err)
+		}
+		app.Session.Put(r.Context(), "error", "This password reset link is invalid or has expired. Please request a new one.")
+		http.Redirect(w, r, "/forgot-password", http.StatusSeeOther)
+		return
+	}
+
+	form := NewForm(url.Values{})
+	form.Values.Set("token", token)
+
+	app.render(w, r, "reset-password.page.gohtml", &TemplateData{Form: form})
+}
+
+// PostResetPassword sets the user's new password, uses up the reset token and
+// logs the user out everywhere else
+func (app *Config) PostResetPassword(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		app.logError(r, err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	form := NewForm(r.PostForm)
+	form.Required("token", "password", "verify-password")
+	form.MinLength("password", 8)
+	form.Matches("password", "verify-password", "Passwords do not match")
+	if !form.Valid() {
+		form.Values.Del("password")
+		form.Values.Del("verify-password")
+		app.render(w, r, "reset-password.page.gohtml", &TemplateData{Form: form})
+		return
+	}
+
+	userID, err := app.Models.PasswordReset.Redeem(r.Context(), form.Get("token"), form.Values.Get("password"))
+	if err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			app.logError(r, err)
+		}
+		app.Session.Put(r.Context(), "error", "This password reset link is invalid or has expired. Please request a new one.")
+		http.Redirect(w, r, "/forgot-password", http.StatusSeeOther)
+		return
+	}
+
+	if err := app.revokeSessions(r.Context(), userID, app.Session.Token(r.Context())); err != nil {
+		app.Log.ErrorContext(r.Context(), "Error revoking sessions", "error", err)
+	}
+
+	app.Session.Put(r.Context(), "flash", "Your password has been changed. Please log in.")
+	http.Redirect(w, r, "/login", http.StatusSeeOther)
+}
+
+// sendPasswordResetEmail creates a reset token for the user and emails them a link to use it
+func (app *Config) sendPasswordResetEmail(ctx context.Context, userID int, email string) error {
+	token, err := app.Models.PasswordReset.New(ctx, userID, passwordResetTTL)
+	if err != nil {
+		return err
+	}
+
+	msg := Message{
+		To:       email,
+		Subject:  "Reset your password",
+		Template: "password-reset",
+		Data:     fmt.Sprintf("%s/reset-password?token=%s", app.Settings.AppURL, url.QueryEscape(token)),
+	}
+
+	return app.TrySend(ctx, msg)
+}
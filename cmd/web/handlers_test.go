@@ -0,0 +1,480 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLogin(t *testing.T) {
+	app := newTestApp(t)
+	addUser(t, app, "alice@example.com", "correct horse")
+
+	inactive := addUser(t, app, "bob@example.com", "correct horse")
+	inactive.Active = 0
+	if err := app.Models.User.Update(context.Background(), *inactive); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		email    string
+		password string
+		location string
+		loggedIn string
+	}{
+		{"valid", "alice@example.com", "correct horse", "/", "alice@example.com"},
+		{"email in another case", "Alice@Example.com", "correct horse", "/", "alice@example.com"},
+		{"wrong password", "alice@example.com", "wrong", "/login", ""},
+		{"unknown email", "nobody@example.com", "correct horse", "/login", ""},
+		{"inactive", "bob@example.com", "correct horse", "/login", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestClient(t, app)
+
+			res, _ := c.postForm("/login", url.Values{"email": {tt.email}, "password": {tt.password}})
+			if res.StatusCode != http.StatusSeeOther || res.Header.Get("Location") != tt.location {
+				t.Fatalf("got %d to %q, want 303 to %q", res.StatusCode, res.Header.Get("Location"), tt.location)
+			}
+
+			if got := c.loggedInAs(); got != tt.loggedIn {
+				t.Errorf("logged in as %q, want %q", got, tt.loggedIn)
+			}
+		})
+	}
+}
+
+func TestLoginLockout(t *testing.T) {
+	app := newTestApp(t)
+	addUser(t, app, "alice@example.com", "correct horse")
+	c := newTestClient(t, app)
+
+	for i := 0; i < app.LoginLimiter.MaxPerEmail; i++ {
+		c.postForm("/login", url.Values{"email": {"alice@example.com"}, "password": {"wrong"}})
+	}
+
+	// the right password doesn't help once the account is locked
+	res, _ := c.postForm("/login", url.Values{"email": {"alice@example.com"}, "password": {"correct horse"}})
+	if res.StatusCode != http.StatusSeeOther || res.Header.Get("Location") != "/login" {
+		t.Fatalf("got %d to %q, want 303 to /login", res.StatusCode, res.Header.Get("Location"))
+	}
+	if _, body := c.get("/login"); !strings.Contains(body, "Too many failed login attempts") {
+		t.Error("login page doesn't say the account is locked")
+	}
+	if got := c.loggedInAs(); got != "" {
+		t.Errorf("logged in as %q while locked", got)
+	}
+
+	// the owner is told, once
+	if n := len(outbox(app).Messages()); n != 1 {
+		t.Errorf("queued %d emails, want 1 lockout notice", n)
+	}
+}
+
+func TestAPILogin(t *testing.T) {
+	app := newTestApp(t)
+	addUser(t, app, "alice@example.com", "correct horse")
+
+	inactive := addUser(t, app, "bob@example.com", "correct horse")
+	inactive.Active = 0
+	if err := app.Models.User.Update(context.Background(), *inactive); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		email    string
+		password string
+		status   int
+		code     string
+	}{
+		{"valid", "alice@example.com", "correct horse", http.StatusOK, ""},
+		{"wrong password", "alice@example.com", "wrong", http.StatusUnauthorized, "invalid_credentials"},
+		{"unknown email", "nobody@example.com", "correct horse", http.StatusUnauthorized, "invalid_credentials"},
+		{"inactive", "bob@example.com", "correct horse", http.StatusForbidden, "inactive_account"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestClient(t, app)
+
+			res, body := c.postJSON("/api/v1/login", map[string]string{"email": tt.email, "password": tt.password})
+			if res.StatusCode != tt.status {
+				t.Fatalf("got %d: %s, want %d", res.StatusCode, body, tt.status)
+			}
+
+			if tt.code != "" {
+				if !strings.Contains(body, `"code":"`+tt.code+`"`) {
+					t.Errorf("got %s, want error %s", body, tt.code)
+				}
+				if got := c.loggedInAs(); got != "" {
+					t.Errorf("logged in as %q", got)
+				}
+				return
+			}
+
+			var profile struct {
+				Data APIUser `json:"data"`
+			}
+			if err := json.Unmarshal([]byte(body), &profile); err != nil {
+				t.Fatal(err)
+			}
+			if profile.Data.Email != tt.email {
+				t.Errorf("response is for %q, want %q", profile.Data.Email, tt.email)
+			}
+			if got := c.loggedInAs(); got != tt.email {
+				t.Errorf("logged in as %q, want %q", got, tt.email)
+			}
+		})
+	}
+
+	t.Run("locked", func(t *testing.T) {
+		c := newTestClient(t, app)
+
+		for i := 0; i < app.LoginLimiter.MaxPerEmail; i++ {
+			c.postJSON("/api/v1/login", map[string]string{"email": "alice@example.com", "password": "wrong"})
+		}
+
+		res, body := c.postJSON("/api/v1/login", map[string]string{"email": "alice@example.com", "password": "correct horse"})
+		if res.StatusCode != http.StatusTooManyRequests || !strings.Contains(body, `"code":"too_many_attempts"`) {
+			t.Fatalf("got %d: %s, want 429 too_many_attempts", res.StatusCode, body)
+		}
+		if res.Header.Get("Retry-After") == "" {
+			t.Error("no Retry-After header")
+		}
+	})
+}
+
+func TestLoginSecondFactor(t *testing.T) {
+	app := newTestApp(t)
+	user := addUser(t, app, "alice@example.com", "correct horse")
+	secret, codes := enableTwoFactor(t, app, user.ID)
+
+	password := url.Values{"email": {"alice@example.com"}, "password": {"correct horse"}}
+
+	t.Run("valid code", func(t *testing.T) {
+		c := newTestClient(t, app)
+
+		res, _ := c.postForm("/login", password)
+		if loc := res.Header.Get("Location"); loc != "/login/2fa" {
+			t.Fatalf("after password: redirected to %q, want /login/2fa", loc)
+		}
+		if got := c.loggedInAs(); got != "" {
+			t.Fatalf("logged in as %q with only a password", got)
+		}
+
+		code, err := totpCode(secret, time.Now().Unix()/30)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res, _ = c.postForm("/login/2fa", url.Values{"code": {code}})
+		if loc := res.Header.Get("Location"); loc != "/" {
+			t.Fatalf("after code: redirected to %q, want /", loc)
+		}
+		if got := c.loggedInAs(); got != "alice@example.com" {
+			t.Errorf("logged in as %q, want alice@example.com", got)
+		}
+	})
+
+	t.Run("API", func(t *testing.T) {
+		c := newTestClient(t, app)
+
+		res, body := c.postJSON("/api/v1/login", map[string]string{"email": "alice@example.com", "password": "correct horse"})
+		if res.StatusCode != http.StatusUnauthorized || !strings.Contains(body, `"code":"second_factor_required"`) {
+			t.Fatalf("after password: got %d: %s, want 401 second_factor_required", res.StatusCode, body)
+		}
+		if got := c.loggedInAs(); got != "" {
+			t.Fatalf("logged in as %q with only a password", got)
+		}
+
+		res, body = c.postJSON("/api/v1/login/2fa", map[string]string{"code": "000000"})
+		if res.StatusCode != http.StatusUnauthorized || !strings.Contains(body, `"code":"invalid_code"`) {
+			t.Fatalf("wrong code: got %d: %s, want 401 invalid_code", res.StatusCode, body)
+		}
+
+		// the TOTP code for now was used above and can't be replayed, so use a recovery code
+		code := codes[0]
+		res, body = c.postJSON("/api/v1/login/2fa", map[string]string{"code": code})
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("after code: got %d: %s, want 200", res.StatusCode, body)
+		}
+		if got := c.loggedInAs(); got != "alice@example.com" {
+			t.Errorf("logged in as %q, want alice@example.com", got)
+		}
+
+		// the login is finished, so there is no second step left to take
+		res, body = c.postJSON("/api/v1/login/2fa", map[string]string{"code": code})
+		if res.StatusCode != http.StatusUnauthorized || !strings.Contains(body, `"code":"login_expired"`) {
+			t.Errorf("code again: got %d: %s, want 401 login_expired", res.StatusCode, body)
+		}
+	})
+
+	// a correct password on its own must not clear earlier failures, or an
+	// attacker who knows the password could guess codes forever
+	t.Run("password doesn't reset failures", func(t *testing.T) {
+		c := newTestClient(t, app)
+
+		for i := 0; i < app.LoginLimiter.MaxPerEmail-1; i++ {
+			c.postForm("/login", url.Values{"email": {"alice@example.com"}, "password": {"wrong"}})
+		}
+
+		c.postForm("/login", password)
+		c.postForm("/login/2fa", url.Values{"code": {"000000"}})
+
+		res, _ := c.postForm("/login", password)
+		if loc := res.Header.Get("Location"); loc != "/login" {
+			t.Fatalf("redirected to %q, want /login as the account is locked", loc)
+		}
+	})
+}
+
+func TestRegister(t *testing.T) {
+	app := newTestApp(t)
+	addUser(t, app, "alice@example.com", "correct horse")
+
+	form := func(email, password, verify string) url.Values {
+		return url.Values{
+			"email":           {email},
+			"password":        {password},
+			"verify-password": {verify},
+			"first-name":      {"Carol"},
+			"last-name":       {"Jones"},
+		}
+	}
+
+	tests := []struct {
+		name    string
+		form    url.Values
+		created bool
+		errText string
+	}{
+		{"valid", form("Carol@Example.com", "correct horse", "correct horse"), true, ""},
+		{"email taken", form("alice@example.com", "correct horse", "correct horse"), false, "already exists"},
+		{"email taken in another case", form("ALICE@example.com", "correct horse", "correct horse"), false, "already exists"},
+		{"passwords differ", form("dave@example.com", "correct horse", "battery staple"), false, "Passwords do not match"},
+		{"short password", form("erin@example.com", "short", "short"), false, "too short"},
+		{"bad email", form("not an email", "correct horse", "correct horse"), false, "Invalid email"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestClient(t, app)
+			queued := len(outbox(app).Messages())
+
+			res, body := c.postForm("/register", tt.form)
+
+			if !tt.created {
+				if res.StatusCode != http.StatusOK {
+					t.Fatalf("got %d, want the form shown again", res.StatusCode)
+				}
+				if !strings.Contains(body, tt.errText) {
+					t.Errorf("form doesn't say %q", tt.errText)
+				}
+				if strings.Contains(body, "correct horse") {
+					t.Error("form sent the password back")
+				}
+				if n := len(outbox(app).Messages()); n != queued {
+					t.Errorf("queued %d emails, want none", n-queued)
+				}
+				return
+			}
+
+			if res.StatusCode != http.StatusSeeOther || res.Header.Get("Location") != "/login" {
+				t.Fatalf("got %d to %q, want 303 to /login", res.StatusCode, res.Header.Get("Location"))
+			}
+
+			user, err := app.Models.User.GetByEmail(context.Background(), "carol@example.com")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if user.Email != "carol@example.com" {
+				t.Errorf("stored email %q, want it in lower case", user.Email)
+			}
+			if user.Active != 0 {
+				t.Error("new user is active before following the activation link")
+			}
+			if n := len(outbox(app).Messages()); n != queued+1 {
+				t.Errorf("queued %d emails, want 1 activation email", n-queued)
+			}
+		})
+	}
+}
+
+func TestActivateAccount(t *testing.T) {
+	app := newTestApp(t)
+	user := addUser(t, app, "carol@example.com", "correct horse")
+	user.Active = 0
+	if err := app.Models.User.Update(context.Background(), *user); err != nil {
+		t.Fatal(err)
+	}
+
+	// link signs an activation link for carol, as if sent signedAgo
+	link := func(t *testing.T, signedAgo time.Duration) string {
+		t.Helper()
+
+		signer := NewSigner("test secret")
+		signer.now = func() time.Time { return time.Now().Add(-signedAgo) }
+
+		link, err := signer.SignURL(app.Settings.AppURL+"/activate?email=carol%40example.com", activationLinkTTL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return strings.TrimPrefix(link, app.Settings.AppURL)
+	}
+
+	tests := []struct {
+		name    string
+		path    string
+		errText string
+	}{
+		{"expired", link(t, activationLinkTTL+time.Minute), "This activation link has expired."},
+		{"tampered", strings.Replace(link(t, 0), "carol", "mallory", 1), "This activation link is invalid."},
+		{"unsigned", "/activate?email=carol%40example.com", "This activation link is invalid."},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res, body := newTestClient(t, app).get(tt.path)
+			if res.StatusCode != http.StatusOK {
+				t.Fatalf("got %d, want 200", res.StatusCode)
+			}
+			if !strings.Contains(body, tt.errText) || !strings.Contains(body, `action="/activate/resend"`) {
+				t.Errorf("page doesn't say %q and offer to resend the email", tt.errText)
+			}
+
+			stored, _ := app.Models.User.GetOne(context.Background(), user.ID)
+			if stored.Active != 0 {
+				t.Fatal("account was activated")
+			}
+		})
+	}
+
+	t.Run("valid", func(t *testing.T) {
+		res, _ := newTestClient(t, app).get(link(t, time.Minute))
+		if res.StatusCode != http.StatusSeeOther || res.Header.Get("Location") != "/login" {
+			t.Fatalf("got %d to %q, want 303 to /login", res.StatusCode, res.Header.Get("Location"))
+		}
+
+		stored, _ := app.Models.User.GetOne(context.Background(), user.ID)
+		if stored.Active != 1 {
+			t.Error("account wasn't activated")
+		}
+	})
+}
+
+func TestSubscribe(t *testing.T) {
+	app := newTestApp(t)
+	user := addUser(t, app, "alice@example.com", "correct horse")
+
+	t.Run("logged out", func(t *testing.T) {
+		c := newTestClient(t, app)
+
+		res, _ := c.postForm("/members/subscribe", url.Values{"id": {"1"}})
+		if loc := res.Header.Get("Location"); loc != "/login" {
+			t.Fatalf("redirected to %q, want /login", loc)
+		}
+
+		res, _ = c.postJSON("/api/v1/subscription", map[string]int{"plan_id": 1})
+		if res.StatusCode != http.StatusUnauthorized {
+			t.Fatalf("API: got %d, want 401", res.StatusCode)
+		}
+	})
+
+	c := newTestClient(t, app)
+	c.logIn("alice@example.com", "correct horse")
+
+	t.Run("form", func(t *testing.T) {
+		res, _ := c.postForm("/members/subscribe", url.Values{"id": {"1"}})
+		if res.StatusCode != http.StatusSeeOther || res.Header.Get("Location") != "/members/plans" {
+			t.Fatalf("got %d to %q, want 303 to /members/plans", res.StatusCode, res.Header.Get("Location"))
+		}
+
+		checkPlan(t, app, user.ID, 1)
+
+		// the confirmation, invoice and manual are sent in the background
+		app.Wait.Wait()
+		var subjects []string
+		for _, msg := range outbox(app).Messages() {
+			var m Message
+			if err := json.Unmarshal(msg.Payload, &m); err != nil {
+				t.Fatal(err)
+			}
+			subjects = append(subjects, m.Subject)
+		}
+		if len(subjects) != 3 {
+			t.Errorf("queued %q, want a confirmation, an invoice and a manual", subjects)
+		}
+	})
+
+	t.Run("same plan again", func(t *testing.T) {
+		res, _ := c.postForm("/members/subscribe", url.Values{"id": {"1"}})
+		if loc := res.Header.Get("Location"); loc != "/members/plans" {
+			t.Fatalf("redirected to %q, want /members/plans", loc)
+		}
+		if _, body := c.get("/members/plans"); !strings.Contains(body, "already subscribed") {
+			t.Error("plans page doesn't say the user is already subscribed")
+		}
+	})
+
+	t.Run("API", func(t *testing.T) {
+		res, body := c.postJSON("/api/v1/subscription", map[string]int{"plan_id": 2})
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("got %d: %s", res.StatusCode, body)
+		}
+
+		var profile struct {
+			Data APIUser `json:"data"`
+		}
+		if err := json.Unmarshal([]byte(body), &profile); err != nil {
+			t.Fatal(err)
+		}
+		if profile.Data.Plan == nil || profile.Data.Plan.ID != 2 {
+			t.Errorf("response has plan %+v, want plan 2", profile.Data.Plan)
+		}
+
+		checkPlan(t, app, user.ID, 2)
+		app.Wait.Wait()
+	})
+
+	t.Run("API errors", func(t *testing.T) {
+		tests := []struct {
+			body   any
+			status int
+			code   string
+		}{
+			{map[string]int{"plan_id": 99}, http.StatusNotFound, "plan_not_found"},
+			{map[string]string{"plan_id": "two"}, http.StatusBadRequest, "invalid_plan"},
+			{map[string]int{"plan_id": 0}, http.StatusBadRequest, "invalid_plan"},
+			{map[string]int{"plan_id": -1}, http.StatusBadRequest, "invalid_plan"},
+			{map[string]any{}, http.StatusBadRequest, "invalid_plan"},
+		}
+
+		for _, tt := range tests {
+			res, body := c.postJSON("/api/v1/subscription", tt.body)
+			if res.StatusCode != tt.status || !strings.Contains(body, `"code":"`+tt.code+`"`) {
+				t.Errorf("%v: got %d %s, want %d %s", tt.body, res.StatusCode, body, tt.status, tt.code)
+			}
+		}
+
+		checkPlan(t, app, user.ID, 2)
+	})
+}
+
+// checkPlan fails the test unless the user is subscribed to planID
+func checkPlan(t *testing.T, app *Config, userID, planID int) {
+	t.Helper()
+
+	user, err := app.Models.User.GetOne(context.Background(), userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.Plan == nil || user.Plan.ID != planID {
+		t.Errorf("user is on plan %+v, want plan %d", user.Plan, planID)
+	}
+}
@@ -0,0 +1,358 @@
+package main
+
+import (
+	"concurrent-subscriptions/data"
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// secondFactorTimeout is how long a user has to enter their code after entering their password
+const secondFactorTimeout = 5 * time.Minute
+
+// SecondFactorPage displays the form for the code from the user's authenticator app
+func (app *Config) SecondFactorPage(w http.ResponseWriter, r *http.Request) {
+	if !app.Session.Exists(r.Context(), "2fa_user_id") {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	app.render(w, r, "login-2fa.page.gohtml", nil)
+}
+
+// PostSecondFactor checks the authentication or recovery code and, if it is
+// right, completes the login started by PostLoginPage. API clients post the
+// code to /api/v1/login/2fa, as a form or a JSON object, and get JSON back.
+func (app *Config) PostSecondFactor(w http.ResponseWriter, r *http.Request) {
+	input, err := readInput(w, r)
+	if err != nil {
+		app.logError(r, err)
+		app.failRequest(w, r, http.StatusBadRequest, "invalid_request", "error", "Invalid form post", "/login/2fa")
+		return
+	}
+
+	userID := app.Session.GetInt(r.Context(), "2fa_user_id")
+	startedAt := time.Unix(app.Session.GetInt64(r.Context(), "2fa_started_at"), 0)
+	if userID == 0 || time.Since(startedAt) > secondFactorTimeout {
+		app.Session.Remove(r.Context(), "2fa_user_id")
+		app.Session.Remove(r.Context(), "2fa_started_at")
+		app.failRequest(w, r, http.StatusUnauthorized, "login_expired", "warning", "Your login timed out. Please log in again.", "/login")
+		return
+	}
+
+	user, err := app.Models.User.GetOne(r.Context(), userID)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	// codes are throttled exactly like passwords
+	ip := app.clientIP(r)
+	wait, err := app.LoginLimiter.Blocked(ip, user.Email)
+	if err != nil {
+		app.loginUnavailable(w, r, err)
+		return
+	}
+	if wait > 0 {
+		app.auditLogin(r, user.Email, "throttled", user.ID)
+		app.loginThrottled(w, r, wait)
+		return
+	}
+
+	tf, err := app.Models.TwoFactor.Get(r.Context(), user.ID)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	method, err := app.checkSecondFactor(r.Context(), tf, input.Get("code"))
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	if method == "" {
+		app.loginFailed(r.Context(), ip, user.Email, user)
+		app.auditLogin(r, user.Email, "bad_second_factor", user.ID)
+		app.failRequest(w, r, http.StatusUnauthorized, "invalid_code", "error", "Invalid authentication code", "/login/2fa")
+		return
+	}
+
+	app.Session.Remove(r.Context(), "2fa_user_id")
+	app.Session.Remove(r.Context(), "2fa_started_at")
+
+	app.auditLogin(r, user.Email, "success_"+method, user.ID)
+	app.logIn(w, r, user, tf)
+}
+
+// checkSecondFactor accepts either a current TOTP code or an unused recovery
+// code. It returns which was used, "totp" or "recovery_code", or "" if neither matched.
+func (app *Config) checkSecondFactor(ctx context.Context, tf *data.TwoFactor, code string) (string, error) {
+	code = strings.TrimSpace(code)
+	if code == "" || tf.Secret == "" {
+		return "", nil
+	}
+
+	secret, err := app.Secrets.Open(tf.Secret)
+	if err != nil {
+		return "", err
+	}
+
+	if step, ok := verifyTOTP(secret, code, time.Now()); ok {
+		// a code can't be replayed, even within its 30 second window
+		fresh, err := app.Models.TwoFactor.UseStep(ctx, tf.UserID, step)
+		if err != nil || !fresh {
+			return "", err
+		}
+		return "totp", nil
+	}
+
+	if tf.Enabled != 1 {
+		return "", nil
+	}
+
+	used, err := app.Models.TwoFactor.UseRecoveryCode(ctx, tf.UserID, code)
+	if err != nil || !used {
+		return "", err
+	}
+
+	return "recovery_code", nil
+}
+
+// TwoFactorPage shows whether the logged in user has two-factor authentication turned on
+func (app *Config) TwoFactorPage(w http.ResponseWriter, r *http.Request) {
+	tf, err := app.Models.TwoFactor.Get(r.Context(), app.Session.GetInt(r.Context(), "user_id"))
+	if err != nil {
+		app.logError(r, err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	dataMap := make(map[string]any)
+	dataMap["enabled"] = tf.Enabled == 1
+
+	app.render(w, r, "two-factor.page.gohtml", &TemplateData{Data: dataMap})
+}
+
+// TwoFactorSetupPage starts enrollment: it shows a new secret as a QR code for
+// the user's authenticator app. The secret is kept in the session, not stored,
+// until PostTwoFactorSetup confirms it, so opening this page never changes the
+// secret a user already logs in with.
+func (app *Config) TwoFactorSetupPage(w http.ResponseWriter, r *http.Request) {
+	user, ok := app.Session.Get(r.Context(), "user").(data.User)
+	if !ok {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	tf, err := app.Models.TwoFactor.Get(r.Context(), user.ID)
+	if err != nil {
+		app.logError(r, err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	if tf.Enabled == 1 {
+		app.Session.Put(r.Context(), "warning", "Two-factor authentication is already turned on")
+		http.Redirect(w, r, "/members/2fa", http.StatusSeeOther)
+		return
+	}
+
+	secret, err := app.pendingTOTPSecret(r.Context())
+	if err != nil {
+		app.logError(r, err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	qrCode, err := qrDataURI(totpURI(app.Settings.TOTPIssuer, user.Email, secret))
+	if err != nil {
+		app.logError(r, err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	dataMap := make(map[string]any)
+	dataMap["qr"] = qrCode
+	dataMap["secret"] = secret
+
+	app.render(w, r, "two-factor-setup.page.gohtml", &TemplateData{Data: dataMap})
+}
+
+// pendingTOTPSecret returns the secret being set up in this session, first
+// making one if there isn't one yet
+func (app *Config) pendingTOTPSecret(ctx context.Context) (string, error) {
+	if sealed := app.Session.GetString(ctx, "2fa_pending_secret"); sealed != "" {
+		if secret, err := app.Secrets.Open(sealed); err == nil {
+			return secret, nil
+		}
+	}
+
+	secret, err := newTOTPSecret()
+	if err != nil {
+		return "", err
+	}
+
+	sealed, err := app.Secrets.Seal(secret)
+	if err != nil {
+		return "", err
+	}
+
+	app.Session.Put(ctx, "2fa_pending_secret", sealed)
+
+	return secret, nil
+}
+
+// PostTwoFactorSetup finishes enrollment once the user enters a valid code for
+// the secret shown by TwoFactorSetupPage, and shows them their recovery codes
+func (app *Config) PostTwoFactorSetup(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		app.logError(r, err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	user, ok := app.Session.Get(r.Context(), "user").(data.User)
+	if !ok {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	tf, err := app.Models.TwoFactor.Get(r.Context(), user.ID)
+	if err != nil {
+		app.logError(r, err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	if tf.Enabled == 1 {
+		http.Redirect(w, r, "/members/2fa", http.StatusSeeOther)
+		return
+	}
+
+	sealed := app.Session.GetString(r.Context(), "2fa_pending_secret")
+	if sealed == "" {
+		app.Session.Put(r.Context(), "warning", "Please scan the QR code and enter the code it gives you")
+		http.Redirect(w, r, "/members/2fa/setup", http.StatusSeeOther)
+		return
+	}
+
+	ip := app.clientIP(r)
+	if app.codeThrottled(w, r, ip, user.Email) {
+		return
+	}
+
+	secret, err := app.Secrets.Open(sealed)
+	if err != nil {
+		app.logError(r, err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	step, ok := verifyTOTP(secret, r.PostForm.Get("code"), time.Now())
+	if !ok {
+		app.loginFailed(r.Context(), ip, user.Email, &user)
+		app.Session.Put(r.Context(), "error", "That code didn't match. Check your authenticator app and try again.")
+		http.Redirect(w, r, "/members/2fa/setup", http.StatusSeeOther)
+		return
+	}
+
+	codes, err := app.Models.TwoFactor.Enable(r.Context(), user.ID, sealed, step)
+	if err != nil {
+		app.logError(r, err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	app.Session.Remove(r.Context(), "2fa_pending_secret")
+	app.Log.InfoContext(r.Context(), "audit", "event", "two_factor_enabled", "user_id", user.ID)
+
+	dataMap := make(map[string]any)
+	dataMap["codes"] = codes
+
+	app.Session.Put(r.Context(), "flash", "Two-factor authentication is now turned on")
+	app.render(w, r, "two-factor-recovery.page.gohtml", &TemplateData{Data: dataMap})
+}
+
+// PostTwoFactorDisable turns two-factor authentication off, after checking a
+// current code. Administrators can't turn it off.
+func (app *Config) PostTwoFactorDisable(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		app.logError(r, err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	user, ok := app.Session.Get(r.Context(), "user").(data.User)
+	if !ok {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	if user.IsAdmin == 1 {
+		app.Session.Put(r.Context(), "error", "Administrators must keep two-factor authentication turned on")
+		http.Redirect(w, r, "/members/2fa", http.StatusSeeOther)
+		return
+	}
+
+	ip := app.clientIP(r)
+	if app.codeThrottled(w, r, ip, user.Email) {
+		return
+	}
+
+	tf, err := app.Models.TwoFactor.Get(r.Context(), user.ID)
+	if err != nil {
+		app.logError(r, err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	method, err := app.checkSecondFactor(r.Context(), tf, r.PostForm.Get("code"))
+	if err != nil {
+		app.logError(r, err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	if method == "" {
+		app.loginFailed(r.Context(), ip, user.Email, &user)
+		app.Session.Put(r.Context(), "error", "Invalid authentication code")
+		http.Redirect(w, r, "/members/2fa", http.StatusSeeOther)
+		return
+	}
+
+	if err := app.Models.TwoFactor.Disable(r.Context(), user.ID); err != nil {
+		app.logError(r, err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	app.Log.InfoContext(r.Context(), "audit", "event", "two_factor_disabled", "user_id", user.ID)
+
+	app.Session.Put(r.Context(), "flash", "Two-factor authentication is now turned off")
+	http.Redirect(w, r, "/members/2fa", http.StatusSeeOther)
+}
+
+// codeThrottled checks a code for a logged in user against the same limits as
+// logging in, so a stolen session can't be used to guess codes. If the user
+// has to wait, or the limits can't be checked, it tells them so and returns true.
+func (app *Config) codeThrottled(w http.ResponseWriter, r *http.Request, ip, email string) bool {
+	wait, err := app.LoginLimiter.Blocked(ip, email)
+	if err != nil {
+		app.Log.ErrorContext(r.Context(), "Error checking login throttle", "error", err)
+		app.Session.Put(r.Context(), "error", "Codes can't be checked right now. Please try again shortly.")
+		http.Redirect(w, r, "/members/2fa", http.StatusSeeOther)
+		return true
+	}
+	if wait <= 0 {
+		return false
+	}
+
+	app.Session.Put(r.Context(), "error", fmt.Sprintf("Too many incorrect codes. Please try again in %s.", roundUpMinutes(wait)))
+	http.Redirect(w, r, "/members/2fa", http.StatusSeeOther)
+	return true
+}
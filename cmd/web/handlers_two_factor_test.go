@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+// setupKey matches the secret the setup page shows for entering by hand
+var setupKey = regexp.MustCompile(`enter this key by hand: <code>([A-Z2-7]+)</code>`)
+
+func TestTwoFactorSetup(t *testing.T) {
+	app := newTestApp(t)
+
+	// startSetup logs a new user in and opens the setup page, returning the
+	// client and the secret it shows
+	startSetup := func(t *testing.T, email string) (*testClient, int, string) {
+		t.Helper()
+
+		user := addUser(t, app, email, "correct horse")
+		c := newTestClient(t, app)
+		c.logIn(email, "correct horse")
+
+		_, body := c.get("/members/2fa/setup")
+		m := setupKey.FindStringSubmatch(body)
+		if m == nil {
+			t.Fatal("setup page doesn't show a key")
+		}
+
+		return c, user.ID, m[1]
+	}
+
+	twoFactorOn := func(t *testing.T, userID int) bool {
+		t.Helper()
+
+		tf, err := app.Models.TwoFactor.Get(context.Background(), userID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tf.Enabled == 1
+	}
+
+	t.Run("valid code", func(t *testing.T) {
+		c, userID, secret := startSetup(t, "alice@example.com")
+
+		// the secret isn't stored until it is confirmed, and stays the same until then
+		tf, err := app.Models.TwoFactor.Get(context.Background(), userID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tf.Secret != "" {
+			t.Error("opening the setup page stored a secret")
+		}
+		if _, body := c.get("/members/2fa/setup"); !strings.Contains(body, secret) {
+			t.Error("opening the setup page again showed a different key")
+		}
+
+		code, err := totpCode(secret, time.Now().Unix()/30)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res, body := c.postForm("/members/2fa/setup", url.Values{"code": {code}})
+		if res.StatusCode != http.StatusOK || !strings.Contains(body, "log in with one of these codes") {
+			t.Fatalf("got %d, want the recovery codes", res.StatusCode)
+		}
+		if !twoFactorOn(t, userID) {
+			t.Fatal("two-factor authentication is off")
+		}
+
+		// the code that turned it on can't be used to log in
+		login := newTestClient(t, app)
+		login.postForm("/login", url.Values{"email": {"alice@example.com"}, "password": {"correct horse"}})
+		login.postForm("/login/2fa", url.Values{"code": {code}})
+		if got := login.loggedInAs(); got != "" {
+			t.Error("the code used to turn on two-factor authentication logged in again")
+		}
+	})
+
+	t.Run("wrong codes are throttled", func(t *testing.T) {
+		c, userID, secret := startSetup(t, "bob@example.com")
+
+		for i := 0; i < app.LoginLimiter.MaxPerEmail; i++ {
+			c.postForm("/members/2fa/setup", url.Values{"code": {"000000"}})
+		}
+
+		code, err := totpCode(secret, time.Now().Unix()/30)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res, _ := c.postForm("/members/2fa/setup", url.Values{"code": {code}})
+		if loc := res.Header.Get("Location"); loc != "/members/2fa" {
+			t.Fatalf("redirected to %q, want /members/2fa", loc)
+		}
+		if _, body := c.get("/members/2fa"); !strings.Contains(body, "Too many incorrect codes") {
+			t.Error("page doesn't say there were too many incorrect codes")
+		}
+		if twoFactorOn(t, userID) {
+			t.Error("a code was accepted while throttled")
+		}
+	})
+}
+
+func TestTwoFactorDisable(t *testing.T) {
+	app := newTestApp(t)
+	user := addUser(t, app, "alice@example.com", "correct horse")
+	secret, codes := enableTwoFactor(t, app, user.ID)
+
+	c := newTestClient(t, app)
+	c.logInWithCode("alice@example.com", "correct horse", codes[0])
+
+	for i := 0; i < app.LoginLimiter.MaxPerEmail; i++ {
+		c.postForm("/members/2fa/disable", url.Values{"code": {"000000"}})
+	}
+
+	code, err := totpCode(secret, time.Now().Unix()/30)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.postForm("/members/2fa/disable", url.Values{"code": {code}})
+
+	if _, body := c.get("/members/2fa"); !strings.Contains(body, "Too many incorrect codes") {
+		t.Error("page doesn't say there were too many incorrect codes")
+	}
+	tf, err := app.Models.TwoFactor.Get(context.Background(), user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tf.Enabled != 1 {
+		t.Error("two-factor authentication was turned off while throttled")
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// readinessTimeout bounds each dependency check made by ReadyPage. Probes
+// usually give up after a second or two, so the answer must come back sooner.
+const readinessTimeout = time.Second
+
+// smtpCheckInterval is how long the result of an SMTP check is reused, so
+// frequent probes don't open a connection to the mail server every time
+const smtpCheckInterval = 30 * time.Second
+
+// CheckResult is the outcome of checking one dependency. /readyz is public,
+// so Error, which can name hosts and ports, is only logged.
+type CheckResult struct {
+	Status    string  `json:"status"`
+	LatencyMS float64 `json:"latency_ms"`
+	Error     string  `json:"-"`
+}
+
+// Readiness is the body of a /readyz response
+type Readiness struct {
+	Status string                 `json:"status"`
+	Checks map[string]CheckResult `json:"checks"`
+}
+
+// HealthPage reports that the process is up and serving requests. It checks
+// no dependencies, so a database outage never gets the process restarted.
+func (app *Config) HealthPage(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// ReadyPage checks every dependency the application needs to serve requests
+// and responds 200 if they are all fine or 503 if any is not, so the load
+// balancer stops sending traffic here until they recover.
+func (app *Config) ReadyPage(w http.ResponseWriter, r *http.Request) {
+	checks := map[string]func(ctx context.Context) error{
+		"postgres":   app.checkPostgres,
+		"redis":      app.checkRedis,
+		"mail_queue": app.checkMailQueue,
+	}
+
+	// only SMTP has a server to reach; the file and memory drivers are local
+	if t, ok := app.Mailer.Transport.(*SMTPTransport); ok {
+		checks["smtp"] = t.Check
+	}
+
+	res := Readiness{Status: "ok", Checks: make(map[string]CheckResult, len(checks))}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for name, check := range checks {
+		wg.Add(1)
+		go func(name string, check func(ctx context.Context) error) {
+			defer wg.Done()
+			result := runCheck(r.Context(), check)
+
+			mu.Lock()
+			defer mu.Unlock()
+			res.Checks[name] = result
+		}(name, check)
+	}
+	wg.Wait()
+
+	code := http.StatusOK
+	for name, result := range res.Checks {
+		if result.Status != "ok" {
+			res.Status = "fail"
+			code = http.StatusServiceUnavailable
+			app.Log.WarnContext(r.Context(), "Readiness check failed", "check", name, "error", result.Error)
+		}
+	}
+
+	writeJSON(w, code, res)
+}
+
+// runCheck runs check with readinessTimeout and times it. A check that
+// doesn't return in time is reported as failed and left to finish on its own.
+func runCheck(ctx context.Context, check func(ctx context.Context) error) CheckResult {
+	ctx, cancel := context.WithTimeout(ctx, readinessTimeout)
+	defer cancel()
+
+	start := time.Now()
+	done := make(chan error, 1)
+	go func() {
+		done <- check(ctx)
+	}()
+
+	var err error
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		err = fmt.Errorf("timed out after %s", readinessTimeout)
+	}
+
+	result := CheckResult{Status: "ok", LatencyMS: float64(time.Since(start).Microseconds()) / 1000}
+	if err != nil {
+		result.Status = "fail"
+		result.Error = err.Error()
+	}
+
+	return result
+}
+
+func (app *Config) checkPostgres(ctx context.Context) error {
+	return app.DB.PingContext(ctx)
+}
+
+func (app *Config) checkRedis(ctx context.Context) error {
+	conn, err := app.Redis.GetContext(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_, err = redis.DoWithTimeout(conn, readinessTimeout, "PING")
+	return err
+}
+
+// checkMailQueue fails once the outbox is so full that TrySend is refusing mail
+func (app *Config) checkMailQueue(ctx context.Context) error {
+	unsent, err := app.Models.Outbox.CountUnsent(ctx, app.Mailer.QueueSize)
+	if err != nil {
+		return err
+	}
+
+	if unsent >= app.Mailer.QueueSize {
+		return ErrMailQueueFull
+	}
+
+	return nil
+}
+
+// Check makes sure the SMTP server accepts connections. It only opens a TCP
+// connection and doesn't log in, and it reuses its last result for
+// smtpCheckInterval, so however often probes run, the mail server sees at
+// most one connection per interval from each instance.
+func (t *SMTPTransport) Check(ctx context.Context) error {
+	t.checkMu.Lock()
+	defer t.checkMu.Unlock()
+
+	if !t.checkedAt.IsZero() && time.Since(t.checkedAt) < smtpCheckInterval {
+		return t.checkErr
+	}
+
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", net.JoinHostPort(t.server.Host, strconv.Itoa(t.server.Port)))
+	if err == nil {
+		err = conn.Close()
+	}
+
+	t.checkedAt, t.checkErr = time.Now(), err
+	return err
+}
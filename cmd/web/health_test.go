@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	mail "github.com/xhit/go-simple-mail/v2"
+)
+
+func TestReadyPageHidesErrors(t *testing.T) {
+	app := newTestApp(t)
+	addUnusedPools(t, app)
+	c := newTestClient(t, app)
+
+	res, body := c.get("/readyz")
+	if res.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("got %d, want 503", res.StatusCode)
+	}
+
+	var ready Readiness
+	if err := json.Unmarshal([]byte(body), &ready); err != nil {
+		t.Fatal(err)
+	}
+	if ready.Status != "fail" || ready.Checks["redis"].Status != "fail" || ready.Checks["mail_queue"].Status != "ok" {
+		t.Errorf("got %+v, want redis failing and the mail queue ok", ready)
+	}
+
+	// the failures are reported, but not why, as that can name hosts and drivers
+	for _, leak := range []string{"error", "redigo", "localhost"} {
+		if strings.Contains(body, leak) {
+			t.Errorf("response contains %q: %s", leak, body)
+		}
+	}
+}
+
+func TestSMTPCheckIsCached(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	accepted := make(chan struct{}, 10)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+			accepted <- struct{}{}
+		}
+	}()
+
+	server := mail.NewSMTPClient()
+	server.Host = "127.0.0.1"
+	server.Port = ln.Addr().(*net.TCPAddr).Port
+	transport := &SMTPTransport{server: server}
+
+	for i := 0; i < 3; i++ {
+		if err := transport.Check(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	select {
+	case <-accepted:
+	case <-time.After(time.Second):
+		t.Fatal("the SMTP server saw no connection")
+	}
+
+	// the result is reused, failures included, until the interval is up
+	ln.Close()
+	if err := transport.Check(context.Background()); err != nil {
+		t.Errorf("got %v, want the cached result", err)
+	}
+	if n := len(accepted); n != 0 {
+		t.Errorf("the SMTP server saw %d more connections, want none", n)
+	}
+
+	transport.checkedAt = transport.checkedAt.Add(-smtpCheckInterval)
+	if err := transport.Check(context.Background()); err == nil {
+		t.Error("got no error once the interval was up and the server was gone")
+	}
+}
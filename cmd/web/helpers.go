@@ -1,6 +1,144 @@
 package main
 
-func (app *Config) sendEmail(msg Message) {
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5/middleware"
+)
+
+// backgroundJobTimeout bounds background work started by a request, such as
+// creating and mailing an invoice. That work outlives the request, so it isn't
+// cancelled with the request's context.
+const backgroundJobTimeout = time.Minute
+
+// ErrMailQueueFull is returned by TrySend when the outbox already holds Mailer.QueueSize unsent messages
+var ErrMailQueueFull = errors.New("mail queue is full")
+
+// sendEmail stores the message in the durable mail outbox, where one of the
+// mail workers will pick it up and send it. The request ID in ctx, if any, is
+// stored with it, so the send is logged against the request that caused it.
+func (app *Config) sendEmail(ctx context.Context, msg Message) error {
+	if msg.RequestID == "" {
+		msg.RequestID = middleware.GetReqID(ctx)
+	}
+
+	payload, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	id, err := app.Models.Outbox.Enqueue(ctx, payload, app.Mailer.MaxAttempts)
+	if err != nil {
+		return fmt.Errorf("queueing email to %s: %w", msg.To, err)
+	}
+	app.Log.InfoContext(ctx, "Queued email", "email_id", id, "to", msg.To)
+
+	// wake an idle worker, if there is one, rather than waiting for it to poll
+	select {
+	case app.Mailer.WakeChan <- struct{}{}:
+	default:
+	}
+
+	return nil
+}
+
+// TrySend queues the message like sendEmail, unless the mail queue is already
+// full, in which case it returns ErrMailQueueFull straight away. HTTP handlers
+// use it for mail that can be skipped, so a backlog never holds up a request.
+func (app *Config) TrySend(ctx context.Context, msg Message) error {
+	unsent, err := app.Models.Outbox.CountUnsent(ctx, app.Mailer.QueueSize)
+	if err != nil {
+		return err
+	}
+
+	if unsent >= app.Mailer.QueueSize {
+		return ErrMailQueueFull
+	}
+
+	return app.sendEmail(ctx, msg)
+}
+
+// writeJSON writes v as the JSON body of a response with the given status code
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+// runInBackground runs fn in a goroutine tracked by app.Wait, so shutdown waits
+// for it, and by the background_jobs metric. fn's context keeps the values of
+// ctx, such as the request ID, but is bounded by backgroundJobTimeout instead
+// of being cancelled along with ctx. Once shutdown has started, new jobs are
+// refused and logged instead.
+func (app *Config) runInBackground(ctx context.Context, fn func(ctx context.Context)) {
+	app.backgroundMu.Lock()
+	if app.backgroundClosed {
+		app.backgroundMu.Unlock()
+		app.Log.ErrorContext(ctx, "Background job refused; the application is shutting down")
+		return
+	}
 	app.Wait.Add(1)
-	app.Mailer.MailerChan <- msg
+	app.backgroundMu.Unlock()
+
+	app.Metrics.BackgroundJobs.Add(1)
+
+	ctx = context.WithoutCancel(ctx)
+
+	go func() {
+		defer app.Wait.Done()
+		defer app.Metrics.BackgroundJobs.Add(-1)
+
+		ctx, cancel := context.WithTimeout(ctx, backgroundJobTimeout)
+		defer cancel()
+
+		fn(ctx)
+	}()
+}
+
+// stopBackground stops runInBackground taking new jobs, so app.Wait can be
+// waited on safely
+func (app *Config) stopBackground() {
+	app.backgroundMu.Lock()
+	defer app.backgroundMu.Unlock()
+
+	app.backgroundClosed = true
+}
+
+// waitTimeout waits for wg, giving up after timeout. It reports whether wg finished in time.
+func waitTimeout(wg *sync.WaitGroup, timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// revokeSessions destroys every stored session belonging to the user, except
+// the one with the token keep, which may be empty
+func (app *Config) revokeSessions(ctx context.Context, userID int, keep string) error {
+	return app.Session.Iterate(ctx, func(ctx context.Context) error {
+		if app.Session.GetInt(ctx, "user_id") != userID {
+			return nil
+		}
+
+		if keep != "" && app.Session.Token(ctx) == keep {
+			return nil
+		}
+
+		return app.Session.Destroy(ctx)
+	})
 }
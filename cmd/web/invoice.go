@@ -0,0 +1,109 @@
+package main
+
+import (
+	"concurrent-subscriptions/data"
+	"context"
+	"fmt"
+)
+
+// invoiceTaxPercent is the sales tax charged on every invoice
+const invoiceTaxPercent = 13
+
+// invoiceTax returns the tax on an amount in cents, rounded half up to a whole cent
+func invoiceTax(amount int) int {
+	return (amount*invoiceTaxPercent + 50) / 100
+}
+
+// generateInvoice creates an invoice for the user's new plan, renders it as a
+// PDF and emails it to the user. The work happens in a background goroutine
+// started by runInBackground, so it never holds up the HTTP response.
+func (app *Config) generateInvoice(ctx context.Context, user data.User, plan data.Plan) {
+	app.runInBackground(ctx, func(ctx context.Context) {
+		invoice, err := app.createInvoice(ctx, user, plan)
+		if err != nil {
+			app.Log.ErrorContext(ctx, "Error creating invoice", "error", err)
+			return
+		}
+
+		msg := Message{
+			To:       user.Email,
+			Subject:  fmt.Sprintf("Your invoice %s", invoice.InvoiceNumber),
+			Template: "mail",
+			Data:     fmt.Sprintf("Thanks for subscribing to the %s. Your invoice %s is attached.", plan.PlanName, invoice.InvoiceNumber),
+			Attachments: []Attachment{
+				{Name: invoice.InvoiceNumber + ".pdf", Data: renderInvoicePDF(invoice)},
+			},
+		}
+		if err := app.sendEmail(ctx, msg); err != nil {
+			app.Log.ErrorContext(ctx, "Error emailing invoice", "error", err)
+		}
+	})
+}
+
+// createInvoice stores a new invoice for the user and plan, and returns it with its invoice number
+func (app *Config) createInvoice(ctx context.Context, user data.User, plan data.Plan) (*data.Invoice, error) {
+	id, err := app.Models.Invoice.Insert(ctx, data.Invoice{
+		UserID: user.ID,
+		PlanID: plan.ID,
+		Amount: plan.PlanAmount,
+		Tax:    invoiceTax(plan.PlanAmount),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	invoice, err := app.Models.Invoice.GetOne(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	invoice.User = &user
+	invoice.Plan = &plan
+
+	return invoice, nil
+}
+
+// renderInvoicePDF lays out an invoice as a one page PDF
+func renderInvoicePDF(invoice *data.Invoice) []byte {
+	const (
+		left  = 72.0
+		right = pdfPageWidth - 72.0
+	)
+
+	doc := NewPDF()
+	doc.AddPage()
+
+	doc.Text(left, 90, 24, true, "INVOICE")
+	doc.TextRight(right, 90, 12, true, invoice.InvoiceNumber)
+	doc.TextRight(right, 108, 10, false, "Issued "+invoice.IssuedAt.Format("January 2, 2006"))
+	doc.Line(left, 122, right, 122)
+
+	doc.Text(left, 150, 10, true, "Billed to")
+	if invoice.User != nil {
+		doc.Text(left, 166, 11, false, invoice.User.FirstName+" "+invoice.User.LastName)
+		doc.Text(left, 181, 11, false, invoice.User.Email)
+	}
+
+	planName := fmt.Sprintf("Plan #%d", invoice.PlanID)
+	if invoice.Plan != nil {
+		planName = invoice.Plan.PlanName
+	}
+
+	doc.Text(left, 230, 10, true, "Description")
+	doc.TextRight(right, 230, 10, true, "Amount")
+	doc.Line(left, 238, right, 238)
+	doc.Text(left, 256, 11, false, planName+" (monthly subscription)")
+	doc.TextRight(right, 256, 11, false, invoice.AmountForDisplay())
+	doc.Line(left, 270, right, 270)
+
+	doc.Text(right-200, 290, 11, false, "Subtotal")
+	doc.TextRight(right, 290, 11, false, invoice.AmountForDisplay())
+	doc.Text(right-200, 307, 11, false, fmt.Sprintf("Tax (%d%%)", invoiceTaxPercent))
+	doc.TextRight(right, 307, 11, false, invoice.TaxForDisplay())
+	doc.Text(right-200, 329, 12, true, "Total")
+	doc.TextRight(right, 329, 12, true, invoice.TotalForDisplay())
+
+	doc.Text(left, 720, 9, false, "Thank you for your business.")
+
+	return doc.Bytes()
+}
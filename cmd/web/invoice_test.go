@@ -0,0 +1,41 @@
+package main
+
+import (
+	"concurrent-subscriptions/data"
+	"context"
+	"testing"
+)
+
+func TestInvoiceTax(t *testing.T) {
+	tests := []struct {
+		amount, want int
+	}{
+		{1000, 130},
+		{1004, 131}, // 130.52
+		{1150, 150}, // 149.50 rounds up
+		{1003, 130}, // 130.39
+		{1, 0},
+		{4, 1}, // 0.52
+		{0, 0},
+	}
+
+	for _, tt := range tests {
+		if got := invoiceTax(tt.amount); got != tt.want {
+			t.Errorf("invoiceTax(%d) = %d, want %d", tt.amount, got, tt.want)
+		}
+	}
+}
+
+func TestCreateInvoice(t *testing.T) {
+	app := newTestApp(t)
+	user := addUser(t, app, "alice@example.com", "correct horse")
+	plan := data.Plan{ID: 1, PlanName: "Odd Plan", PlanAmount: 1150}
+
+	invoice, err := app.createInvoice(context.Background(), *user, plan)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if invoice.Amount != 1150 || invoice.Tax != 150 {
+		t.Errorf("got amount %d and tax %d, want 1150 and 150", invoice.Amount, invoice.Tax)
+	}
+}
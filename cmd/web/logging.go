@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"runtime"
+	"time"
+
+	"github.com/go-chi/chi/v5/middleware"
+)
+
+// newLogger returns a logger that writes format ("json" or "text") to w,
+// dropping anything below level. Every line logged with a context that
+// carries a request ID includes it as request_id.
+func newLogger(w io.Writer, level, format string) (*slog.Logger, error) {
+	var lvl slog.Level
+	if err := lvl.UnmarshalText([]byte(level)); err != nil {
+		return nil, err
+	}
+
+	opts := &slog.HandlerOptions{Level: lvl, AddSource: true}
+
+	var h slog.Handler
+	switch format {
+	case "json":
+		h = slog.NewJSONHandler(w, opts)
+	case "text":
+		h = slog.NewTextHandler(w, opts)
+	default:
+		return nil, fmt.Errorf("unknown log format %q", format)
+	}
+
+	return slog.New(requestIDHandler{h}), nil
+}
+
+// requestIDHandler adds the request ID from the context, if there is one, to every record
+type requestIDHandler struct {
+	slog.Handler
+}
+
+func (h requestIDHandler) Handle(ctx context.Context, r slog.Record) error {
+	if id := middleware.GetReqID(ctx); id != "" {
+		r.AddAttrs(slog.String("request_id", id))
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h requestIDHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return requestIDHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h requestIDHandler) WithGroup(name string) slog.Handler {
+	return requestIDHandler{h.Handler.WithGroup(name)}
+}
+
+// validRequestID matches the request IDs RequestID accepts from clients
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._:+=/-]{1,64}$`)
+
+// RequestID gives every request an ID, as chi's RequestID does, but only keeps
+// an X-Request-Id sent by the client if it is short and made of plain
+// characters. Anything else is replaced, so a client can't forge log lines or
+// fill the logs with junk.
+func RequestID(next http.Handler) http.Handler {
+	h := middleware.RequestID(next)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if id := r.Header.Get(middleware.RequestIDHeader); id != "" && !validRequestID.MatchString(id) {
+			r.Header.Del(middleware.RequestIDHeader)
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// withRequestID returns a copy of ctx carrying the request ID, so work done
+// outside the request, such as sending its mail, is logged against it
+func withRequestID(ctx context.Context, id string) context.Context {
+	if id == "" {
+		return ctx
+	}
+	return context.WithValue(ctx, middleware.RequestIDKey, id)
+}
+
+// logError logs an error that stopped a request from being served normally,
+// reporting the caller as the source rather than logError itself
+func (app *Config) logError(r *http.Request, err error) {
+	ctx := r.Context()
+	if !app.Log.Enabled(ctx, slog.LevelError) {
+		return
+	}
+
+	var pcs [1]uintptr
+	runtime.Callers(2, pcs[:])
+
+	rec := slog.NewRecord(time.Now(), slog.LevelError, err.Error(), pcs[0])
+	rec.AddAttrs(slog.String("method", r.Method), slog.String("path", r.URL.Path))
+	_ = app.Log.Handler().Handle(ctx, rec)
+}
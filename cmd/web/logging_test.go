@@ -0,0 +1,47 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-chi/chi/v5/middleware"
+)
+
+func TestRequestID(t *testing.T) {
+	tests := []struct {
+		name string
+		sent string
+		kept bool
+	}{
+		{"none", "", false},
+		{"plain", "abc-123.DEF_456", true},
+		{"uuid", "0b6d5c0e-8f43-4a3a-9c51-3f0f1e6b8a7d", true},
+		{"newline", "abc\nlevel=ERROR msg=forged", false},
+		{"space", "abc def", false},
+		{"too long", strings.Repeat("a", 65), false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got string
+			h := RequestID(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				got = middleware.GetReqID(r.Context())
+			}))
+
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			if tt.sent != "" {
+				r.Header.Set(middleware.RequestIDHeader, tt.sent)
+			}
+			h.ServeHTTP(httptest.NewRecorder(), r)
+
+			if got == "" {
+				t.Fatal("request has no ID")
+			}
+			if kept := got == tt.sent; kept != tt.kept {
+				t.Errorf("got ID %q for %q; kept = %v, want %v", got, tt.sent, kept, tt.kept)
+			}
+		})
+	}
+}
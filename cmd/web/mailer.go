@@ -2,12 +2,18 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
 	"fmt"
-	"html/template"
-	"log"
+	"os"
+	"path/filepath"
 	"sync"
 	"time"
 
+	"concurrent-subscriptions/data"
+
 	"github.com/vanng822/go-premailer/premailer"
 	mail "github.com/xhit/go-simple-mail/v2"
 )
@@ -21,78 +27,265 @@ type Mail struct {
 	Encryption  string
 	FromAddress string
 	FromName    string
-	Wait        *sync.WaitGroup
-	MailerChan  chan Message
-	ErrorChan   chan error
-	DoneChan    chan bool
+	// Wait tracks the running mail workers
+	Wait *sync.WaitGroup
+	// Transport delivers the built emails
+	Transport Transport
+	// Templates holds the parsed mail templates
+	Templates *Templates
+	// Workers is the number of goroutines claiming and sending messages from the outbox
+	Workers int
+	// MaxAttempts is how many times a message is tried before it is dead-lettered
+	MaxAttempts int
+	// RetryDelay is the wait before the first retry; it doubles with each later attempt, up to MaxRetryDelay
+	RetryDelay    time.Duration
+	MaxRetryDelay time.Duration
+	// Lease is how long a worker may hold a claimed message before another worker can take it over
+	Lease time.Duration
+	// PollInterval is how often idle workers check the outbox for messages that have become due
+	PollInterval time.Duration
+	// QueueSize is how many unsent messages the outbox may hold before TrySend refuses new ones
+	QueueSize int
+	// Limiter caps the send rate per recipient domain; nil means unlimited
+	Limiter  *domainLimiter
+	WakeChan chan struct{}
+	// DoneChan is closed at shutdown to tell the workers to send what is due and stop
+	DoneChan chan bool
+	// cancel stops the workers at once, if draining takes too long
+	cancel context.CancelFunc
 }
 
+// mailAbandonGrace is how long shutdown waits for a worker to finish the message
+// it is sending, once draining has run out of time
+const mailAbandonGrace = 10 * time.Second
+
+// mailSendTimeout bounds sending one email. It is longer than the SMTP connect
+// and send timeouts together, so it only cuts off a send that is stuck.
+const mailSendTimeout = 30 * time.Second
+
 type Message struct {
 	From        string
 	FromName    string
 	To          string
 	Subject     string
-	Attachments []string
+	Attachments []Attachment
 	Data        any
 	DataMap     map[string]any
 	Template    string
+	// RequestID is the ID of the request that queued the message, if any
+	RequestID string
+}
+
+// Attachment is a file attached to a Message. Its contents are stored with the
+// message in the outbox, so whichever instance delivers it, however many
+// restarts later, has everything it needs.
+type Attachment struct {
+	Name string
+	Data []byte
+}
+
+// UnmarshalJSON also reads attachments queued before their contents were
+// stored in the outbox, which were saved as the path of a file on disk
+func (a *Attachment) UnmarshalJSON(b []byte) error {
+	var path string
+	if err := json.Unmarshal(b, &path); err == nil {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		*a = Attachment{Name: filepath.Base(path), Data: data}
+		return nil
+	}
+
+	type attachment Attachment
+	return json.Unmarshal(b, (*attachment)(a))
 }
 
+// listenForMail starts the mail workers, which run until drainMail is called at shutdown
 func (app *Config) listenForMail() {
-	app.InfoLog.Println("Listening for mail")
+	app.Log.Info("Listening for mail", "workers", app.Mailer.Workers)
+
+	// cancelling ctx stops the workers straight away, abandoning any outbox
+	// query they are waiting on; it is only used if draining takes too long
+	ctx, cancel := context.WithCancel(context.Background())
+	app.Mailer.cancel = cancel
+
+	for i := 0; i < app.Mailer.Workers; i++ {
+		app.Mailer.Wait.Add(1)
+		go func() {
+			defer app.Mailer.Wait.Done()
+			app.mailWorker(ctx)
+		}()
+	}
+}
+
+// drainMail tells the mail workers to send every message that is already due
+// and then stop, and waits up to timeout for them. Anything still unsent stays
+// in the outbox and goes out after the next start, so no email is lost.
+func (app *Config) drainMail(timeout time.Duration) {
+	close(app.Mailer.DoneChan)
+
+	if waitTimeout(app.Mailer.Wait, timeout) {
+		return
+	}
+
+	app.Log.Warn("Mail queue not drained in time; the rest will be sent after restart", "timeout", timeout)
+	app.Mailer.cancel()
+
+	if !waitTimeout(app.Mailer.Wait, mailAbandonGrace) {
+		app.Log.Error("Mail workers did not stop; a message being sent may be sent again after restart")
+	}
+}
+
+// mailWorker claims due messages from the outbox and sends them, one at a time.
+// When the outbox is empty it sleeps until a new message is queued or the poll
+// interval passes, whichever comes first. Once DoneChan is closed it stops as
+// soon as nothing is due, and it stops at once if ctx is cancelled.
+func (app *Config) mailWorker(ctx context.Context) {
+	ticker := time.NewTicker(app.Mailer.PollInterval)
+	defer ticker.Stop()
+
 	for {
 		select {
-		case msg := <-app.Mailer.MailerChan:
-			app.InfoLog.Println("Sending email")
-			go app.Mailer.sendMail(msg, app.Mailer.ErrorChan)
-		case err := <-app.Mailer.ErrorChan:
-			app.ErrorLog.Println("Error sending email: ", err)
-		case <-app.Mailer.DoneChan:
-			app.Mailer.Wait.Done()
+		case <-ctx.Done():
 			return
+		default:
 		}
+
+		msg, err := app.Models.Outbox.ClaimNext(ctx, app.Mailer.Lease)
+		if err != nil {
+			if !errors.Is(err, sql.ErrNoRows) && ctx.Err() == nil {
+				app.Log.ErrorContext(ctx, "Error claiming email from outbox", "error", err)
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-app.Mailer.DoneChan:
+				return
+			case <-app.Mailer.WakeChan:
+			case <-ticker.C:
+			}
+			continue
+		}
+
+		app.deliver(ctx, msg)
 	}
 }
 
-// sendMail sends the message as an email
-func (m *Mail) sendMail(msg Message, errorChan chan error) {
-	log.Println("In sendMail...")
-	defer m.Wait.Done()
-	formattedMessage, plainTextMessage := m.buildMessages(&msg, errorChan)
-	email := m.buildEmail(&msg, plainTextMessage, formattedMessage)
-	server := m.setupMailServer()
+// deliver sends one claimed outbox message and records the outcome. Failed
+// messages are retried with exponential backoff until they run out of attempts,
+// at which point they are dead-lettered.
+func (app *Config) deliver(ctx context.Context, row *data.OutboxMessage) {
+	// the outcome is recorded even if the workers are being cancelled; otherwise
+	// an email that was sent would be sent again once its lease ran out
+	ctx = context.WithoutCancel(ctx)
 
-	log.Println("Connecting to mail server...")
-	smtpClient, err := server.Connect()
+	var msg Message
+	if err := json.Unmarshal(row.Payload, &msg); err != nil {
+		app.Log.Error("Dead-lettering unreadable email", "email_id", row.ID, "error", err)
+		if err := app.Models.Outbox.MarkDead(ctx, row.ID, err.Error()); err != nil {
+			app.Log.Error("Error updating outbox", "email_id", row.ID, "error", err)
+		}
+		return
+	}
+
+	ctx = withRequestID(ctx, msg.RequestID)
+
+	// respect the per-domain rate limit without using up an attempt
+	if app.Mailer.Limiter != nil {
+		if wait := app.Mailer.Limiter.Take(recipientDomain(msg.To)); wait > 0 {
+			if err := app.Models.Outbox.Postpone(ctx, row.ID, time.Now().Add(wait)); err != nil {
+				app.Log.ErrorContext(ctx, "Error updating outbox", "email_id", row.ID, "error", err)
+			}
+			return
+		}
+	}
+
+	app.Log.InfoContext(ctx, "Sending email", "email_id", row.ID, "to", msg.To, "attempt", row.Attempts, "max_attempts", row.MaxAttempts)
+	start := time.Now()
+	sendCtx, cancel := context.WithTimeout(ctx, mailSendTimeout)
+	sendErr := app.Mailer.sendMail(sendCtx, msg)
+	cancel()
+	app.Metrics.MailDuration.Observe(time.Since(start).Seconds())
+
+	var err error
+	switch {
+	case sendErr == nil:
+		app.Metrics.MailSent.Inc()
+		err = app.Models.Outbox.MarkSent(ctx, row.ID)
+	case row.Attempts >= row.MaxAttempts:
+		app.Metrics.MailFailed.Inc("dead")
+		app.Log.ErrorContext(ctx, "Dead-lettering email", "email_id", row.ID, "to", msg.To, "attempts", row.Attempts, "error", sendErr)
+		err = app.Models.Outbox.MarkDead(ctx, row.ID, sendErr.Error())
+	default:
+		app.Metrics.MailFailed.Inc("retry")
+		retryAt := time.Now().Add(app.Mailer.retryDelay(row.Attempts))
+		app.Log.WarnContext(ctx, "Error sending email, will retry", "email_id", row.ID, "to", msg.To, "retry_at", retryAt, "error", sendErr)
+		err = app.Models.Outbox.MarkFailed(ctx, row.ID, sendErr.Error(), retryAt)
+	}
+
+	if err != nil {
+		app.Log.ErrorContext(ctx, "Error updating outbox", "email_id", row.ID, "error", err)
+	}
+}
+
+// retryDelay returns how long to wait before retrying a message that has failed the given number of attempts
+func (m *Mail) retryDelay(attempts int) time.Duration {
+	delay := m.RetryDelay
+	for i := 1; i < attempts && delay < m.MaxRetryDelay; i++ {
+		delay *= 2
+	}
+
+	if delay > m.MaxRetryDelay {
+		delay = m.MaxRetryDelay
+	}
+
+	return delay
+}
+
+// sendMail sends the message as an email. If ctx ends first, it gives up
+// waiting and returns an error; the send may still finish in the background,
+// in which case the message is sent twice when it is retried.
+func (m *Mail) sendMail(ctx context.Context, msg Message) error {
+	formattedMessage, plainTextMessage, err := m.buildMessages(&msg)
 	if err != nil {
-		log.Println("Error connecting to mail server")
-		errorChan <- err
+		return err
 	}
-	log.Println("Connected to mail server...")
 
-	if err := email.Send(smtpClient); err != nil {
-		log.Println("Error sending email: ", err)
-		errorChan <- err
+	email := m.buildEmail(&msg, plainTextMessage, formattedMessage)
+	if email.Error != nil {
+		return email.Error
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- m.Transport.Send(email)
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return fmt.Errorf("sending email: %w", ctx.Err())
 	}
 }
 
 // buildEmail build the email object with the message and attachments
 func (*Mail) buildEmail(msg *Message, plainTextMessage string, formattedMessage string) *mail.Email {
-	log.Println("In buildEmail")
 	email := mail.NewMSG()
 	email.SetFrom(msg.From).AddTo(msg.To).SetSubject(msg.Subject)
 	email.SetBody(mail.TextPlain, plainTextMessage).AddAlternative(mail.TextHTML, formattedMessage)
 	for _, attachment := range msg.Attachments {
-		email.AddAttachment(attachment)
+		email.Attach(&mail.File{Name: attachment.Name, Data: attachment.Data})
 	}
 	return email
 }
 
 // buildMessages builds the HTML and plain text messages for the email
-func (m *Mail) buildMessages(msg *Message, errorChan chan error) (string, string) {
-	log.Println("In buildMessages")
+func (m *Mail) buildMessages(msg *Message) (string, string, error) {
 	if msg.Template == "" {
-		msg.Template = "default"
+		msg.Template = "mail"
 	}
 	if msg.From == "" {
 		msg.From = m.FromAddress
@@ -108,20 +301,19 @@ func (m *Mail) buildMessages(msg *Message, errorChan chan error) (string, string
 	msg.DataMap = data
 	formattedMessage, err := m.buildHTMLMessage(msg)
 	if err != nil {
-		errorChan <- err
+		return "", "", err
 	}
 
 	plainTextMessage, err := m.buildPlainTextMessage(msg)
 	if err != nil {
-		errorChan <- err
+		return "", "", err
 	}
 
-	return formattedMessage, plainTextMessage
+	return formattedMessage, plainTextMessage, nil
 }
 
 // setupMailServer sets up the mail server
 func (m *Mail) setupMailServer() *mail.SMTPServer {
-	log.Println("In setupMailServer")
 	server := mail.NewSMTPClient()
 	server.Host = m.Host
 	server.Port = m.Port
@@ -136,25 +328,19 @@ func (m *Mail) setupMailServer() *mail.SMTPServer {
 
 // buildHTMLMessage builds the HTML message for the email
 func (m *Mail) buildHTMLMessage(msg *Message) (string, error) {
-	log.Println("In buildHTMLMessage")
-	templateToRender := fmt.Sprintf("/Users/kodylow/Documents/github/golang/concurrent-subscriptions/cmd/web/templates/%s.html.gohtml", msg.Template)
-
-	t, err := template.New("email-html").ParseFiles(templateToRender)
+	t, err := m.Templates.MailHTML(msg.Template)
 	if err != nil {
-		log.Println("Error parsing template: ", err)
 		return "", err
 	}
 
 	var tpl bytes.Buffer
 	if err := t.ExecuteTemplate(&tpl, "body", msg.DataMap); err != nil {
-		log.Println("Error executing template: ", err)
 		return "", err
 	}
 
 	formattedMessage := tpl.String()
 	formattedMessage, err = m.inlineCSS(formattedMessage)
 	if err != nil {
-		log.Println("Error inlining CSS: ", err)
 		return "", err
 	}
 
@@ -163,10 +349,7 @@ func (m *Mail) buildHTMLMessage(msg *Message) (string, error) {
 
 // buildPlainTextMessage builds the plain text message for the email
 func (m *Mail) buildPlainTextMessage(msg *Message) (string, error) {
-	log.Println("In buildPlainTextMessage")
-	templateToRender := fmt.Sprintf("/Users/kodylow/Documents/github/golang/concurrent-subscriptions/cmd/web/templates/%s.plain.gohtml", msg.Template)
-
-	t, err := template.New("email-plain").ParseFiles(templateToRender)
+	t, err := m.Templates.MailText(msg.Template)
 	if err != nil {
 		return "", err
 	}
@@ -182,7 +365,6 @@ func (m *Mail) buildPlainTextMessage(msg *Message) (string, error) {
 }
 
 func (m *Mail) inlineCSS(s string) (string, error) {
-	log.Println("In inlineCSS")
 	options := premailer.Options{
 		RemoveClasses:     false,
 		CssToAttributes:   false,
@@ -204,7 +386,6 @@ func (m *Mail) inlineCSS(s string) (string, error) {
 
 // getEncryption returns the encryption type for the mail server
 func (m *Mail) getEncryption(e string) mail.Encryption {
-	log.Println("In getEncryption")
 	switch e {
 	case "tls":
 		return mail.EncryptionSTARTTLS
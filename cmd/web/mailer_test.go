@@ -0,0 +1,89 @@
+package main
+
+import (
+	"concurrent-subscriptions/data"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDeliverAttachments(t *testing.T) {
+	pdf := []byte("%PDF-1.4 not really a pdf")
+
+	// messages queued before attachment contents were stored in the outbox held a path
+	legacyPath := filepath.Join(t.TempDir(), "INV-0001.pdf")
+	if err := os.WriteFile(legacyPath, pdf, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	legacy := func(path string) []byte {
+		b, err := json.Marshal(map[string]any{"To": "alice@example.com", "Subject": "Invoice", "Data": "Hello", "Attachments": []string{path}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+
+	current, err := json.Marshal(Message{
+		To:          "alice@example.com",
+		Subject:     "Invoice",
+		Data:        "Hello",
+		Attachments: []Attachment{{Name: "INV-0002.pdf", Data: pdf}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		payload  []byte
+		status   string
+		filename string
+	}{
+		{"stored in the outbox", current, data.OutboxSent, "INV-0002.pdf"},
+		{"legacy path", legacy(legacyPath), data.OutboxSent, "INV-0001.pdf"},
+		{"legacy path that is gone", legacy(filepath.Join(t.TempDir(), "missing.pdf")), data.OutboxDead, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApp(t)
+			transport := app.Mailer.Transport.(*MemoryTransport)
+
+			if _, err := app.Models.Outbox.Enqueue(context.Background(), tt.payload, app.Mailer.MaxAttempts); err != nil {
+				t.Fatal(err)
+			}
+
+			app.listenForMail()
+			app.drainMail(5 * time.Second)
+
+			messages := outbox(app).Messages()
+			if len(messages) != 1 || messages[0].Status != tt.status {
+				t.Fatalf("outbox holds %+v, want one %s message", messages, tt.status)
+			}
+
+			sent := transport.Messages()
+			if tt.filename == "" {
+				if len(sent) != 0 {
+					t.Errorf("sent %d emails, want none", len(sent))
+				}
+				return
+			}
+
+			if len(sent) != 1 {
+				t.Fatalf("sent %d emails, want 1", len(sent))
+			}
+			raw := sent[0].Raw
+			if !strings.Contains(raw, tt.filename) {
+				t.Errorf("email doesn't attach %s", tt.filename)
+			}
+			if !strings.Contains(strings.ReplaceAll(raw, "\r\n", ""), base64.StdEncoding.EncodeToString(pdf)) {
+				t.Error("email doesn't hold the attachment's contents")
+			}
+		})
+	}
+}
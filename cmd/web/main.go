@@ -5,7 +5,10 @@ import (
 	"context"
 	"database/sql"
 	"encoding/gob"
+	"errors"
+	"fmt"
 	"log"
+	"log/slog"
 	"net/http"
 	"os"
 	"os/signal"
@@ -19,107 +22,153 @@ import (
 	_ "github.com/jackc/pgconn"
 	_ "github.com/jackc/pgx/v5"
 	_ "github.com/jackc/pgx/v5/stdlib"
-	"github.com/joho/godotenv"
 )
 
-const webPort = "3000"
-
 func main() {
-	log.Printf("Starting application...")
-	// load environment variables
-	if err := loadEnv(); err != nil {
+	// schema migrations are run with: web migrate up|down N|status|baseline N
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		if err := runMigrate(os.Args[2:], os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	// load configuration. Until the logger exists, errors go to stderr as plain text.
+	settings, err := loadSettings(os.Args[1:])
+	if err != nil {
 		log.Fatal(err)
 	}
 
-	// connect to the database
-	db := initDB()
-	defer db.Close()
-	db.Ping()
+	// create the logger; anything written with the log package goes through it too
+	logger, err := newLogger(os.Stdout, settings.LogLevel, settings.LogFormat)
+	if err != nil {
+		log.Fatal(err)
+	}
+	slog.SetDefault(logger)
+	logger.Info("Starting application...")
+
+	if settings.MetricsToken == "" {
+		logger.Warn("METRICS_TOKEN is not set, so /metrics is public to anyone who can reach the server")
+	}
+
+	// connect to the database; it is closed by shutdown
+	db := initDB(settings.DSN)
+
+	// connect to redis; it is closed by shutdown
+	redisPool := newRedisPool(settings.RedisAddr)
+
+	// create metrics
+	metrics := NewMetrics()
 
 	// create sessions
-	session := initSession()
+	session := initSession(settings, redisPool, metrics)
 
-	// create loggers
-	infoLog := log.New(os.Stdout, "INFO\t", log.Ldate|log.Ltime)
-	errorLog := log.New(os.Stdout, "ERROR\t", log.Ldate|log.Ltime|log.Lshortfile)
+	// parse templates
+	templates, err := NewTemplates(settings.DevMode)
+	if err != nil {
+		fatal("Could not parse templates", err)
+	}
 
-	// create channels
+	// create the box that encrypts two-factor secrets
+	secrets, err := NewSecretBox(settings.TOTPKey)
+	if err != nil {
+		fatal("Could not set up encryption", err)
+	}
 
 	// create waitgroup
 	wg := sync.WaitGroup{}
 
 	// set up the application config
 	app := Config{
-		Session:  session,
-		DB:       db,
-		InfoLog:  infoLog,
-		ErrorLog: errorLog,
-		Wait:     &wg,
-		Models:   data.New(db),
+		Session:   session,
+		DB:        db,
+		Redis:     redisPool,
+		Log:       logger,
+		Wait:      &wg,
+		Models:    data.New(db, settings.DBTimeout),
+		Signer:    NewSigner(settings.SigningSecret),
+		Secrets:   secrets,
+		Templates: templates,
+		Settings:  settings,
+		Metrics:   metrics,
+		LoginLimiter: &LoginLimiter{
+			Store:       &RedisLimiterStore{Pool: redisPool},
+			MaxPerIP:    settings.Login.MaxPerIP,
+			MaxPerEmail: settings.Login.MaxPerEmail,
+			Window:      settings.Login.Window,
+			LockoutFor:  settings.Login.LockoutFor,
+		},
+	}
+
+	// log session store errors against the request they happened in
+	session.ErrorFunc = func(w http.ResponseWriter, r *http.Request, err error) {
+		app.logError(r, err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 	}
 
 	// set up and listen for mail
 	app.Mailer = app.createMailer()
-	go app.listenForMail()
-
-	// listen for signals
-	go app.listenForShutdown()
+	app.listenForMail()
 
-	// listen for web connections
+	// listen for web connections until we are told to stop
 	app.serve()
-
 }
 
+// serve runs the HTTP server until a SIGINT or SIGTERM has been handled by shutdown
 func (app *Config) serve() {
 	srv := &http.Server{
-		Addr:         ":" + webPort,
+		Addr:         fmt.Sprintf(":%d", app.Settings.Port),
 		Handler:      app.routes(),
-		ErrorLog:     app.ErrorLog,
+		ErrorLog:     slog.NewLogLogger(app.Log.Handler(), slog.LevelError),
 		ReadTimeout:  5 * time.Second,
 		WriteTimeout: 10 * time.Second,
 		IdleTimeout:  120 * time.Second,
 	}
 
-	app.InfoLog.Printf("Starting server on port %s", webPort)
+	// listen for signals
+	done := make(chan struct{})
+	go app.listenForShutdown(srv, done)
+
+	app.Log.Info("Starting server", "port", app.Settings.Port)
 	err := srv.ListenAndServe()
-	if err != nil {
-		app.ErrorLog.Fatal(err)
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		app.Log.Error("Server stopped", "error", err)
+		os.Exit(1)
 	}
+
+	<-done
 }
 
-// loadEnv loads environment variables from a .env file
-func loadEnv() error {
-	// load environment variables from .env file
-	log.Printf("Loading environment variables from .env file...")
-	if err := godotenv.Load(); err != nil {
-		return err
+// fatal logs an error the application can't start without, and exits
+func fatal(msg string, err error) {
+	if err != nil {
+		slog.Error(msg, "error", err)
+	} else {
+		slog.Error(msg)
 	}
-
-	return nil
+	os.Exit(1)
 }
 
 // initDB initializes the database connection
-func initDB() *sql.DB {
+func initDB(dsn string) *sql.DB {
 	// open the database connection
-	log.Printf("Connecting to database...")
-	conn := connectToDB()
+	slog.Info("Connecting to database...")
+	conn := connectToDB(dsn)
 	if conn == nil {
-		log.Fatal("Could not connect to database")
+		fatal("Could not connect to database", nil)
 	}
 
 	return conn
 }
 
 // connectToDB attempts to connect to the database
-func connectToDB() *sql.DB {
+func connectToDB(dsn string) *sql.DB {
 	attempts := 0
 
-	dsn := os.Getenv("DB_DSN")
-
 	for {
 		conn, err := openDB(dsn)
 		if err != nil {
-			log.Printf("Could not connect to postgres: %s", err)
+			slog.Warn("Could not connect to postgres", "error", err)
 		} else {
 			return conn
 		}
@@ -128,15 +177,15 @@ func connectToDB() *sql.DB {
 			return nil
 		}
 
-		log.Printf("Retrying postgres connection in 1 second...")
+		slog.Info("Retrying postgres connection in 1 second...")
 		time.Sleep(time.Second)
 		attempts++
 	}
 }
 
-// openDB opens a connection to the database
+// openDB opens a connection to the database. The DSN holds the database
+// password, so it is never logged.
 func openDB(dsn string) (*sql.DB, error) {
-	log.Printf("Opening database connection: %s", dsn)
 	db, err := sql.Open("pgx", dsn)
 	if err != nil {
 		return nil, err
@@ -150,29 +199,27 @@ func openDB(dsn string) (*sql.DB, error) {
 }
 
 // initSession initializes the session
-func initSession() *scs.SessionManager {
-	log.Printf("Initializing session...")
+func initSession(settings Settings, redisPool *redis.Pool, metrics *Metrics) *scs.SessionManager {
+	slog.Info("Initializing session...")
 	gob.Register(data.User{})
 	session := scs.New()
+	session.Store = &metricsStore{store: redisstore.New(redisPool), errors: metrics.SessionErrors}
 
-	redisPool := newRedisPool()
-	session.Store = redisstore.New(redisPool)
-
-	session.Lifetime = 24 * time.Hour
+	session.Lifetime = settings.SessionLifetime
 	session.Cookie.Persist = true
 	session.Cookie.SameSite = http.SameSiteLaxMode
-	session.Cookie.Secure = true
+	session.Cookie.Secure = settings.CookieSecure
 
 	return session
 }
 
 // newRedisPool initializes the Redis connection pool
-func newRedisPool() *redis.Pool {
-	log.Printf("Initializing Redis...")
+func newRedisPool(addr string) *redis.Pool {
+	slog.Info("Initializing Redis...")
 
 	redisPool := &redis.Pool{
 		DialContext: func(ctx context.Context) (redis.Conn, error) {
-			return redis.Dial("tcp", os.Getenv("REDIS"))
+			return redis.Dial("tcp", addr)
 		},
 	}
 
@@ -182,57 +229,97 @@ func newRedisPool() *redis.Pool {
 
 	_, err := conn.Do("PING")
 	if err != nil {
-		log.Fatalf("Could not connect to Redis: %v", err)
+		fatal("Could not connect to Redis", err)
 	}
 
 	return redisPool
 }
 
-func (app *Config) listenForShutdown() {
+// listenForShutdown waits for SIGINT or SIGTERM, shuts the application down
+// and then closes done
+func (app *Config) listenForShutdown(srv *http.Server, done chan<- struct{}) {
 	quit := make(chan os.Signal, 1)
 	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
 	<-quit
-	app.shutdown()
-	os.Exit(0)
+	app.shutdown(srv)
+	close(done)
 }
 
-func (app *Config) shutdown() {
-	// cleanup tasks
-	app.InfoLog.Println("Cleaning up for shutdown...")
+// shutdown stops the application in order: stop taking requests and let the
+// ones in flight finish, finish background work, send the mail that is due,
+// and only then close the database and Redis, which all of those rely on.
+func (app *Config) shutdown(srv *http.Server) {
+	app.Log.Info("Cleaning up for shutdown")
+
+	// stop accepting connections and wait for in-flight requests
+	ctx, cancel := context.WithTimeout(context.Background(), app.Settings.ShutdownTimeout)
+	defer cancel()
 
-	// block until waitgroup is empty
-	app.Wait.Wait()
-	app.Mailer.DoneChan <- true
+	if err := srv.Shutdown(ctx); err != nil {
+		app.Log.Error("Error shutting down HTTP server", "error", err)
+	}
+
+	// finish background work, such as invoices, which may queue more mail
+	app.Log.Info("Waiting for background work")
+	app.stopBackground()
+	if !waitTimeout(app.Wait, app.Settings.ShutdownTimeout) {
+		app.Log.Error("Background work did not finish in time")
+	}
 
-	// close channels
-	app.InfoLog.Println("Closing channels...")
-	close(app.Mailer.ErrorChan)
-	close(app.Mailer.MailerChan)
-	close(app.Mailer.DoneChan)
+	// send the mail that is due
+	app.Log.Info("Draining mail queue")
+	app.drainMail(app.Settings.Mail.DrainTimeout)
+
+	// close connections
+	app.Log.Info("Closing connections")
+	if err := app.DB.Close(); err != nil {
+		app.Log.Error("Error closing database", "error", err)
+	}
+	if err := app.Redis.Close(); err != nil {
+		app.Log.Error("Error closing Redis", "error", err)
+	}
 
-	// shutdown
-	app.InfoLog.Println("Shutdown complete")
+	app.Log.Info("Shutdown complete")
 }
 
 func (app *Config) createMailer() Mail {
 	// create channels
-	errorChan := make(chan error)
-	mailerChan := make(chan Message, 100)
+	wakeChan := make(chan struct{}, 1)
 	doneChan := make(chan bool)
 
 	// create mailer
 	m := Mail{
-		Domain:      "localhost",
-		Host:        "localhost",
-		Port:        1025,
-		Encryption:  "none",
-		FromName:    "Info",
-		FromAddress: "info@mycompany.com",
-		Wait:        app.Wait,
-		ErrorChan:   errorChan,
-		MailerChan:  mailerChan,
-		DoneChan:    doneChan,
+		Domain:        app.Settings.SMTP.Domain,
+		Host:          app.Settings.SMTP.Host,
+		Port:          app.Settings.SMTP.Port,
+		Username:      app.Settings.SMTP.Username,
+		Password:      app.Settings.SMTP.Password,
+		Encryption:    app.Settings.SMTP.Encryption,
+		FromName:      app.Settings.SMTP.FromName,
+		FromAddress:   app.Settings.SMTP.FromAddress,
+		Wait:          &sync.WaitGroup{},
+		Templates:     app.Templates,
+		Workers:       app.Settings.Mail.Workers,
+		MaxAttempts:   app.Settings.Mail.MaxAttempts,
+		RetryDelay:    30 * time.Second,
+		MaxRetryDelay: time.Hour,
+		Lease:         2 * time.Minute,
+		PollInterval:  5 * time.Second,
+		QueueSize:     app.Settings.Mail.QueueSize,
+		WakeChan:      wakeChan,
+		DoneChan:      doneChan,
+	}
+
+	if app.Settings.Mail.DomainRate > 0 {
+		m.Limiter = newDomainLimiter(app.Settings.Mail.DomainRate, app.Settings.Mail.DomainBurst)
+	}
+
+	// pick how mail is delivered
+	transport, err := newTransport(app.Settings.Mail.Driver, &m, app.Settings.Mail.FileDir)
+	if err != nil {
+		fatal("Could not set up mailer", err)
 	}
+	m.Transport = transport
 
 	return m
 }
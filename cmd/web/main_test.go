@@ -0,0 +1,113 @@
+package main
+
+import (
+	"concurrent-subscriptions/data"
+	"context"
+	"fmt"
+	mail "github.com/xhit/go-simple-mail/v2"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// slowTransport is a MemoryTransport that takes delay to send each email
+type slowTransport struct {
+	MemoryTransport
+	delay time.Duration
+}
+
+func (t *slowTransport) Send(email *mail.Email) error {
+	time.Sleep(t.delay)
+	return t.MemoryTransport.Send(email)
+}
+
+func TestShutdownDrainsMail(t *testing.T) {
+	tests := []struct {
+		name     string
+		delay    time.Duration
+		drainFor time.Duration
+		allSent  bool
+	}{
+		{"drained in time", 0, 5 * time.Second, true},
+		{"drain times out", 50 * time.Millisecond, 120 * time.Millisecond, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApp(t)
+			app.Settings.Mail.DrainTimeout = tt.drainFor
+			transport := &slowTransport{delay: tt.delay}
+			app.Mailer.Transport = transport
+			user := addUser(t, app, "alice@example.com", "correct horse")
+
+			srv := startTestServer(t, app)
+			app.listenForMail()
+
+			// mail queued directly and by a background job, which shutdown must wait for
+			const queued = 10
+			for i := 0; i < queued; i++ {
+				msg := Message{To: fmt.Sprintf("user%d@example.com", i), Subject: "Hello", Data: "Hello"}
+				if err := app.sendEmail(context.Background(), msg); err != nil {
+					t.Fatal(err)
+				}
+			}
+			app.sendManual(context.Background(), *user, testPlans[0])
+
+			app.shutdown(srv)
+
+			messages := outbox(app).Messages()
+			if len(messages) != queued+1 {
+				t.Fatalf("outbox has %d messages, want %d", len(messages), queued+1)
+			}
+
+			sent := 0
+			for _, msg := range messages {
+				switch msg.Status {
+				case data.OutboxSent:
+					sent++
+				case data.OutboxPending:
+					if tt.allSent {
+						t.Errorf("message %d is still pending", msg.ID)
+					}
+				default:
+					t.Errorf("message %d is %s, want sent or pending", msg.ID, msg.Status)
+				}
+			}
+
+			if got := len(transport.Messages()); got != sent {
+				t.Errorf("transport sent %d emails, but %d are marked sent", got, sent)
+			}
+			if !tt.allSent && sent == len(messages) {
+				t.Error("every message was sent; the drain timeout was never reached")
+			}
+
+			// background jobs are refused once shutdown has started
+			app.sendManual(context.Background(), *user, testPlans[0])
+			app.Wait.Wait()
+			if n := len(outbox(app).Messages()); n != len(messages) {
+				t.Errorf("a background job queued mail after shutdown")
+			}
+		})
+	}
+}
+
+// startTestServer serves the app's routes on a local port, and gives the app a
+// database and Redis pool that shutdown can close without them being reachable
+func startTestServer(t *testing.T, app *Config) *http.Server {
+	t.Helper()
+
+	addUnusedPools(t, app)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := &http.Server{Handler: app.routes()}
+	go func() {
+		_ = srv.Serve(ln)
+	}()
+
+	return srv
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"concurrent-subscriptions/data"
+	"context"
+	"fmt"
+)
+
+// sendConfirmation emails the user to confirm their new plan. It runs in the
+// background, like generateInvoice.
+func (app *Config) sendConfirmation(ctx context.Context, user data.User, plan data.Plan) {
+	app.runInBackground(ctx, func(ctx context.Context) {
+		msg := Message{
+			To:       user.Email,
+			Subject:  "Your subscription is confirmed",
+			Template: "mail",
+			Data:     fmt.Sprintf("You are now subscribed to the %s. Your manual and invoice follow in separate emails.", plan.PlanName),
+		}
+		if err := app.sendEmail(ctx, msg); err != nil {
+			app.Log.ErrorContext(ctx, "Error emailing subscription confirmation", "error", err)
+		}
+	})
+}
+
+// sendManual emails the user the manual for their new plan, in the background
+func (app *Config) sendManual(ctx context.Context, user data.User, plan data.Plan) {
+	app.runInBackground(ctx, func(ctx context.Context) {
+		msg := Message{
+			To:       user.Email,
+			Subject:  "Your " + plan.PlanName + " manual",
+			Template: "mail",
+			Data:     fmt.Sprintf("Your manual for the %s is attached.", plan.PlanName),
+			Attachments: []Attachment{
+				{Name: plan.PlanName + " Manual.pdf", Data: renderManualPDF(user, plan)},
+			},
+		}
+		if err := app.sendEmail(ctx, msg); err != nil {
+			app.Log.ErrorContext(ctx, "Error emailing manual", "error", err)
+		}
+	})
+}
+
+// renderManualPDF lays out the plan manual for a user as a one page PDF
+func renderManualPDF(user data.User, plan data.Plan) []byte {
+	const left = 72.0
+
+	doc := NewPDF()
+	doc.AddPage()
+
+	doc.Text(left, 90, 24, true, plan.PlanName+" Manual")
+	doc.Line(left, 104, pdfPageWidth-72, 104)
+
+	lines := []string{
+		fmt.Sprintf("Hello %s,", user.FirstName),
+		"",
+		fmt.Sprintf("Welcome to the %s. Your subscription costs %s per month.", plan.PlanName, plan.PlanAmountFormatted),
+		"",
+		"Getting started:",
+		"  1. Log in with the email address you registered with.",
+		"  2. Visit the Plans page at any time to see or switch your plan.",
+		"  3. Your invoices are emailed to you as each subscription starts.",
+		"",
+		"If you have any questions, just reply to this email.",
+	}
+
+	y := 136.0
+	for _, line := range lines {
+		doc.Text(left, y, 11, false, line)
+		y += 17
+	}
+
+	return doc.Bytes()
+}
@@ -0,0 +1,368 @@
+package main
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"concurrent-subscriptions/data"
+
+	"github.com/alexedwards/scs/v2"
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+)
+
+// requestBuckets are the upper bounds, in seconds, of the HTTP latency histogram
+var requestBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// mailBuckets are the upper bounds, in seconds, of the mail send latency histogram.
+// Sending goes through an SMTP relay, so it is much slower than serving a page.
+var mailBuckets = []float64{.05, .1, .25, .5, 1, 2.5, 5, 10, 30}
+
+// Metrics holds the counters and histograms the application updates as it runs.
+// They are written out in the Prometheus text format by MetricsPage; values that
+// can be read at any time, such as the database pool stats, are read there instead.
+type Metrics struct {
+	Requests        *counterVec
+	RequestDuration *histogramVec
+	MailSent        *counterVec
+	MailFailed      *counterVec
+	MailDuration    *histogramVec
+	SessionErrors   *counterVec
+	BackgroundJobs  atomic.Int64
+}
+
+// NewMetrics returns a Metrics with every value at zero
+func NewMetrics() *Metrics {
+	return &Metrics{
+		Requests:        newCounterVec("method", "route", "code"),
+		RequestDuration: newHistogramVec(requestBuckets, "method", "route"),
+		MailSent:        newCounterVec(),
+		MailFailed:      newCounterVec("outcome"),
+		MailDuration:    newHistogramVec(mailBuckets),
+		SessionErrors:   newCounterVec("op"),
+	}
+}
+
+// RecordRequests counts every request and how long it took, labelled with the
+// chi route pattern rather than the path, so /admin/users/1 and /admin/users/2
+// are counted together. It must come before Recoverer, so it sees the status
+// code Recoverer writes.
+func (app *Config) RecordRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+
+		next.ServeHTTP(ww, r)
+
+		// requests that match no route are counted together, so
+		// scanners probing random paths can't create new series
+		route := "unmatched"
+		if rctx := chi.RouteContext(r.Context()); rctx != nil && rctx.RoutePattern() != "" {
+			route = rctx.RoutePattern()
+		}
+
+		code := ww.Status()
+		if code == 0 {
+			code = http.StatusOK
+		}
+
+		method := methodLabel(r.Method)
+		app.Metrics.Requests.Inc(method, route, strconv.Itoa(code))
+		app.Metrics.RequestDuration.Observe(time.Since(start).Seconds(), method, route)
+	})
+}
+
+// methodLabel returns the method to label a request's metrics with. Methods
+// outside the standard set are counted together as "other", as any client can
+// send whatever method it likes.
+func methodLabel(method string) string {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch,
+		http.MethodDelete, http.MethodConnect, http.MethodOptions, http.MethodTrace:
+		return method
+	default:
+		return "other"
+	}
+}
+
+// MetricsPage writes every metric in the Prometheus text exposition format. If
+// METRICS_TOKEN is set, the scraper must send it as a bearer token; otherwise
+// anyone who can reach the server can read it. If the outbox can't be counted,
+// its samples are left out and mail_outbox_scrape_error is 1, so an outage
+// doesn't cost every other metric.
+func (app *Config) MetricsPage(w http.ResponseWriter, r *http.Request) {
+	want := "Bearer " + app.Settings.MetricsToken
+	if app.Settings.MetricsToken != "" && subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte(want)) != 1 {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	outbox, outboxErr := app.Models.Outbox.CountByStatus(r.Context())
+	if outboxErr != nil {
+		app.Log.ErrorContext(r.Context(), "Error counting outbox for metrics", "error", outboxErr)
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+
+	buf := bufio.NewWriter(w)
+	m := app.Metrics
+
+	m.Requests.write(buf, "http_requests_total", "HTTP requests served, by method, route pattern and status code.")
+	m.RequestDuration.write(buf, "http_request_duration_seconds", "How long HTTP requests took to serve, by method and route pattern.")
+
+	writeHeader(buf, "mail_outbox_messages", "gauge", "Messages in the mail outbox that haven't been sent, by status.")
+	if outboxErr == nil {
+		for _, status := range []string{data.OutboxPending, data.OutboxSending, data.OutboxDead} {
+			writeSample(buf, "mail_outbox_messages", labels([]string{"status"}, []string{status}), float64(outbox[status]))
+		}
+	}
+	scrapeError := 0.0
+	if outboxErr != nil {
+		scrapeError = 1
+	}
+	writeGauge(buf, "mail_outbox_scrape_error", "1 if the mail outbox couldn't be counted for this scrape, otherwise 0.", scrapeError)
+
+	m.MailSent.write(buf, "mail_sent_total", "Emails sent successfully.")
+	m.MailFailed.write(buf, "mail_send_failures_total", "Failed email sends, by whether the message will be retried or was dead-lettered.")
+	m.MailDuration.write(buf, "mail_send_duration_seconds", "How long sending an email took, successful or not.")
+
+	stats := app.DB.Stats()
+	writeGauge(buf, "db_pool_max_open_connections", "Maximum number of open database connections.", float64(stats.MaxOpenConnections))
+	writeGauge(buf, "db_pool_open_connections", "Open database connections, in use or idle.", float64(stats.OpenConnections))
+	writeGauge(buf, "db_pool_in_use_connections", "Database connections currently in use.", float64(stats.InUse))
+	writeGauge(buf, "db_pool_idle_connections", "Idle database connections.", float64(stats.Idle))
+	writeCounter(buf, "db_pool_wait_total", "Times a query had to wait for a free database connection.", float64(stats.WaitCount))
+	writeCounter(buf, "db_pool_wait_seconds_total", "Total time spent waiting for a free database connection.", stats.WaitDuration.Seconds())
+	writeCounter(buf, "db_pool_max_idle_closed_total", "Connections closed because the idle pool was full.", float64(stats.MaxIdleClosed))
+	writeCounter(buf, "db_pool_max_idle_time_closed_total", "Connections closed because they were idle too long.", float64(stats.MaxIdleTimeClosed))
+	writeCounter(buf, "db_pool_max_lifetime_closed_total", "Connections closed because they reached their maximum lifetime.", float64(stats.MaxLifetimeClosed))
+
+	m.SessionErrors.write(buf, "session_store_errors_total", "Errors from the Redis session store, by operation.")
+
+	writeGauge(buf, "background_jobs", "Background jobs, such as invoices, that are running now.", float64(m.BackgroundJobs.Load()))
+
+	if err := buf.Flush(); err != nil {
+		app.Log.ErrorContext(r.Context(), "Error writing metrics", "error", err)
+	}
+}
+
+// counterVec is a set of counters, one for each combination of label values
+type counterVec struct {
+	mu     sync.Mutex
+	labels []string
+	values map[string]*counterValue
+}
+
+type counterValue struct {
+	labelValues []string
+	value       float64
+}
+
+func newCounterVec(labels ...string) *counterVec {
+	return &counterVec{labels: labels, values: make(map[string]*counterValue)}
+}
+
+// Inc adds one to the counter with the given label values, which must be in
+// the order the labels were declared
+func (c *counterVec) Inc(labelValues ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	key := strings.Join(labelValues, "\xff")
+	v, ok := c.values[key]
+	if !ok {
+		v = &counterValue{labelValues: labelValues}
+		c.values[key] = v
+	}
+	v.value++
+}
+
+func (c *counterVec) write(w io.Writer, name, help string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	writeHeader(w, name, "counter", help)
+
+	// a counter without labels is always written, even before its first increment
+	if len(c.labels) == 0 && len(c.values) == 0 {
+		writeSample(w, name, "", 0)
+		return
+	}
+
+	for _, key := range sortedKeys(c.values) {
+		v := c.values[key]
+		writeSample(w, name, labels(c.labels, v.labelValues), v.value)
+	}
+}
+
+// histogramVec is a set of histograms, one for each combination of label values
+type histogramVec struct {
+	mu      sync.Mutex
+	buckets []float64
+	labels  []string
+	values  map[string]*histogramValue
+}
+
+type histogramValue struct {
+	labelValues []string
+	counts      []uint64 // per bucket, not cumulative; the last is +Inf
+	count       uint64
+	sum         float64
+}
+
+func newHistogramVec(buckets []float64, labels ...string) *histogramVec {
+	return &histogramVec{buckets: buckets, labels: labels, values: make(map[string]*histogramValue)}
+}
+
+// Observe records one value in the histogram with the given label values
+func (h *histogramVec) Observe(value float64, labelValues ...string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	key := strings.Join(labelValues, "\xff")
+	v, ok := h.values[key]
+	if !ok {
+		v = &histogramValue{labelValues: labelValues, counts: make([]uint64, len(h.buckets)+1)}
+		h.values[key] = v
+	}
+
+	v.counts[sort.SearchFloat64s(h.buckets, value)]++
+	v.count++
+	v.sum += value
+}
+
+func (h *histogramVec) write(w io.Writer, name, help string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	writeHeader(w, name, "histogram", help)
+
+	if len(h.labels) == 0 && len(h.values) == 0 {
+		h.values[""] = &histogramValue{counts: make([]uint64, len(h.buckets)+1)}
+	}
+
+	bucketLabels := append(append([]string{}, h.labels...), "le")
+	for _, key := range sortedKeys(h.values) {
+		v := h.values[key]
+
+		var cumulative uint64
+		for i, count := range v.counts {
+			cumulative += count
+			le := "+Inf"
+			if i < len(h.buckets) {
+				le = formatFloat(h.buckets[i])
+			}
+			values := append(append([]string{}, v.labelValues...), le)
+			writeSample(w, name+"_bucket", labels(bucketLabels, values), float64(cumulative))
+		}
+
+		writeSample(w, name+"_sum", labels(h.labels, v.labelValues), v.sum)
+		writeSample(w, name+"_count", labels(h.labels, v.labelValues), float64(v.count))
+	}
+}
+
+// metricsStore wraps a session store and counts its errors. It only supports
+// stores that can be iterated, as revokeSessions needs.
+type metricsStore struct {
+	store interface {
+		scs.Store
+		scs.IterableStore
+	}
+	errors *counterVec
+}
+
+func (s *metricsStore) Find(token string) ([]byte, bool, error) {
+	b, found, err := s.store.Find(token)
+	s.count("find", err)
+	return b, found, err
+}
+
+func (s *metricsStore) Commit(token string, b []byte, expiry time.Time) error {
+	err := s.store.Commit(token, b, expiry)
+	s.count("commit", err)
+	return err
+}
+
+func (s *metricsStore) Delete(token string) error {
+	err := s.store.Delete(token)
+	s.count("delete", err)
+	return err
+}
+
+func (s *metricsStore) All() (map[string][]byte, error) {
+	sessions, err := s.store.All()
+	s.count("all", err)
+	return sessions, err
+}
+
+func (s *metricsStore) count(op string, err error) {
+	if err != nil {
+		s.errors.Inc(op)
+	}
+}
+
+func writeHeader(w io.Writer, name, kind, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+func writeGauge(w io.Writer, name, help string, value float64) {
+	writeHeader(w, name, "gauge", help)
+	writeSample(w, name, "", value)
+}
+
+func writeCounter(w io.Writer, name, help string, value float64) {
+	writeHeader(w, name, "counter", help)
+	writeSample(w, name, "", value)
+}
+
+func writeSample(w io.Writer, name, labels string, value float64) {
+	fmt.Fprintf(w, "%s%s %s\n", name, labels, formatFloat(value))
+}
+
+// labelEscaper escapes label values as the text format requires
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// labels formats names and values as {name="value",...}, or "" if there are none
+func labels(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, name := range names {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		fmt.Fprintf(&b, `%s="%s"`, name, labelEscaper.Replace(values[i]))
+	}
+	b.WriteByte('}')
+
+	return b.String()
+}
+
+func formatFloat(f float64) string {
+	if math.IsInf(f, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestRecordRequestsMethods(t *testing.T) {
+	app := newTestApp(t)
+	addUnusedPools(t, app)
+	c := newTestClient(t, app)
+
+	for _, method := range []string{http.MethodGet, http.MethodDelete, "FOO", "BAR", "get"} {
+		req, err := http.NewRequest(method, c.srv.URL+"/healthz", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.do(req)
+	}
+
+	_, body := c.get("/metrics")
+
+	for _, want := range []string{`method="GET",route="/healthz"`, `method="DELETE",`, `method="other",`} {
+		if !strings.Contains(body, want) {
+			t.Errorf("metrics don't include %s", want)
+		}
+	}
+	for _, unwanted := range []string{`method="FOO"`, `method="BAR"`, `method="get"`} {
+		if strings.Contains(body, unwanted) {
+			t.Errorf("metrics include %s", unwanted)
+		}
+	}
+}
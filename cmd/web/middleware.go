@@ -1,7 +1,54 @@
 package main
 
-import "net/http"
+import (
+	"concurrent-subscriptions/data"
+	"net/http"
+)
 
 func (app *Config) SessionLoad(next http.Handler) http.Handler {
 	return app.Session.LoadAndSave(next)
 }
+
+// Auth redirects anonymous users to the login page, or tells API clients they must log in
+func (app *Config) Auth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !app.IsAuthenticated(r) {
+			if wantsJSON(r) {
+				writeJSONError(w, http.StatusUnauthorized, "unauthorized", "You must log in")
+				return
+			}
+			app.Session.Put(r.Context(), "warning", "You must log in to see this page")
+			http.Redirect(w, r, "/login", http.StatusSeeOther)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// AdminOnly only lets administrators through, and only once they have set up
+// two-factor authentication. It must be used after Auth.
+func (app *Config) AdminOnly(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, ok := app.Session.Get(r.Context(), "user").(data.User)
+		if !ok || user.IsAdmin != 1 {
+			app.Session.Put(r.Context(), "error", "You do not have permission to see this page")
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return
+		}
+
+		tf, err := app.Models.TwoFactor.Get(r.Context(), user.ID)
+		if err != nil {
+			app.logError(r, err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+
+		if tf.Enabled != 1 {
+			app.Session.Put(r.Context(), "warning", "Administrators must set up two-factor authentication")
+			http.Redirect(w, r, "/members/2fa/setup", http.StatusSeeOther)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"concurrent-subscriptions/data"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"text/tabwriter"
+
+	"github.com/joho/godotenv"
+)
+
+const migrateUsage = `usage: %s migrate [-dsn DSN] <command>
+
+commands:
+  up          apply every pending migration
+  down N      revert the N most recently applied migrations
+  status      list migrations and when they were applied
+  baseline N  record migrations up to version N as applied without running
+              them, for a database created from the old db.sql
+
+The database is read from DB_DSN, which may be set in a .env file.
+`
+
+// runMigrate runs the migrate subcommand. It only needs a database, so it
+// doesn't load or validate the rest of the application's settings.
+func runMigrate(args []string, out io.Writer) error {
+	if err := godotenv.Load(); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("loading .env: %w", err)
+	}
+
+	env := &envReader{}
+	fset := flag.NewFlagSet("migrate", flag.ContinueOnError)
+	fset.Usage = func() {
+		fmt.Fprintf(fset.Output(), migrateUsage, os.Args[0])
+		fset.PrintDefaults()
+	}
+	dsn := fset.String("dsn", env.String("DB_DSN", ""), "Postgres connection string (DB_DSN)")
+
+	if err := fset.Parse(args); err != nil {
+		return err
+	}
+
+	cmd := fset.Arg(0)
+	var steps int
+	switch {
+	case cmd == "up" && fset.NArg() == 1, cmd == "status" && fset.NArg() == 1:
+	case (cmd == "down" || cmd == "baseline") && fset.NArg() == 2:
+		n, err := strconv.Atoi(fset.Arg(1))
+		if err != nil || n < 1 {
+			return fmt.Errorf("migrate %s: N must be a positive number, got %q", cmd, fset.Arg(1))
+		}
+		steps = n
+	default:
+		fset.Usage()
+		return errors.New("unknown or incomplete migrate command")
+	}
+
+	if *dsn == "" {
+		return errors.New("DB_DSN is required")
+	}
+
+	conn, err := openDB(*dsn)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	// stop cleanly on ctrl-c; the migration in progress is rolled back
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	switch cmd {
+	case "up":
+		done, err := data.MigrateUp(ctx, conn)
+		for _, m := range done {
+			fmt.Fprintf(out, "applied  %04d_%s\n", m.Version, m.Name)
+		}
+		if err == nil && len(done) == 0 {
+			fmt.Fprintln(out, "database is up to date")
+		}
+		return err
+
+	case "down":
+		done, err := data.MigrateDown(ctx, conn, steps)
+		for _, m := range done {
+			fmt.Fprintf(out, "reverted %04d_%s\n", m.Version, m.Name)
+		}
+		if err == nil && len(done) == 0 {
+			fmt.Fprintln(out, "no migrations to revert")
+		}
+		return err
+
+	case "baseline":
+		done, err := data.MigrateBaseline(ctx, conn, steps)
+		for _, m := range done {
+			fmt.Fprintf(out, "recorded %04d_%s\n", m.Version, m.Name)
+		}
+		if err == nil && len(done) == 0 {
+			fmt.Fprintln(out, "nothing to record")
+		}
+		return err
+
+	default:
+		status, err := data.GetMigrationStatus(ctx, conn)
+		if err != nil {
+			return err
+		}
+
+		tw := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "VERSION\tNAME\tAPPLIED")
+		for _, s := range status {
+			applied := "pending"
+			if s.AppliedAt != nil {
+				applied = s.AppliedAt.Format("2006-01-02 15:04:05")
+			}
+			fmt.Fprintf(tw, "%04d\t%s\t%s\n", s.Version, s.Name, applied)
+		}
+		return tw.Flush()
+	}
+}
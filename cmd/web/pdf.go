@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Page dimensions for US Letter, in PDF points
+const (
+	pdfPageWidth  = 612.0
+	pdfPageHeight = 792.0
+)
+
+// PDF is a minimal, pure Go PDF writer. It supports text in the standard
+// Helvetica fonts and straight lines, which is all our invoices and manuals need.
+// Coordinates are measured in points from the top left corner of the page.
+type PDF struct {
+	pages []*bytes.Buffer
+}
+
+// NewPDF returns an empty PDF document
+func NewPDF() *PDF {
+	return &PDF{}
+}
+
+// AddPage starts a new page; subsequent drawing goes to this page
+func (p *PDF) AddPage() {
+	p.pages = append(p.pages, &bytes.Buffer{})
+}
+
+// Text draws a single line of text with its baseline at x, y
+func (p *PDF) Text(x, y, size float64, bold bool, s string) {
+	font := "F1"
+	if bold {
+		font = "F2"
+	}
+
+	fmt.Fprintf(p.page(), "BT /%s %.2f Tf %.2f %.2f Td (%s) Tj ET\n",
+		font, size, x, pdfPageHeight-y, pdfEscape(s))
+}
+
+// TextRight draws a single line of text that ends at x
+func (p *PDF) TextRight(x, y, size float64, bold bool, s string) {
+	p.Text(x-pdfTextWidth(s, size, bold), y, size, bold, s)
+}
+
+// Line draws a straight line from x1, y1 to x2, y2
+func (p *PDF) Line(x1, y1, x2, y2 float64) {
+	fmt.Fprintf(p.page(), "%.2f %.2f m %.2f %.2f l S\n",
+		x1, pdfPageHeight-y1, x2, pdfPageHeight-y2)
+}
+
+// Bytes returns the rendered document
+func (p *PDF) Bytes() []byte {
+	var buf bytes.Buffer
+	_, _ = p.WriteTo(&buf)
+	return buf.Bytes()
+}
+
+// WriteTo writes the rendered document to w
+func (p *PDF) WriteTo(w io.Writer) (int64, error) {
+	if len(p.pages) == 0 {
+		p.AddPage()
+	}
+
+	var buf bytes.Buffer
+	var offsets []int
+
+	// objects are numbered from 1: catalog, page tree, two fonts, then a
+	// page object and a content stream for every page
+	object := func(body string) {
+		offsets = append(offsets, buf.Len())
+		fmt.Fprintf(&buf, "%d 0 obj\n%s\nendobj\n", len(offsets), body)
+	}
+
+	const firstPageObj = 5
+	kids := make([]string, len(p.pages))
+	for i := range p.pages {
+		kids[i] = fmt.Sprintf("%d 0 R", firstPageObj+i*2)
+	}
+
+	buf.WriteString("%PDF-1.4\n%\xe2\xe3\xcf\xd3\n")
+	object("<< /Type /Catalog /Pages 2 0 R >>")
+	object(fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", strings.Join(kids, " "), len(p.pages)))
+	object("<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica /Encoding /WinAnsiEncoding >>")
+	object("<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica-Bold /Encoding /WinAnsiEncoding >>")
+
+	for i, content := range p.pages {
+		object(fmt.Sprintf("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 %.0f %.0f] "+
+			"/Resources << /Font << /F1 3 0 R /F2 4 0 R >> >> /Contents %d 0 R >>",
+			pdfPageWidth, pdfPageHeight, firstPageObj+i*2+1))
+		object(fmt.Sprintf("<< /Length %d >>\nstream\n%sendstream", content.Len(), content.String()))
+	}
+
+	xref := buf.Len()
+	fmt.Fprintf(&buf, "xref\n0 %d\n0000000000 65535 f \n", len(offsets)+1)
+	for _, off := range offsets {
+		fmt.Fprintf(&buf, "%010d 00000 n \n", off)
+	}
+	fmt.Fprintf(&buf, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(offsets)+1, xref)
+
+	return buf.WriteTo(w)
+}
+
+// page returns the page currently being drawn on
+func (p *PDF) page() *bytes.Buffer {
+	if len(p.pages) == 0 {
+		p.AddPage()
+	}
+	return p.pages[len(p.pages)-1]
+}
+
+// pdfEscape encodes s as the contents of a PDF string literal. Characters
+// outside of Latin-1 can't be shown by the standard fonts and become '?'.
+func pdfEscape(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		switch {
+		case r == '\\' || r == '(' || r == ')':
+			b.WriteByte('\\')
+			b.WriteRune(r)
+		case r < 32:
+			b.WriteByte(' ')
+		case r > 255:
+			b.WriteByte('?')
+		default:
+			b.WriteByte(byte(r))
+		}
+	}
+	return b.String()
+}
+
+// pdfTextWidth approximates the width of s in points. Helvetica averages just
+// over half an em per character, which is close enough for right-aligning figures.
+func pdfTextWidth(s string, size float64, bold bool) float64 {
+	em := 0.556
+	if bold {
+		em = 0.584
+	}
+	return float64(len([]rune(s))) * em * size
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxIdleBuckets is how many domains domainLimiter tracks before it forgets idle ones
+const maxIdleBuckets = 1000
+
+// domainLimiter is a token bucket rate limiter keyed by recipient domain, so a
+// burst of mail to one provider can't get our SMTP relay throttled or blocked.
+type domainLimiter struct {
+	mu      sync.Mutex
+	rate    float64
+	burst   float64
+	buckets map[string]*tokenBucket
+	now     func() time.Time
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// newDomainLimiter allows perMinute messages per domain on average, with bursts of up to burst messages
+func newDomainLimiter(perMinute, burst int) *domainLimiter {
+	return &domainLimiter{
+		rate:    float64(perMinute) / 60,
+		burst:   float64(burst),
+		buckets: make(map[string]*tokenBucket),
+		now:     time.Now,
+	}
+}
+
+// Take uses up a token for domain. It returns zero if the message may be sent
+// now, or otherwise how long until a token becomes available.
+func (l *domainLimiter) Take(domain string) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	b, ok := l.buckets[domain]
+	if !ok {
+		if len(l.buckets) >= maxIdleBuckets {
+			l.prune(now)
+		}
+		b = &tokenBucket{tokens: l.burst, last: now}
+		l.buckets[domain] = b
+	}
+
+	b.tokens += now.Sub(b.last).Seconds() * l.rate
+	if b.tokens > l.burst {
+		b.tokens = l.burst
+	}
+	b.last = now
+
+	if b.tokens < 1 {
+		return time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+	}
+
+	b.tokens--
+	return 0
+}
+
+// prune drops the buckets that have refilled completely; they behave exactly like new ones
+func (l *domainLimiter) prune(now time.Time) {
+	for domain, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, domain)
+		}
+	}
+}
+
+// recipientDomain returns the lower cased domain part of an email address
+func recipientDomain(address string) string {
+	at := strings.LastIndex(address, "@")
+	if at < 0 {
+		return ""
+	}
+	return strings.ToLower(strings.TrimRight(address[at+1:], "> "))
+}
@@ -2,12 +2,11 @@ package main
 
 import (
 	"concurrent-subscriptions/data"
-	"fmt"
-	"html/template"
 	"net/http"
 	"time"
 )
 
+// pathToTemplates is where templates are read from in dev mode; otherwise they are embedded in the binary
 var pathToTemplates = "./cmd/web/templates"
 
 type TemplateData struct {
@@ -19,40 +18,31 @@ type TemplateData struct {
 	Warning       string
 	Error         string
 	Authenticated bool
+	IsAdmin       bool
 	Now           time.Time
 	User          *data.User
+	Form          *Form
 }
 
 // render is a helper function that renders templates using html/template
 func (app *Config) render(w http.ResponseWriter, r *http.Request, t string, td *TemplateData) {
-	partials := []string{
-		fmt.Sprintf("%s/base.layout.gohtml", pathToTemplates),
-		fmt.Sprintf("%s/header.partial.gohtml", pathToTemplates),
-		fmt.Sprintf("%s/navbar.partial.gohtml", pathToTemplates),
-		fmt.Sprintf("%s/footer.partial.gohtml", pathToTemplates),
-		fmt.Sprintf("%s/alerts.partial.gohtml", pathToTemplates),
-	}
-
-	var templateSlice []string
-	templateSlice = append(templateSlice, fmt.Sprintf("%s/%s", pathToTemplates, t))
-
-	for _, x := range partials {
-		templateSlice = append(templateSlice, x)
-	}
-
 	if td == nil {
 		td = &TemplateData{}
 	}
 
-	tmpl, err := template.ParseFiles(templateSlice...)
+	if td.Form == nil {
+		td.Form = NewForm(nil)
+	}
+
+	tmpl, err := app.Templates.Page(t)
 	if err != nil {
-		app.ErrorLog.Println(err)
+		app.logError(r, err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
 	if err := tmpl.Execute(w, app.AddDefaultData(td, r)); err != nil {
-		app.ErrorLog.Println(err)
+		app.logError(r, err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
@@ -65,7 +55,9 @@ func (app *Config) AddDefaultData(td *TemplateData, r *http.Request) *TemplateDa
 	td.Error = app.Session.PopString(r.Context(), "error")
 	if app.IsAuthenticated(r) {
 		td.Authenticated = true
-		// TODO - get more user information
+		if user, ok := app.Session.Get(r.Context(), "user").(data.User); ok {
+			td.IsAdmin = user.IsAdmin == 1
+		}
 	}
 	td.Now = time.Now()
 
@@ -11,17 +11,83 @@ func (app *Config) routes() http.Handler {
 	mux := chi.NewRouter()
 
 	// set up middleware
+	mux.Use(RequestID)
+	mux.Use(app.RecordRequests)
 	mux.Use(middleware.Recoverer)
 	mux.Use(app.SessionLoad)
 
 	// set up routes
+	mux.Get("/healthz", app.HealthPage)
+	mux.Get("/readyz", app.ReadyPage)
+	mux.Get("/metrics", app.MetricsPage)
 	mux.Get("/", app.HomePage)
 	mux.Get("/login", app.LoginPage)
 	mux.Post("/login", app.PostLoginPage)
+	mux.Get("/login/2fa", app.SecondFactorPage)
+	mux.Post("/login/2fa", app.PostSecondFactor)
 	mux.Get("/logout", app.Logout)
 	mux.Get("/register", app.RegisterPage)
 	mux.Post("/register", app.PostRegisterPage)
 	mux.Get("/activate", app.ActivateAccount)
+	mux.Post("/activate/resend", app.PostResendActivation)
+	mux.Get("/forgot-password", app.ForgotPasswordPage)
+	mux.Post("/forgot-password", app.PostForgotPassword)
+	mux.Get("/reset-password", app.ResetPasswordPage)
+	mux.Post("/reset-password", app.PostResetPassword)
+
+	// pages for logged in users
+	mux.Route("/members", func(mux chi.Router) {
+		mux.Use(app.Auth)
+
+		mux.Get("/plans", app.ChooseSubscription)
+		mux.Post("/subscribe", app.SubscribeToPlan)
+
+		mux.Get("/2fa", app.TwoFactorPage)
+		mux.Get("/2fa/setup", app.TwoFactorSetupPage)
+		mux.Post("/2fa/setup", app.PostTwoFactorSetup)
+		mux.Post("/2fa/disable", app.PostTwoFactorDisable)
+	})
+
+	// pages for administrators
+	mux.Route("/admin", func(mux chi.Router) {
+		mux.Use(app.Auth)
+		mux.Use(app.AdminOnly)
+
+		mux.Get("/", func(w http.ResponseWriter, r *http.Request) {
+			http.Redirect(w, r, "/admin/users", http.StatusSeeOther)
+		})
+
+		mux.Get("/users", app.AdminUsersPage)
+		mux.Get("/users/{id}", app.AdminUserPage)
+		mux.Post("/users/{id}", app.PostAdminUser)
+		mux.Post("/users/{id}/plan", app.PostAdminUserPlan)
+		mux.Post("/users/{id}/delete", app.PostAdminDeleteUser)
+
+		mux.Get("/plans", app.AdminPlansPage)
+		mux.Get("/plans/new", app.AdminPlanPage)
+		mux.Post("/plans/new", app.PostAdminPlan)
+		mux.Get("/plans/{id}", app.AdminPlanPage)
+		mux.Post("/plans/{id}", app.PostAdminPlan)
+	})
+
+	// JSON API for the mobile client. It shares its handlers with the pages
+	// above, which answer with JSON for API requests.
+	mux.Route("/api/v1", func(mux chi.Router) {
+		mux.Use(app.APIRequest)
+		mux.NotFound(APINotFound)
+		mux.MethodNotAllowed(APIMethodNotAllowed)
+
+		mux.Post("/login", app.PostLoginPage)
+		mux.Post("/login/2fa", app.PostSecondFactor)
+		mux.Get("/plans", app.ChooseSubscription)
+
+		mux.Group(func(mux chi.Router) {
+			mux.Use(app.Auth)
+
+			mux.Get("/me", app.Profile)
+			mux.Post("/subscription", app.SubscribeToPlan)
+		})
+	})
 
 	// mux.Get("/test-email", func(w http.ResponseWriter, r *http.Request) {
 	// 	app.InfoLog.Println("Sending test email")
@@ -0,0 +1,386 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"net/netip"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/joho/godotenv"
+)
+
+// Settings is the typed configuration for the application. Every setting is
+// read from an environment variable, which may come from an optional .env file,
+// and can be overridden by the command line flag of the same name.
+type Settings struct {
+	Port            int
+	AppURL          string
+	DevMode         bool
+	ShutdownTimeout time.Duration
+	LogLevel        string
+	LogFormat       string
+
+	DSN       string
+	DBTimeout time.Duration
+	RedisAddr string
+
+	SessionLifetime time.Duration
+	CookieSecure    bool
+	SigningSecret   string
+	TOTPKey         string
+	TOTPIssuer      string
+	MetricsToken    string
+	TrustedProxies  []netip.Prefix
+
+	SMTP  SMTPSettings
+	Mail  MailSettings
+	Login LoginSettings
+}
+
+// SMTPSettings holds the mail server connection and the default sender
+type SMTPSettings struct {
+	Domain      string
+	Host        string
+	Port        int
+	Username    string
+	Password    string
+	Encryption  string
+	FromAddress string
+	FromName    string
+}
+
+// MailSettings controls how queued mail is delivered
+type MailSettings struct {
+	Driver       string
+	FileDir      string
+	Workers      int
+	MaxAttempts  int
+	QueueSize    int
+	DomainRate   int
+	DomainBurst  int
+	DrainTimeout time.Duration
+}
+
+// LoginSettings controls login throttling and account lockout
+type LoginSettings struct {
+	MaxPerIP    int
+	MaxPerEmail int
+	Window      time.Duration
+	LockoutFor  time.Duration
+}
+
+// SettingsError lists every problem found while loading settings, so they can all be fixed in one go
+type SettingsError []string
+
+func (e SettingsError) Error() string {
+	return "invalid configuration:\n  - " + strings.Join(e, "\n  - ")
+}
+
+// loadSettings reads the optional .env file, the environment and the command line flags in args
+func loadSettings(args []string) (Settings, error) {
+	if err := godotenv.Load(); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return Settings{}, fmt.Errorf("loading .env: %w", err)
+	}
+
+	var s Settings
+	env := &envReader{}
+	fset := flag.NewFlagSet("web", flag.ContinueOnError)
+
+	fset.IntVar(&s.Port, "port", env.Int("PORT", 3000), "port to listen on (PORT)")
+	fset.StringVar(&s.AppURL, "app-url", env.String("APP_URL", ""), "public base URL used in emailed links (APP_URL)")
+	fset.BoolVar(&s.DevMode, "dev", env.Bool("DEV_MODE", false), "reload templates from disk on every request (DEV_MODE)")
+	fset.StringVar(&s.LogLevel, "log-level", env.String("LOG_LEVEL", "info"), "lowest level logged: debug, info, warn or error (LOG_LEVEL)")
+	fset.StringVar(&s.LogFormat, "log-format", env.String("LOG_FORMAT", "json"), "log output format: json or text (LOG_FORMAT)")
+	fset.DurationVar(&s.ShutdownTimeout, "shutdown-timeout", env.Duration("SHUTDOWN_TIMEOUT", 30*time.Second), "how long shutdown waits for requests and background work (SHUTDOWN_TIMEOUT)")
+
+	fset.StringVar(&s.DSN, "dsn", env.String("DB_DSN", ""), "Postgres connection string (DB_DSN)")
+	fset.DurationVar(&s.DBTimeout, "db-timeout", env.Duration("DB_TIMEOUT", 3*time.Second), "longest any one database operation may take (DB_TIMEOUT)")
+	fset.StringVar(&s.RedisAddr, "redis", env.String("REDIS", ""), "Redis address, host:port (REDIS)")
+
+	fset.DurationVar(&s.SessionLifetime, "session-lifetime", env.Duration("SESSION_LIFETIME", 24*time.Hour), "how long a session lasts (SESSION_LIFETIME)")
+	fset.BoolVar(&s.CookieSecure, "cookie-secure", env.Bool("COOKIE_SECURE", true), "only send the session cookie over HTTPS (COOKIE_SECURE)")
+	fset.StringVar(&s.SigningSecret, "signing-secret", env.String("URL_SIGNING_SECRET", ""), "secret key for signed URLs (URL_SIGNING_SECRET)")
+
+	fset.StringVar(&s.TOTPKey, "totp-key", env.String("TOTP_ENCRYPTION_KEY", ""), "secret key that encrypts stored two-factor secrets (TOTP_ENCRYPTION_KEY)")
+	fset.StringVar(&s.TOTPIssuer, "totp-issuer", env.String("TOTP_ISSUER", "Concurrent Subscriptions"), "name shown in authenticator apps (TOTP_ISSUER)")
+	fset.StringVar(&s.MetricsToken, "metrics-token", env.String("METRICS_TOKEN", ""), "bearer token required to read /metrics; if empty, /metrics is public to anyone who can reach the server (METRICS_TOKEN)")
+	s.TrustedProxies = env.Prefixes("TRUSTED_PROXIES")
+	fset.Var((*prefixList)(&s.TrustedProxies), "trusted-proxies", "comma separated IP addresses or CIDR ranges of reverse proxies whose X-Forwarded-For header is believed (TRUSTED_PROXIES)")
+
+	fset.StringVar(&s.SMTP.Domain, "smtp-domain", env.String("SMTP_DOMAIN", "localhost"), "mail domain (SMTP_DOMAIN)")
+	fset.StringVar(&s.SMTP.Host, "smtp-host", env.String("SMTP_HOST", "localhost"), "SMTP server host (SMTP_HOST)")
+	fset.IntVar(&s.SMTP.Port, "smtp-port", env.Int("SMTP_PORT", 1025), "SMTP server port (SMTP_PORT)")
+	fset.StringVar(&s.SMTP.Username, "smtp-username", env.String("SMTP_USERNAME", ""), "SMTP username (SMTP_USERNAME)")
+	fset.StringVar(&s.SMTP.Password, "smtp-password", env.String("SMTP_PASSWORD", ""), "SMTP password (SMTP_PASSWORD)")
+	fset.StringVar(&s.SMTP.Encryption, "smtp-encryption", env.String("SMTP_ENCRYPTION", "none"), "SMTP encryption: tls, ssl or none (SMTP_ENCRYPTION)")
+	fset.StringVar(&s.SMTP.FromAddress, "mail-from", env.String("MAIL_FROM_ADDRESS", "info@mycompany.com"), "default sender address (MAIL_FROM_ADDRESS)")
+	fset.StringVar(&s.SMTP.FromName, "mail-from-name", env.String("MAIL_FROM_NAME", "Info"), "default sender name (MAIL_FROM_NAME)")
+
+	fset.StringVar(&s.Mail.Driver, "mail-driver", env.String("MAIL_DRIVER", "smtp"), "mail transport: smtp, file or memory (MAIL_DRIVER)")
+	fset.StringVar(&s.Mail.FileDir, "mail-file-dir", env.String("MAIL_FILE_DIR", "./tmp/mail"), "maildir used by the file mail driver (MAIL_FILE_DIR)")
+	fset.IntVar(&s.Mail.Workers, "mail-workers", env.Int("MAIL_WORKERS", 4), "number of mail sending workers (MAIL_WORKERS)")
+	fset.IntVar(&s.Mail.MaxAttempts, "mail-max-attempts", env.Int("MAIL_MAX_ATTEMPTS", 8), "attempts before an email is dead-lettered (MAIL_MAX_ATTEMPTS)")
+	fset.IntVar(&s.Mail.QueueSize, "mail-queue-size", env.Int("MAIL_QUEUE_SIZE", 1000), "unsent emails allowed before TrySend refuses more (MAIL_QUEUE_SIZE)")
+	fset.IntVar(&s.Mail.DomainRate, "mail-domain-rate", env.Int("MAIL_DOMAIN_RATE", 60), "emails per minute per recipient domain, 0 for no limit (MAIL_DOMAIN_RATE)")
+	fset.IntVar(&s.Mail.DomainBurst, "mail-domain-burst", env.Int("MAIL_DOMAIN_BURST", 10), "burst size for the per domain limit (MAIL_DOMAIN_BURST)")
+	fset.DurationVar(&s.Mail.DrainTimeout, "mail-drain-timeout", env.Duration("MAIL_DRAIN_TIMEOUT", 30*time.Second), "how long shutdown spends sending mail that is due (MAIL_DRAIN_TIMEOUT)")
+
+	fset.IntVar(&s.Login.MaxPerIP, "login-max-ip-failures", env.Int("LOGIN_MAX_IP_FAILURES", 20), "failed logins allowed per IP in each window (LOGIN_MAX_IP_FAILURES)")
+	fset.IntVar(&s.Login.MaxPerEmail, "login-max-failures", env.Int("LOGIN_MAX_FAILURES", 5), "failed logins that lock an account (LOGIN_MAX_FAILURES)")
+	fset.DurationVar(&s.Login.Window, "login-window", env.Duration("LOGIN_WINDOW", 15*time.Minute), "window failed logins are counted over (LOGIN_WINDOW)")
+	fset.DurationVar(&s.Login.LockoutFor, "login-lockout", env.Duration("LOGIN_LOCKOUT", 15*time.Minute), "how long a locked account stays locked (LOGIN_LOCKOUT)")
+
+	if len(env.errs) > 0 {
+		return Settings{}, env.errs
+	}
+
+	if err := fset.Parse(args); err != nil {
+		return Settings{}, err
+	}
+
+	if s.AppURL == "" {
+		s.AppURL = fmt.Sprintf("http://localhost:%d", s.Port)
+	}
+	s.AppURL = strings.TrimRight(s.AppURL, "/")
+
+	if err := s.validate(); err != nil {
+		return Settings{}, err
+	}
+
+	return s, nil
+}
+
+// validate checks that required settings are present and the rest are in range
+func (s *Settings) validate() error {
+	var errs SettingsError
+
+	if s.Port < 1 || s.Port > 65535 {
+		errs = append(errs, fmt.Sprintf("PORT must be between 1 and 65535, got %d", s.Port))
+	}
+	if u, err := url.Parse(s.AppURL); err != nil || u.Scheme == "" || u.Host == "" {
+		errs = append(errs, fmt.Sprintf("APP_URL must be an absolute URL, got %q", s.AppURL))
+	}
+	if s.DSN == "" {
+		errs = append(errs, "DB_DSN is required")
+	}
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(s.LogLevel)); err != nil {
+		errs = append(errs, fmt.Sprintf("LOG_LEVEL must be debug, info, warn or error, got %q", s.LogLevel))
+	}
+	if s.LogFormat != "json" && s.LogFormat != "text" {
+		errs = append(errs, fmt.Sprintf("LOG_FORMAT must be json or text, got %q", s.LogFormat))
+	}
+	if s.ShutdownTimeout <= 0 {
+		errs = append(errs, "SHUTDOWN_TIMEOUT must be positive")
+	}
+	if s.DBTimeout <= 0 {
+		errs = append(errs, "DB_TIMEOUT must be positive")
+	}
+	if s.RedisAddr == "" {
+		errs = append(errs, "REDIS is required")
+	}
+	if s.SessionLifetime <= 0 {
+		errs = append(errs, "SESSION_LIFETIME must be positive")
+	}
+	if len(s.SigningSecret) < 32 {
+		errs = append(errs, "URL_SIGNING_SECRET is required and must be at least 32 characters")
+	}
+	if len(s.TOTPKey) < 32 {
+		errs = append(errs, "TOTP_ENCRYPTION_KEY is required and must be at least 32 characters")
+	}
+	if s.TOTPIssuer == "" || strings.Contains(s.TOTPIssuer, ":") {
+		errs = append(errs, "TOTP_ISSUER is required and cannot contain a colon")
+	}
+
+	switch s.Mail.Driver {
+	case "smtp":
+		if s.SMTP.Host == "" {
+			errs = append(errs, "SMTP_HOST is required when MAIL_DRIVER is smtp")
+		}
+		if s.SMTP.Port < 1 || s.SMTP.Port > 65535 {
+			errs = append(errs, fmt.Sprintf("SMTP_PORT must be between 1 and 65535, got %d", s.SMTP.Port))
+		}
+		switch s.SMTP.Encryption {
+		case "tls", "ssl", "none":
+		default:
+			errs = append(errs, fmt.Sprintf("SMTP_ENCRYPTION must be tls, ssl or none, got %q", s.SMTP.Encryption))
+		}
+	case "file":
+		if s.Mail.FileDir == "" {
+			errs = append(errs, "MAIL_FILE_DIR is required when MAIL_DRIVER is file")
+		}
+	case "memory":
+	default:
+		errs = append(errs, fmt.Sprintf("MAIL_DRIVER must be smtp, file or memory, got %q", s.Mail.Driver))
+	}
+
+	if s.SMTP.FromAddress == "" {
+		errs = append(errs, "MAIL_FROM_ADDRESS is required")
+	}
+	if s.Mail.Workers < 1 {
+		errs = append(errs, "MAIL_WORKERS must be at least 1")
+	}
+	if s.Mail.MaxAttempts < 1 {
+		errs = append(errs, "MAIL_MAX_ATTEMPTS must be at least 1")
+	}
+	if s.Mail.QueueSize < 1 {
+		errs = append(errs, "MAIL_QUEUE_SIZE must be at least 1")
+	}
+	if s.Mail.DomainRate < 0 {
+		errs = append(errs, "MAIL_DOMAIN_RATE cannot be negative")
+	}
+	if s.Mail.DomainRate > 0 && s.Mail.DomainBurst < 1 {
+		errs = append(errs, "MAIL_DOMAIN_BURST must be at least 1")
+	}
+	if s.Mail.DrainTimeout <= 0 {
+		errs = append(errs, "MAIL_DRAIN_TIMEOUT must be positive")
+	}
+
+	if s.Login.MaxPerIP < 1 || s.Login.MaxPerEmail < 1 {
+		errs = append(errs, "LOGIN_MAX_IP_FAILURES and LOGIN_MAX_FAILURES must be at least 1")
+	}
+	if s.Login.Window <= 0 || s.Login.LockoutFor <= 0 {
+		errs = append(errs, "LOGIN_WINDOW and LOGIN_LOCKOUT must be positive")
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+
+	return nil
+}
+
+// envReader reads typed environment variables, collecting a readable error for
+// every value that doesn't parse instead of stopping at the first
+type envReader struct {
+	errs SettingsError
+}
+
+// String returns the environment variable key, or def if it is unset
+func (e *envReader) String(key, def string) string {
+	if v, ok := os.LookupEnv(key); ok && v != "" {
+		return v
+	}
+	return def
+}
+
+// Int returns the environment variable key as an int, or def if it is unset
+func (e *envReader) Int(key string, def int) int {
+	v := e.String(key, "")
+	if v == "" {
+		return def
+	}
+
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		e.errs = append(e.errs, fmt.Sprintf("%s must be a whole number, got %q", key, v))
+		return def
+	}
+	return n
+}
+
+// Bool returns the environment variable key as a bool, or def if it is unset
+func (e *envReader) Bool(key string, def bool) bool {
+	v := e.String(key, "")
+	if v == "" {
+		return def
+	}
+
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		e.errs = append(e.errs, fmt.Sprintf("%s must be true or false, got %q", key, v))
+		return def
+	}
+	return b
+}
+
+// Duration returns the environment variable key as a duration such as "24h", or def if it is unset
+func (e *envReader) Duration(key string, def time.Duration) time.Duration {
+	v := e.String(key, "")
+	if v == "" {
+		return def
+	}
+
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		e.errs = append(e.errs, fmt.Sprintf("%s must be a duration such as 30m or 24h, got %q", key, v))
+		return def
+	}
+	return d
+}
+
+// Prefixes returns the environment variable key as a comma separated list of
+// IP addresses and CIDR ranges, or nil if it is unset
+func (e *envReader) Prefixes(key string) []netip.Prefix {
+	v := e.String(key, "")
+	if v == "" {
+		return nil
+	}
+
+	prefixes, err := parsePrefixes(v)
+	if err != nil {
+		e.errs = append(e.errs, fmt.Sprintf("%s must be a comma separated list of IP addresses or CIDR ranges, got %q", key, v))
+		return nil
+	}
+	return prefixes
+}
+
+// prefixList is a flag.Value holding a comma separated list of IP addresses and CIDR ranges
+type prefixList []netip.Prefix
+
+func (l *prefixList) String() string {
+	if l == nil {
+		return ""
+	}
+
+	parts := make([]string, len(*l))
+	for i, p := range *l {
+		parts[i] = p.String()
+	}
+	return strings.Join(parts, ",")
+}
+
+func (l *prefixList) Set(v string) error {
+	prefixes, err := parsePrefixes(v)
+	if err != nil {
+		return err
+	}
+	*l = prefixes
+	return nil
+}
+
+// parsePrefixes parses a comma separated list of IP addresses and CIDR ranges.
+// A bare address is a range of just that address.
+func parsePrefixes(v string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, part := range strings.Split(v, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		if strings.Contains(part, "/") {
+			p, err := netip.ParsePrefix(part)
+			if err != nil {
+				return nil, fmt.Errorf("%q is not a CIDR range", part)
+			}
+			prefixes = append(prefixes, p.Masked())
+			continue
+		}
+
+		addr, err := netip.ParseAddr(part)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not an IP address", part)
+		}
+		addr = addr.Unmap()
+		prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+	}
+	return prefixes, nil
+}
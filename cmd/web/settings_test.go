@@ -0,0 +1,233 @@
+package main
+
+import (
+	"errors"
+	"net/netip"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// validSettings returns settings that pass validation, for tests to break one at a time
+func validSettings() Settings {
+	return Settings{
+		Port:            3000,
+		AppURL:          "http://localhost:3000",
+		ShutdownTimeout: 30 * time.Second,
+		LogLevel:        "info",
+		LogFormat:       "json",
+		DSN:             "host=localhost",
+		DBTimeout:       3 * time.Second,
+		RedisAddr:       "127.0.0.1:6379",
+		SessionLifetime: 24 * time.Hour,
+		SigningSecret:   strings.Repeat("s", 32),
+		TOTPKey:         strings.Repeat("k", 32),
+		TOTPIssuer:      "Concurrent Subscriptions",
+		SMTP: SMTPSettings{
+			Host:        "localhost",
+			Port:        1025,
+			Encryption:  "none",
+			FromAddress: "info@example.com",
+		},
+		Mail: MailSettings{
+			Driver:       "smtp",
+			Workers:      4,
+			MaxAttempts:  8,
+			QueueSize:    1000,
+			DomainRate:   60,
+			DomainBurst:  10,
+			DrainTimeout: 30 * time.Second,
+		},
+		Login: LoginSettings{
+			MaxPerIP:    20,
+			MaxPerEmail: 5,
+			Window:      15 * time.Minute,
+			LockoutFor:  15 * time.Minute,
+		},
+	}
+}
+
+func TestSettingsValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(s *Settings)
+		want   string
+	}{
+		{"valid", func(s *Settings) {}, ""},
+		{"port out of range", func(s *Settings) { s.Port = 70000 }, "PORT must be between 1 and 65535"},
+		{"relative app url", func(s *Settings) { s.AppURL = "localhost:3000" }, "APP_URL must be an absolute URL"},
+		{"no dsn", func(s *Settings) { s.DSN = "" }, "DB_DSN is required"},
+		{"no redis", func(s *Settings) { s.RedisAddr = "" }, "REDIS is required"},
+		{"unknown log level", func(s *Settings) { s.LogLevel = "loud" }, "LOG_LEVEL must be"},
+		{"unknown log format", func(s *Settings) { s.LogFormat = "xml" }, "LOG_FORMAT must be"},
+		{"zero session lifetime", func(s *Settings) { s.SessionLifetime = 0 }, "SESSION_LIFETIME must be positive"},
+		{"short signing secret", func(s *Settings) { s.SigningSecret = "secret" }, "URL_SIGNING_SECRET is required"},
+		{"short totp key", func(s *Settings) { s.TOTPKey = "" }, "TOTP_ENCRYPTION_KEY is required"},
+		{"totp issuer with a colon", func(s *Settings) { s.TOTPIssuer = "a:b" }, "TOTP_ISSUER"},
+		{"unknown encryption", func(s *Settings) { s.SMTP.Encryption = "starttls" }, "SMTP_ENCRYPTION must be"},
+		{"no smtp host", func(s *Settings) { s.SMTP.Host = "" }, "SMTP_HOST is required"},
+		{"smtp host not needed for files", func(s *Settings) { s.SMTP.Host = ""; s.Mail.Driver = "file"; s.Mail.FileDir = "mail" }, ""},
+		{"no maildir", func(s *Settings) { s.Mail.Driver = "file" }, "MAIL_FILE_DIR is required"},
+		{"unknown mail driver", func(s *Settings) { s.Mail.Driver = "pigeon" }, "MAIL_DRIVER must be"},
+		{"no workers", func(s *Settings) { s.Mail.Workers = 0 }, "MAIL_WORKERS must be at least 1"},
+		{"no burst", func(s *Settings) { s.Mail.DomainBurst = 0 }, "MAIL_DOMAIN_BURST must be at least 1"},
+		{"burst not needed without a rate", func(s *Settings) { s.Mail.DomainRate = 0; s.Mail.DomainBurst = 0 }, ""},
+		{"no login failures allowed", func(s *Settings) { s.Login.MaxPerEmail = 0 }, "LOGIN_MAX_FAILURES must be at least 1"},
+		{"zero lockout", func(s *Settings) { s.Login.LockoutFor = 0 }, "LOGIN_LOCKOUT must be positive"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := validSettings()
+			tt.change(&s)
+
+			err := s.validate()
+			if tt.want == "" {
+				if err != nil {
+					t.Fatalf("got %v, want no error", err)
+				}
+				return
+			}
+
+			var errs SettingsError
+			if !errors.As(err, &errs) || len(errs) != 1 || !strings.Contains(errs[0], tt.want) {
+				t.Errorf("got %v, want one error saying %q", err, tt.want)
+			}
+		})
+	}
+
+	t.Run("every problem is reported", func(t *testing.T) {
+		s := validSettings()
+		s.DSN, s.RedisAddr, s.SigningSecret = "", "", ""
+
+		var errs SettingsError
+		if err := s.validate(); !errors.As(err, &errs) || len(errs) != 3 {
+			t.Errorf("got %v, want 3 errors", err)
+		}
+	})
+}
+
+// setRequiredEnv sets the environment variables loadSettings can't do without
+func setRequiredEnv(t *testing.T) {
+	t.Helper()
+
+	t.Setenv("DB_DSN", "host=localhost")
+	t.Setenv("REDIS", "127.0.0.1:6379")
+	t.Setenv("URL_SIGNING_SECRET", strings.Repeat("s", 32))
+	t.Setenv("TOTP_ENCRYPTION_KEY", strings.Repeat("k", 32))
+}
+
+func TestLoadSettings(t *testing.T) {
+	setRequiredEnv(t)
+	t.Setenv("PORT", "4000")
+	t.Setenv("APP_URL", "")
+	t.Setenv("SESSION_LIFETIME", "2h")
+	t.Setenv("COOKIE_SECURE", "false")
+
+	s, err := loadSettings([]string{"-port", "5000"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// flags win over the environment, which wins over the defaults
+	if s.Port != 5000 {
+		t.Errorf("port %d, want the flag's 5000", s.Port)
+	}
+	if s.SessionLifetime != 2*time.Hour || s.CookieSecure {
+		t.Errorf("session lifetime %s and secure cookies %v, want 2h and false from the environment", s.SessionLifetime, s.CookieSecure)
+	}
+	if s.DBTimeout != 3*time.Second {
+		t.Errorf("db timeout %s, want the default 3s", s.DBTimeout)
+	}
+	if s.AppURL != "http://localhost:5000" {
+		t.Errorf("app url %q, want it derived from the port", s.AppURL)
+	}
+
+	t.Setenv("APP_URL", "https://example.com/")
+	if s, err := loadSettings(nil); err != nil || s.AppURL != "https://example.com" {
+		t.Errorf("app url %q, %v; want https://example.com without the trailing slash", s.AppURL, err)
+	}
+}
+
+func TestLoadSettingsErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		env  map[string]string
+		args []string
+		want []string
+	}{
+		{"unparsable values", map[string]string{"PORT": "eighty", "COOKIE_SECURE": "maybe", "DB_TIMEOUT": "soon"}, nil,
+			[]string{"PORT must be a whole number", "COOKIE_SECURE must be true or false", "DB_TIMEOUT must be a duration"}},
+		{"missing required", map[string]string{"DB_DSN": "", "REDIS": ""}, nil,
+			[]string{"DB_DSN is required", "REDIS is required"}},
+		{"bad flag", nil, []string{"-port", "eighty"}, []string{"invalid value"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setRequiredEnv(t)
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+
+			_, err := loadSettings(tt.args)
+			if err == nil {
+				t.Fatal("got no error")
+			}
+			for _, want := range tt.want {
+				if !strings.Contains(err.Error(), want) {
+					t.Errorf("error doesn't say %q: %v", want, err)
+				}
+			}
+		})
+	}
+}
+
+func TestParsePrefixes(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    []string
+		wantErr bool
+	}{
+		{"", nil, false},
+		{"10.0.0.0/8", []string{"10.0.0.0/8"}, false},
+		{"10.1.2.3/8", []string{"10.0.0.0/8"}, false},
+		{"192.0.2.1, 2001:db8::/32", []string{"192.0.2.1/32", "2001:db8::/32"}, false},
+		{"::ffff:192.0.2.1", []string{"192.0.2.1/32"}, false},
+		{"10.0.0.0/8,,", []string{"10.0.0.0/8"}, false},
+		{"proxy.internal", nil, true},
+		{"10.0.0.0/33", nil, true},
+	}
+
+	for _, tt := range tests {
+		got, err := parsePrefixes(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parsePrefixes(%q) error = %v, want error %v", tt.in, err, tt.wantErr)
+			continue
+		}
+
+		var want []netip.Prefix
+		for _, p := range tt.want {
+			want = append(want, netip.MustParsePrefix(p))
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("parsePrefixes(%q) = %v, want %v", tt.in, got, want)
+		}
+	}
+}
+
+func TestTrustedProxiesSetting(t *testing.T) {
+	t.Setenv("TRUSTED_PROXIES", "10.0.0.0/8")
+
+	env := &envReader{}
+	if got := env.Prefixes("TRUSTED_PROXIES"); len(got) != 1 || got[0].String() != "10.0.0.0/8" {
+		t.Errorf("got %v, want [10.0.0.0/8]", got)
+	}
+
+	t.Setenv("TRUSTED_PROXIES", "10.0.0.0/8, proxy.internal")
+	env.Prefixes("TRUSTED_PROXIES")
+	if len(env.errs) != 1 {
+		t.Errorf("got errors %v, want one", env.errs)
+	}
+}
@@ -0,0 +1,327 @@
+package main
+
+import (
+	"concurrent-subscriptions/data"
+	"context"
+	"database/sql"
+	"encoding/gob"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alexedwards/scs/v2"
+	"github.com/alexedwards/scs/v2/memstore"
+	"github.com/gomodule/redigo/redis"
+)
+
+// testPlans are the plans every test app starts with
+var testPlans = []data.Plan{
+	{ID: 1, PlanName: "Bronze Plan", PlanAmount: 1000},
+	{ID: 2, PlanName: "Silver Plan", PlanAmount: 2000},
+}
+
+// newTestApp returns an application backed by the in-memory repositories,
+// session store, limiter store and mail transport, so handlers can be tested
+// without Postgres, Redis or an SMTP server
+func newTestApp(t *testing.T) *Config {
+	t.Helper()
+
+	gob.Register(data.User{})
+
+	templates, err := NewTemplates(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	secrets, err := NewSecretBox("test key")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	metrics := NewMetrics()
+
+	session := scs.New()
+	session.Store = &metricsStore{store: memstore.New(), errors: metrics.SessionErrors}
+
+	settings := Settings{
+		AppURL:          "http://localhost",
+		ShutdownTimeout: 5 * time.Second,
+		Mail: MailSettings{
+			Workers:      2,
+			MaxAttempts:  3,
+			QueueSize:    100,
+			DrainTimeout: 5 * time.Second,
+		},
+		Login: LoginSettings{
+			MaxPerIP:    20,
+			MaxPerEmail: 3,
+			Window:      time.Minute,
+			LockoutFor:  time.Minute,
+		},
+	}
+
+	app := &Config{
+		Session:   session,
+		Log:       slog.New(slog.NewTextHandler(io.Discard, nil)),
+		Wait:      &sync.WaitGroup{},
+		Models:    data.NewMemory(testPlans...),
+		Signer:    NewSigner("test secret"),
+		Secrets:   secrets,
+		Templates: templates,
+		Settings:  settings,
+		Metrics:   metrics,
+		LoginLimiter: &LoginLimiter{
+			Store:       NewMemoryLimiterStore(),
+			MaxPerIP:    settings.Login.MaxPerIP,
+			MaxPerEmail: settings.Login.MaxPerEmail,
+			Window:      settings.Login.Window,
+			LockoutFor:  settings.Login.LockoutFor,
+		},
+	}
+
+	app.Mailer = Mail{
+		FromAddress:   "info@example.com",
+		FromName:      "Test",
+		Wait:          &sync.WaitGroup{},
+		Transport:     &MemoryTransport{},
+		Templates:     templates,
+		Workers:       settings.Mail.Workers,
+		MaxAttempts:   settings.Mail.MaxAttempts,
+		RetryDelay:    time.Millisecond,
+		MaxRetryDelay: time.Millisecond,
+		Lease:         time.Minute,
+		PollInterval:  10 * time.Millisecond,
+		QueueSize:     settings.Mail.QueueSize,
+		WakeChan:      make(chan struct{}, 1),
+		DoneChan:      make(chan bool),
+	}
+
+	return app
+}
+
+// addUnusedPools gives the app a database and Redis pool that are never
+// connected to, for code that only reads their stats or closes them
+func addUnusedPools(t *testing.T, app *Config) {
+	t.Helper()
+
+	db, err := sql.Open("pgx", "postgres://localhost/unused")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = db.Close() })
+
+	app.DB = db
+	app.Redis = &redis.Pool{}
+}
+
+// addUser stores an active user with the given email and password, and returns it
+func addUser(t *testing.T, app *Config, email, password string) *data.User {
+	t.Helper()
+
+	id, err := app.Models.User.Insert(context.Background(), data.User{
+		Email:     email,
+		FirstName: "Test",
+		LastName:  "User",
+		Password:  password,
+		Active:    1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	user, err := app.Models.User.GetOne(context.Background(), id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return user
+}
+
+// addAdmin stores an active administrator with two-factor authentication
+// turned on, as AdminOnly requires, and returns them with a recovery code
+func addAdmin(t *testing.T, app *Config, email, password string) (*data.User, string) {
+	t.Helper()
+
+	user := addUser(t, app, email, password)
+	user.IsAdmin = 1
+	if err := app.Models.User.Update(context.Background(), *user); err != nil {
+		t.Fatal(err)
+	}
+	_, codes := enableTwoFactor(t, app, user.ID)
+
+	return user, codes[0]
+}
+
+// enableTwoFactor turns on two-factor authentication for a user and returns
+// their TOTP secret and recovery codes
+func enableTwoFactor(t *testing.T, app *Config, userID int) (string, []string) {
+	t.Helper()
+
+	secret, err := newTOTPSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed, err := app.Secrets.Seal(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	codes, err := app.Models.TwoFactor.Enable(context.Background(), userID, sealed, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return secret, codes
+}
+
+// testClient makes requests to a test server, keeping its cookies between
+// requests like a browser does, but without following redirects
+type testClient struct {
+	t      *testing.T
+	srv    *httptest.Server
+	client *http.Client
+}
+
+func newTestClient(t *testing.T, app *Config) *testClient {
+	t.Helper()
+
+	srv := httptest.NewServer(app.routes())
+	t.Cleanup(srv.Close)
+
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &testClient{
+		t:   t,
+		srv: srv,
+		client: &http.Client{
+			Jar: jar,
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+	}
+}
+
+// get makes a GET request and returns the response and its body
+func (c *testClient) get(path string) (*http.Response, string) {
+	c.t.Helper()
+
+	req, err := http.NewRequest(http.MethodGet, c.srv.URL+path, nil)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+
+	return c.do(req)
+}
+
+// postForm posts form values and returns the response and its body
+func (c *testClient) postForm(path string, values url.Values) (*http.Response, string) {
+	c.t.Helper()
+
+	req, err := http.NewRequest(http.MethodPost, c.srv.URL+path, strings.NewReader(values.Encode()))
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	return c.do(req)
+}
+
+// postJSON posts body as JSON and returns the response and its body
+func (c *testClient) postJSON(path string, body any) (*http.Response, string) {
+	c.t.Helper()
+
+	b, err := json.Marshal(body)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+
+	req, err := http.NewRequest(http.MethodPost, c.srv.URL+path, strings.NewReader(string(b)))
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	return c.do(req)
+}
+
+func (c *testClient) do(req *http.Request) (*http.Response, string) {
+	c.t.Helper()
+
+	res, err := c.client.Do(req)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+
+	return res, string(body)
+}
+
+// logIn logs the client in with the given credentials and fails the test if that doesn't work
+func (c *testClient) logIn(email, password string) {
+	c.t.Helper()
+
+	res, _ := c.postForm("/login", url.Values{"email": {email}, "password": {password}})
+	if loc := res.Header.Get("Location"); res.StatusCode != http.StatusSeeOther || loc != "/" {
+		c.t.Fatalf("logging in: got %d to %q, want 303 to /", res.StatusCode, loc)
+	}
+}
+
+// logInWithCode logs the client in with a password and a second factor code,
+// and fails the test if that doesn't work
+func (c *testClient) logInWithCode(email, password, code string) {
+	c.t.Helper()
+
+	res, _ := c.postForm("/login", url.Values{"email": {email}, "password": {password}})
+	if loc := res.Header.Get("Location"); loc != "/login/2fa" {
+		c.t.Fatalf("logging in: redirected to %q, want /login/2fa", loc)
+	}
+
+	res, _ = c.postForm("/login/2fa", url.Values{"code": {code}})
+	if loc := res.Header.Get("Location"); res.StatusCode != http.StatusSeeOther || loc != "/" {
+		c.t.Fatalf("entering code: got %d to %q, want 303 to /", res.StatusCode, loc)
+	}
+}
+
+// loggedInAs returns the email of the user the client is logged in as, or "" if it isn't
+func (c *testClient) loggedInAs() string {
+	c.t.Helper()
+
+	res, body := c.get("/api/v1/me")
+	if res.StatusCode == http.StatusUnauthorized {
+		return ""
+	}
+	if res.StatusCode != http.StatusOK {
+		c.t.Fatalf("GET /api/v1/me: got %d: %s", res.StatusCode, body)
+	}
+
+	var profile struct {
+		Data APIUser `json:"data"`
+	}
+	if err := json.Unmarshal([]byte(body), &profile); err != nil {
+		c.t.Fatal(err)
+	}
+
+	return profile.Data.Email
+}
+
+// outbox returns the in-memory outbox the app queues mail in
+func outbox(app *Config) *data.MemoryOutboxRepository {
+	return app.Models.Outbox.(*data.MemoryOutboxRepository)
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"errors"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSigner(t *testing.T) {
+	signedAt := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	signer := NewSigner("test secret")
+	signer.now = func() time.Time { return signedAt }
+
+	link, err := signer.SignURL("http://localhost/activate?email=alice%40example.com", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// change rewrites the signed link's query
+	change := func(key, value string) string {
+		u, _ := url.Parse(link)
+		q := u.Query()
+		q.Set(key, value)
+		u.RawQuery = q.Encode()
+		return u.String()
+	}
+
+	tests := []struct {
+		name string
+		url  string
+		now  time.Time
+		want error
+	}{
+		{"valid", link, signedAt, nil},
+		{"valid without the host", strings.TrimPrefix(link, "http://localhost"), signedAt, nil},
+		{"valid until it expires", link, signedAt.Add(time.Hour), nil},
+		{"expired", link, signedAt.Add(time.Hour + time.Second), ErrExpiredSignature},
+		{"different email", change("email", "mallory@example.com"), signedAt, ErrInvalidSignature},
+		{"later expiry", change("expires", "9999999999"), signedAt.Add(2 * time.Hour), ErrInvalidSignature},
+		{"forged signature", change("signature", "AAAA"), signedAt, ErrInvalidSignature},
+		{"extra parameter", change("admin", "1"), signedAt, ErrInvalidSignature},
+		{"different path", strings.Replace(link, "/activate", "/reset-password", 1), signedAt, ErrInvalidSignature},
+		{"no signature", "http://localhost/activate?email=alice%40example.com&expires=9999999999", signedAt, ErrInvalidSignature},
+		{"unparsable", "http://localhost/%zz", signedAt, ErrInvalidSignature},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			signer.now = func() time.Time { return tt.now }
+
+			if err := signer.VerifyURL(tt.url); !errors.Is(err, tt.want) {
+				t.Errorf("got %v, want %v", err, tt.want)
+			}
+		})
+	}
+
+	t.Run("other secret", func(t *testing.T) {
+		other := NewSigner("another secret")
+		other.now = func() time.Time { return signedAt }
+
+		if err := other.VerifyURL(link); !errors.Is(err, ErrInvalidSignature) {
+			t.Errorf("got %v, want %v", err, ErrInvalidSignature)
+		}
+	})
+
+	t.Run("signing again replaces the signature", func(t *testing.T) {
+		signer.now = func() time.Time { return signedAt }
+
+		resigned, err := signer.SignURL(link, time.Minute)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n := strings.Count(resigned, signatureParam+"="); n != 1 {
+			t.Errorf("got %d signatures in %s, want 1", n, resigned)
+		}
+		if err := signer.VerifyURL(resigned); err != nil {
+			t.Errorf("got %v, want a valid link", err)
+		}
+	})
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"embed"
+	"fmt"
+	"html/template"
+	"io/fs"
+	"os"
+	"path"
+	"strings"
+	textTemplate "text/template"
+)
+
+//go:embed templates
+var embeddedTemplates embed.FS
+
+// Templates holds every page and mail template, parsed once at startup. In dev
+// mode the templates are instead read from disk and parsed on every use, so
+// edits show up without rebuilding the binary.
+type Templates struct {
+	fsys   fs.FS
+	reload bool
+
+	pages    map[string]*template.Template
+	mailHTML map[string]*template.Template
+	mailText map[string]*textTemplate.Template
+}
+
+// NewTemplates parses the templates embedded in the binary, or, in dev mode,
+// the ones under pathToTemplates
+func NewTemplates(devMode bool) (*Templates, error) {
+	var fsys fs.FS
+	if devMode {
+		fsys = os.DirFS(pathToTemplates)
+	} else {
+		sub, err := fs.Sub(embeddedTemplates, "templates")
+		if err != nil {
+			return nil, err
+		}
+		fsys = sub
+	}
+
+	t := &Templates{
+		fsys:     fsys,
+		reload:   devMode,
+		pages:    make(map[string]*template.Template),
+		mailHTML: make(map[string]*template.Template),
+		mailText: make(map[string]*textTemplate.Template),
+	}
+
+	// parse everything up front, even in dev mode, so a broken template stops startup
+	names, err := fs.Glob(fsys, "*.gohtml")
+	if err != nil {
+		return nil, err
+	}
+
+	for _, name := range names {
+		switch {
+		case strings.HasSuffix(name, ".page.gohtml"):
+			if t.pages[name], err = t.parsePage(name); err != nil {
+				return nil, err
+			}
+		case strings.HasSuffix(name, ".html.gohtml"):
+			mail := strings.TrimSuffix(name, ".html.gohtml")
+			if t.mailHTML[mail], err = t.parseMailHTML(mail); err != nil {
+				return nil, err
+			}
+		case strings.HasSuffix(name, ".plain.gohtml"):
+			mail := strings.TrimSuffix(name, ".plain.gohtml")
+			if t.mailText[mail], err = t.parseMailText(mail); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return t, nil
+}
+
+// Page returns the named page template, parsed together with the layout and partials
+func (t *Templates) Page(name string) (*template.Template, error) {
+	if t.reload {
+		return t.parsePage(name)
+	}
+
+	tmpl, ok := t.pages[name]
+	if !ok {
+		return nil, fmt.Errorf("template %s does not exist", name)
+	}
+	return tmpl, nil
+}
+
+// MailHTML returns the HTML template for the named email
+func (t *Templates) MailHTML(name string) (*template.Template, error) {
+	if t.reload {
+		return t.parseMailHTML(name)
+	}
+
+	tmpl, ok := t.mailHTML[name]
+	if !ok {
+		return nil, fmt.Errorf("html mail template %s does not exist", name)
+	}
+	return tmpl, nil
+}
+
+// MailText returns the plain text template for the named email
+func (t *Templates) MailText(name string) (*textTemplate.Template, error) {
+	if t.reload {
+		return t.parseMailText(name)
+	}
+
+	tmpl, ok := t.mailText[name]
+	if !ok {
+		return nil, fmt.Errorf("plain text mail template %s does not exist", name)
+	}
+	return tmpl, nil
+}
+
+// parsePage parses a page template along with the base layout and all partials
+func (t *Templates) parsePage(name string) (*template.Template, error) {
+	layouts, err := fs.Glob(t.fsys, "*.layout.gohtml")
+	if err != nil {
+		return nil, err
+	}
+
+	partials, err := fs.Glob(t.fsys, "*.partial.gohtml")
+	if err != nil {
+		return nil, err
+	}
+
+	files := append([]string{name}, layouts...)
+	files = append(files, partials...)
+
+	return template.New(path.Base(name)).ParseFS(t.fsys, files...)
+}
+
+// parseMailHTML parses the HTML template for the named email
+func (t *Templates) parseMailHTML(name string) (*template.Template, error) {
+	return template.New("email-html").ParseFS(t.fsys, name+".html.gohtml")
+}
+
+// parseMailText parses the plain text template for the named email. It uses
+// text/template, so links and punctuation are not HTML escaped.
+func (t *Templates) parseMailText(name string) (*textTemplate.Template, error) {
+	return textTemplate.New("email-plain").ParseFS(t.fsys, name+".plain.gohtml")
+}
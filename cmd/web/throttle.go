@@ -0,0 +1,337 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// LoginLimiter throttles failed logins using counters in Store, which is Redis
+// in production, so the limits hold across every instance of the app. Failures
+// are counted per client IP and per email address in fixed windows of Window,
+// each starting at the first failure; once an email reaches MaxPerEmail
+// failures the account is locked for LockoutFor.
+//
+// The limiter fails closed: when Store returns an error, callers refuse the
+// attempt rather than let it through unchecked, so taking Redis down can't be
+// used to get around the limits.
+type LoginLimiter struct {
+	Store       LimiterStore
+	MaxPerIP    int
+	MaxPerEmail int
+	Window      time.Duration
+	LockoutFor  time.Duration
+}
+
+// LimiterStore holds the counters and locks LoginLimiter works with. Every key
+// expires; nothing is kept for longer than a window or lockout.
+type LimiterStore interface {
+	// Incr adds one to the counter at key and returns its new value. A counter
+	// that doesn't exist yet is created with an expiry of window.
+	Incr(key string, window time.Duration) (int, error)
+	// Get returns the value at key and how long until it expires, or zeroes
+	// if it doesn't exist
+	Get(key string) (int, time.Duration, error)
+	// SetNX sets key to 1, expiring after ttl, unless it already exists. It
+	// reports whether it set the key.
+	SetNX(key string, ttl time.Duration) (bool, error)
+	// Del removes key
+	Del(key string) error
+}
+
+// Password reset requests allowed in each window. Every request counts, not
+// just failures, as each one sends an email.
+const (
+	maxResetsPerIP    = 10
+	maxResetsPerEmail = 3
+)
+
+// AllowReset records a password reset request and reports whether it is within
+// the limits, per client IP and per email address. On an error it reports false.
+func (l *LoginLimiter) AllowReset(ip, email string) (bool, error) {
+	perIP, err := l.Store.Incr(l.key("reset-ip", ip), l.Window)
+	if err != nil {
+		return false, err
+	}
+
+	perEmail, err := l.Store.Incr(l.key("reset-email", email), l.Window)
+	if err != nil {
+		return false, err
+	}
+
+	return perIP <= maxResetsPerIP && perEmail <= maxResetsPerEmail, nil
+}
+
+// Blocked reports how long the client must wait before trying to log in again,
+// or zero if it may try now. On an error callers must refuse the attempt.
+func (l *LoginLimiter) Blocked(ip, email string) (time.Duration, error) {
+	// a locked account stays locked whichever IP the attempt comes from
+	_, ttl, err := l.Store.Get(l.lockKey(email))
+	if err != nil {
+		return 0, err
+	}
+	if ttl > 0 {
+		return ttl, nil
+	}
+
+	failures, ttl, err := l.Store.Get(l.ipKey(ip))
+	if err != nil {
+		return 0, err
+	}
+	if failures >= l.MaxPerIP {
+		return ttl, nil
+	}
+
+	return 0, nil
+}
+
+// Fail records a failed login. It returns true if this failure locked the account.
+func (l *LoginLimiter) Fail(ip, email string) (bool, error) {
+	if _, err := l.Store.Incr(l.ipKey(ip), l.Window); err != nil {
+		return false, err
+	}
+
+	failures, err := l.Store.Incr(l.emailKey(email), l.Window)
+	if err != nil {
+		return false, err
+	}
+
+	if failures < l.MaxPerEmail {
+		return false, nil
+	}
+
+	// only the request that sets the lock reports it, so callers act on it once
+	locked, err := l.Store.SetNX(l.lockKey(email), l.LockoutFor)
+	if err != nil || !locked {
+		return false, err
+	}
+
+	return true, l.Store.Del(l.emailKey(email))
+}
+
+// Succeed clears the failure count for an email after a successful login
+func (l *LoginLimiter) Succeed(email string) error {
+	return l.Store.Del(l.emailKey(email))
+}
+
+// ShouldNotify returns true the first time it is called for an email in each
+// window, so the account owner gets at most one lockout email per window
+func (l *LoginLimiter) ShouldNotify(email string) (bool, error) {
+	return l.Store.SetNX(l.key("notified", email), l.Window)
+}
+
+func (l *LoginLimiter) ipKey(ip string) string       { return l.key("ip", ip) }
+func (l *LoginLimiter) emailKey(email string) string { return l.key("email", email) }
+func (l *LoginLimiter) lockKey(email string) string  { return l.key("lock", email) }
+
+func (l *LoginLimiter) key(kind, id string) string {
+	return fmt.Sprintf("login:%s:%s", kind, strings.ToLower(strings.TrimSpace(id)))
+}
+
+// RedisLimiterStore is the LimiterStore used in production
+type RedisLimiterStore struct {
+	Pool *redis.Pool
+}
+
+// Incr increments the counter at key. The counter is created with its expiry
+// and incremented in one transaction, and INCR keeps the expiry, so a counter
+// can never be left without one.
+func (s *RedisLimiterStore) Incr(key string, window time.Duration) (int, error) {
+	conn := s.Pool.Get()
+	defer conn.Close()
+
+	if err := conn.Send("MULTI"); err != nil {
+		return 0, err
+	}
+	if err := conn.Send("SET", key, 0, "PX", window.Milliseconds(), "NX"); err != nil {
+		return 0, err
+	}
+	if err := conn.Send("INCR", key); err != nil {
+		return 0, err
+	}
+
+	replies, err := redis.Values(conn.Do("EXEC"))
+	if err != nil {
+		return 0, err
+	}
+
+	return redis.Int(replies[1], nil)
+}
+
+// Get returns the value at key and how long until it expires
+func (s *RedisLimiterStore) Get(key string) (int, time.Duration, error) {
+	conn := s.Pool.Get()
+	defer conn.Close()
+
+	n, err := redis.Int(conn.Do("GET", key))
+	if errors.Is(err, redis.ErrNil) {
+		return 0, 0, nil
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+
+	ttl, err := redis.Int64(conn.Do("PTTL", key))
+	if err != nil {
+		return 0, 0, err
+	}
+	if ttl < 0 {
+		ttl = 0
+	}
+
+	return n, time.Duration(ttl) * time.Millisecond, nil
+}
+
+// SetNX sets key to 1 with an expiry, unless it exists
+func (s *RedisLimiterStore) SetNX(key string, ttl time.Duration) (bool, error) {
+	conn := s.Pool.Get()
+	defer conn.Close()
+
+	reply, err := conn.Do("SET", key, 1, "PX", ttl.Milliseconds(), "NX")
+	if err != nil {
+		return false, err
+	}
+
+	return reply != nil, nil
+}
+
+// Del removes key
+func (s *RedisLimiterStore) Del(key string) error {
+	conn := s.Pool.Get()
+	defer conn.Close()
+
+	_, err := conn.Do("DEL", key)
+	return err
+}
+
+// MemoryLimiterStore is a LimiterStore that keeps everything in memory, for
+// tests. Its limits only hold within one process.
+type MemoryLimiterStore struct {
+	mu     sync.Mutex
+	values map[string]limiterValue
+}
+
+type limiterValue struct {
+	n       int
+	expires time.Time
+}
+
+// NewMemoryLimiterStore returns an empty MemoryLimiterStore
+func NewMemoryLimiterStore() *MemoryLimiterStore {
+	return &MemoryLimiterStore{values: make(map[string]limiterValue)}
+}
+
+// Incr increments the counter at key, creating it with an expiry of window
+func (s *MemoryLimiterStore) Incr(key string, window time.Duration) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	v, ok := s.live(key)
+	if !ok {
+		v = limiterValue{expires: time.Now().Add(window)}
+	}
+	v.n++
+	s.values[key] = v
+
+	return v.n, nil
+}
+
+// Get returns the value at key and how long until it expires
+func (s *MemoryLimiterStore) Get(key string) (int, time.Duration, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	v, ok := s.live(key)
+	if !ok {
+		return 0, 0, nil
+	}
+
+	return v.n, time.Until(v.expires), nil
+}
+
+// SetNX sets key to 1 with an expiry, unless it exists
+func (s *MemoryLimiterStore) SetNX(key string, ttl time.Duration) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.live(key); ok {
+		return false, nil
+	}
+	s.values[key] = limiterValue{n: 1, expires: time.Now().Add(ttl)}
+
+	return true, nil
+}
+
+// Del removes key
+func (s *MemoryLimiterStore) Del(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.values, key)
+
+	return nil
+}
+
+// live returns the value at key, if it exists and hasn't expired. s.mu must be held.
+func (s *MemoryLimiterStore) live(key string) (limiterValue, bool) {
+	v, ok := s.values[key]
+	if !ok || !time.Now().Before(v.expires) {
+		delete(s.values, key)
+		return limiterValue{}, false
+	}
+
+	return v, true
+}
+
+// clientIP returns the IP address the request came from. Behind a reverse
+// proxy RemoteAddr is the proxy, so when it is one of Settings.TrustedProxies
+// the address is taken from X-Forwarded-For instead: the rightmost entry that
+// isn't a trusted proxy itself, as anything left of that may have been sent by
+// the client. X-Forwarded-For is ignored on requests from anywhere else.
+func (app *Config) clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	addr, err := netip.ParseAddr(host)
+	if err != nil || !app.trustedProxy(addr) {
+		return host
+	}
+
+	var hops []string
+	for _, v := range r.Header.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(v, ",")...)
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop, err := netip.ParseAddr(strings.TrimSpace(hops[i]))
+		if err != nil {
+			break
+		}
+		if !app.trustedProxy(hop) {
+			return hop.Unmap().String()
+		}
+		addr = hop
+	}
+
+	// every hop was a trusted proxy, or the header was missing or garbled
+	return addr.Unmap().String()
+}
+
+// trustedProxy reports whether addr is one of Settings.TrustedProxies
+func (app *Config) trustedProxy(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, p := range app.Settings.TrustedProxies {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func newTestLimiter() *LoginLimiter {
+	return &LoginLimiter{
+		Store:       NewMemoryLimiterStore(),
+		MaxPerIP:    5,
+		MaxPerEmail: 3,
+		Window:      time.Minute,
+		LockoutFor:  time.Hour,
+	}
+}
+
+func TestLoginLimiterLocksAccount(t *testing.T) {
+	l := newTestLimiter()
+
+	for i := 1; i <= l.MaxPerEmail; i++ {
+		locked, err := l.Fail("192.0.2.1", "alice@example.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := i == l.MaxPerEmail; locked != want {
+			t.Fatalf("failure %d: locked = %v, want %v", i, locked, want)
+		}
+	}
+
+	// the lock holds from any IP, for the lockout rather than the window,
+	// and whatever case the email is typed in
+	wait, err := l.Blocked("198.51.100.7", " Alice@Example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if wait <= l.Window || wait > l.LockoutFor {
+		t.Errorf("blocked for %s, want up to %s", wait, l.LockoutFor)
+	}
+
+	// only the failure that set the lock reports it
+	if locked, _ := l.Fail("192.0.2.1", "alice@example.com"); locked {
+		t.Error("failure after the lock reported locking it again")
+	}
+
+	if wait, _ := l.Blocked("192.0.2.1", "bob@example.com"); wait != 0 {
+		t.Errorf("another account is blocked for %s", wait)
+	}
+}
+
+func TestLoginLimiterSucceed(t *testing.T) {
+	l := newTestLimiter()
+
+	for i := 0; i < l.MaxPerEmail-1; i++ {
+		l.Fail("192.0.2.1", "alice@example.com")
+	}
+	if err := l.Succeed("alice@example.com"); err != nil {
+		t.Fatal(err)
+	}
+
+	// the count starts again, so one more failure doesn't lock the account
+	if locked, _ := l.Fail("192.0.2.1", "alice@example.com"); locked {
+		t.Error("failure after a successful login locked the account")
+	}
+}
+
+func TestLoginLimiterBlocksIP(t *testing.T) {
+	l := newTestLimiter()
+
+	// spread over accounts, so none of them is locked
+	for i := 0; i < l.MaxPerIP; i++ {
+		l.Fail("192.0.2.1", string(rune('a'+i))+"@example.com")
+	}
+
+	wait, err := l.Blocked("192.0.2.1", "new@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if wait <= 0 || wait > l.Window {
+		t.Errorf("blocked for %s, want up to %s", wait, l.Window)
+	}
+	if wait, _ := l.Blocked("192.0.2.2", "new@example.com"); wait != 0 {
+		t.Errorf("another IP is blocked for %s", wait)
+	}
+}
+
+func TestLoginLimiterShouldNotify(t *testing.T) {
+	l := newTestLimiter()
+
+	for i, want := range []bool{true, false, false} {
+		got, err := l.ShouldNotify("alice@example.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != want {
+			t.Errorf("call %d: got %v, want %v", i+1, got, want)
+		}
+	}
+}
+
+func TestLoginLimiterAllowReset(t *testing.T) {
+	tests := []struct {
+		name    string
+		ips     []string
+		email   string
+		allowed bool
+	}{
+		{"first request", []string{"192.0.2.1"}, "alice@example.com", true},
+		{"at the email limit", []string{"192.0.2.1", "192.0.2.2", "192.0.2.3"}, "alice@example.com", true},
+		{"over the email limit", []string{"192.0.2.1", "192.0.2.2", "192.0.2.3", "192.0.2.4"}, "alice@example.com", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := newTestLimiter()
+
+			var allowed bool
+			for _, ip := range tt.ips {
+				var err error
+				if allowed, err = l.AllowReset(ip, tt.email); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if allowed != tt.allowed {
+				t.Errorf("got %v, want %v", allowed, tt.allowed)
+			}
+		})
+	}
+
+	t.Run("over the IP limit", func(t *testing.T) {
+		l := newTestLimiter()
+
+		for i := 0; i < maxResetsPerIP; i++ {
+			l.AllowReset("192.0.2.1", string(rune('a'+i))+"@example.com")
+		}
+		if allowed, _ := l.AllowReset("192.0.2.1", "new@example.com"); allowed {
+			t.Error("request over the IP limit was allowed")
+		}
+	})
+}
+
+// brokenLimiterStore fails every call, like Redis being unreachable
+type brokenLimiterStore struct{}
+
+var errStoreDown = errors.New("store down")
+
+func (brokenLimiterStore) Incr(string, time.Duration) (int, error)   { return 0, errStoreDown }
+func (brokenLimiterStore) Get(string) (int, time.Duration, error)    { return 0, 0, errStoreDown }
+func (brokenLimiterStore) SetNX(string, time.Duration) (bool, error) { return false, errStoreDown }
+func (brokenLimiterStore) Del(string) error                          { return errStoreDown }
+
+func TestLoginLimiterFailsClosed(t *testing.T) {
+	l := newTestLimiter()
+	l.Store = brokenLimiterStore{}
+
+	if _, err := l.Blocked("192.0.2.1", "alice@example.com"); err == nil {
+		t.Error("Blocked returned no error")
+	}
+	if allowed, err := l.AllowReset("192.0.2.1", "alice@example.com"); allowed || err == nil {
+		t.Errorf("AllowReset = %v, %v; want false and an error", allowed, err)
+	}
+
+	// and a login is refused rather than let through unchecked
+	app := newTestApp(t)
+	addUser(t, app, "alice@example.com", "correct horse")
+	app.LoginLimiter.Store = brokenLimiterStore{}
+	c := newTestClient(t, app)
+
+	res, _ := c.postJSON("/api/v1/login", map[string]string{"email": "alice@example.com", "password": "correct horse"})
+	if res.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("got %d, want 503", res.StatusCode)
+	}
+
+	res, _ = c.postForm("/login", url.Values{"email": {"alice@example.com"}, "password": {"correct horse"}})
+	if res.StatusCode != http.StatusSeeOther || res.Header.Get("Location") != "/login" {
+		t.Errorf("got %d to %q, want 303 to /login", res.StatusCode, res.Header.Get("Location"))
+	}
+	if got := c.loggedInAs(); got != "" {
+		t.Errorf("logged in as %q without checking the throttle", got)
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	trusted := []netip.Prefix{
+		netip.MustParsePrefix("10.0.0.0/8"),
+		netip.MustParsePrefix("2001:db8::1/128"),
+	}
+
+	tests := []struct {
+		name       string
+		trusted    []netip.Prefix
+		remoteAddr string
+		xff        []string
+		want       string
+	}{
+		{"no proxies configured", nil, "192.0.2.1:1234", nil, "192.0.2.1"},
+		{"header ignored without trusted proxies", nil, "192.0.2.1:1234", []string{"203.0.113.9"}, "192.0.2.1"},
+		{"header ignored from an untrusted peer", trusted, "192.0.2.1:1234", []string{"203.0.113.9"}, "192.0.2.1"},
+		{"trusted proxy", trusted, "10.0.0.2:1234", []string{"203.0.113.9"}, "203.0.113.9"},
+		{"spoofed entries on the left", trusted, "10.0.0.2:1234", []string{"1.2.3.4, 203.0.113.9"}, "203.0.113.9"},
+		{"chain of trusted proxies", trusted, "10.0.0.2:1234", []string{"203.0.113.9, 10.1.1.1", "10.0.0.3"}, "203.0.113.9"},
+		{"ipv6 proxy", trusted, "[2001:db8::1]:1234", []string{"2001:db8::2"}, "2001:db8::2"},
+		{"ipv4 mapped peer", trusted, "[::ffff:10.0.0.2]:1234", []string{"203.0.113.9"}, "203.0.113.9"},
+		{"no header from a trusted proxy", trusted, "10.0.0.2:1234", nil, "10.0.0.2"},
+		{"only trusted hops", trusted, "10.0.0.2:1234", []string{"10.0.0.3"}, "10.0.0.3"},
+		{"garbled header", trusted, "10.0.0.2:1234", []string{"203.0.113.9, nonsense"}, "10.0.0.2"},
+		{"remote addr without a port", nil, "192.0.2.1", nil, "192.0.2.1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := &Config{Settings: Settings{TrustedProxies: tt.trusted}}
+
+			r := httptest.NewRequest(http.MethodPost, "/login", nil)
+			r.RemoteAddr = tt.remoteAddr
+			for _, v := range tt.xff {
+				r.Header.Add("X-Forwarded-For", v)
+			}
+
+			if got := app.clientIP(r); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
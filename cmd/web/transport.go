@@ -0,0 +1,136 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	mail "github.com/xhit/go-simple-mail/v2"
+)
+
+// Transport delivers a fully built email. Mail.sendMail builds the message and
+// hands it to whichever Transport was configured with MAIL_DRIVER.
+type Transport interface {
+	Send(email *mail.Email) error
+}
+
+// newTransport returns the transport for the named driver: "smtp" (the default),
+// "file" to drop .eml files into a maildir for local development, or "memory"
+// to capture messages for tests
+func newTransport(driver string, m *Mail, dir string) (Transport, error) {
+	switch driver {
+	case "", "smtp":
+		return &SMTPTransport{server: m.setupMailServer()}, nil
+	case "file":
+		return NewFileTransport(dir)
+	case "memory":
+		return &MemoryTransport{}, nil
+	default:
+		return nil, fmt.Errorf("unknown mail driver %q", driver)
+	}
+}
+
+// SMTPTransport sends email through an SMTP server, opening a new connection for every message
+type SMTPTransport struct {
+	server *mail.SMTPServer
+
+	// checkMu guards the last result of Check, which is reused for a while
+	checkMu   sync.Mutex
+	checkedAt time.Time
+	checkErr  error
+}
+
+// Send connects to the SMTP server and sends the email
+func (t *SMTPTransport) Send(email *mail.Email) error {
+	slog.Debug("Connecting to mail server", "host", t.server.Host, "port", t.server.Port)
+	smtpClient, err := t.server.Connect()
+	if err != nil {
+		return err
+	}
+
+	return email.Send(smtpClient)
+}
+
+// FileTransport writes every email as an .eml file into a maildir, so local
+// development needs no mail server. Messages are written to dir/tmp and then
+// renamed into dir/new, so a reader never sees a partial file.
+type FileTransport struct {
+	dir      string
+	hostname string
+	seq      atomic.Uint64
+}
+
+// NewFileTransport returns a FileTransport for the maildir at dir, creating it if needed
+func NewFileTransport(dir string) (*FileTransport, error) {
+	for _, sub := range []string{"tmp", "new", "cur"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0o755); err != nil {
+			return nil, err
+		}
+	}
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "localhost"
+	}
+
+	return &FileTransport{dir: dir, hostname: hostname}, nil
+}
+
+// Send writes the email to the maildir
+func (t *FileTransport) Send(email *mail.Email) error {
+	name := fmt.Sprintf("%d.%d_%d.%s.eml", time.Now().Unix(), os.Getpid(), t.seq.Add(1), t.hostname)
+
+	tmp := filepath.Join(t.dir, "tmp", name)
+	if err := os.WriteFile(tmp, []byte(email.GetMessage()), 0o644); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, filepath.Join(t.dir, "new", name))
+}
+
+// CapturedEmail is one message recorded by a MemoryTransport
+type CapturedEmail struct {
+	From string
+	To   []string
+	Raw  string
+}
+
+// MemoryTransport records every email it is given instead of sending it
+type MemoryTransport struct {
+	mu       sync.Mutex
+	messages []CapturedEmail
+}
+
+// Send records the email
+func (t *MemoryTransport) Send(email *mail.Email) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.messages = append(t.messages, CapturedEmail{
+		From: email.GetFrom(),
+		To:   email.GetRecipients(),
+		Raw:  email.GetMessage(),
+	})
+
+	return nil
+}
+
+// Messages returns a copy of the emails recorded so far
+func (t *MemoryTransport) Messages() []CapturedEmail {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return append([]CapturedEmail(nil), t.messages...)
+}
+
+// Reset forgets all recorded emails
+func (t *MemoryTransport) Reset() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.messages = nil
+}
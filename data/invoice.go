@@ -0,0 +1,164 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// Invoice is the type for an invoice issued when a user subscribes to a plan.
+// Amount and Tax are stored in cents, like Plan.PlanAmount.
+type Invoice struct {
+	ID            int
+	InvoiceNumber string
+	UserID        int
+	PlanID        int
+	Amount        int
+	Tax           int
+	IssuedAt      time.Time
+	CreatedAt     time.Time
+	UpdatedAt     time.Time
+	User          *User
+	Plan          *Plan
+}
+
+// InvoiceRepository stores and retrieves invoices
+type InvoiceRepository interface {
+	Insert(ctx context.Context, invoice Invoice) (int, error)
+	GetOne(ctx context.Context, id int) (*Invoice, error)
+	GetAllForUser(ctx context.Context, userID int) ([]*Invoice, error)
+}
+
+// PostgresInvoiceRepository stores and retrieves invoices in Postgres
+type PostgresInvoiceRepository struct {
+	DB      *sql.DB
+	Timeout time.Duration
+}
+
+// Insert inserts a new invoice into the database, assigning it the next invoice
+// number, and returns the ID of the newly inserted row
+func (r *PostgresInvoiceRepository) Insert(ctx context.Context, invoice Invoice) (int, error) {
+	ctx, cancel := withTimeout(ctx, r.Timeout)
+	defer cancel()
+
+	if invoice.IssuedAt.IsZero() {
+		invoice.IssuedAt = time.Now()
+	}
+
+	var newID int
+	stmt := `with next as (select nextval('public.invoice_id_seq') as id)
+		insert into invoices (id, invoice_number, user_id, plan_id, amount, tax, issued_at, created_at, updated_at)
+		select id, 'INV-' || lpad(id::text, 6, '0'), $1, $2, $3, $4, $5, $6, $7 from next
+		returning id`
+
+	err := r.DB.QueryRowContext(ctx, stmt,
+		invoice.UserID,
+		invoice.PlanID,
+		invoice.Amount,
+		invoice.Tax,
+		invoice.IssuedAt,
+		time.Now(),
+		time.Now(),
+	).Scan(&newID)
+
+	if err != nil {
+		return 0, err
+	}
+
+	return newID, nil
+}
+
+// GetOne returns one invoice by id
+func (r *PostgresInvoiceRepository) GetOne(ctx context.Context, id int) (*Invoice, error) {
+	ctx, cancel := withTimeout(ctx, r.Timeout)
+	defer cancel()
+
+	query := `select id, invoice_number, user_id, plan_id, amount, tax, issued_at, created_at, updated_at
+			from invoices where id = $1`
+
+	var invoice Invoice
+	row := r.DB.QueryRowContext(ctx, query, id)
+
+	err := row.Scan(
+		&invoice.ID,
+		&invoice.InvoiceNumber,
+		&invoice.UserID,
+		&invoice.PlanID,
+		&invoice.Amount,
+		&invoice.Tax,
+		&invoice.IssuedAt,
+		&invoice.CreatedAt,
+		&invoice.UpdatedAt,
+	)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &invoice, nil
+}
+
+// GetAllForUser returns all invoices issued to a user, newest first
+func (r *PostgresInvoiceRepository) GetAllForUser(ctx context.Context, userID int) ([]*Invoice, error) {
+	ctx, cancel := withTimeout(ctx, r.Timeout)
+	defer cancel()
+
+	query := `select id, invoice_number, user_id, plan_id, amount, tax, issued_at, created_at, updated_at
+			from invoices where user_id = $1 order by issued_at desc`
+
+	rows, err := r.DB.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var invoices []*Invoice
+
+	for rows.Next() {
+		var invoice Invoice
+		err := rows.Scan(
+			&invoice.ID,
+			&invoice.InvoiceNumber,
+			&invoice.UserID,
+			&invoice.PlanID,
+			&invoice.Amount,
+			&invoice.Tax,
+			&invoice.IssuedAt,
+			&invoice.CreatedAt,
+			&invoice.UpdatedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		invoices = append(invoices, &invoice)
+	}
+
+	return invoices, nil
+}
+
+// Total returns the amount plus tax, in cents
+func (i *Invoice) Total() int {
+	return i.Amount + i.Tax
+}
+
+// AmountForDisplay formats the invoice amount as a currency string
+func (i *Invoice) AmountForDisplay() string {
+	return formatCents(i.Amount)
+}
+
+// TaxForDisplay formats the invoice tax as a currency string
+func (i *Invoice) TaxForDisplay() string {
+	return formatCents(i.Tax)
+}
+
+// TotalForDisplay formats the invoice total as a currency string
+func (i *Invoice) TotalForDisplay() string {
+	return formatCents(i.Total())
+}
+
+// formatCents formats an amount in cents as a currency string
+func formatCents(cents int) string {
+	return fmt.Sprintf("$%.2f", float64(cents)/100.0)
+}
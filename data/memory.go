@@ -0,0 +1,833 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+var (
+	_ UserRepository          = (*MemoryUserRepository)(nil)
+	_ PlanRepository          = (*MemoryPlanRepository)(nil)
+	_ InvoiceRepository       = (*MemoryInvoiceRepository)(nil)
+	_ OutboxRepository        = (*MemoryOutboxRepository)(nil)
+	_ PasswordResetRepository = (*MemoryPasswordResetRepository)(nil)
+	_ TwoFactorRepository     = (*MemoryTwoFactorRepository)(nil)
+)
+
+// NewMemory returns Models backed entirely by the in-memory repositories, with
+// the given plans. It is the in-memory counterpart of New.
+func NewMemory(plans ...Plan) Models {
+	planRepo := NewMemoryPlanRepository(plans...)
+	invoiceRepo := NewMemoryInvoiceRepository()
+	userRepo := NewMemoryUserRepository(planRepo)
+	userRepo.Invoices = invoiceRepo
+
+	return Models{
+		User:          userRepo,
+		Plan:          planRepo,
+		Invoice:       invoiceRepo,
+		Outbox:        NewMemoryOutboxRepository(),
+		PasswordReset: NewMemoryPasswordResetRepository(userRepo),
+		TwoFactor:     NewMemoryTwoFactorRepository(),
+	}
+}
+
+// MemoryPlanRepository is a PlanRepository that keeps everything in memory.
+// It is meant for tests, which can run handlers against it without Postgres.
+type MemoryPlanRepository struct {
+	mu            sync.Mutex
+	plans         map[int]Plan
+	subscriptions map[int]int // user id to plan id
+	nextID        int
+}
+
+// NewMemoryPlanRepository returns a MemoryPlanRepository holding the given plans.
+// Plans without an ID are given one.
+func NewMemoryPlanRepository(plans ...Plan) *MemoryPlanRepository {
+	r := &MemoryPlanRepository{
+		plans:         make(map[int]Plan),
+		subscriptions: make(map[int]int),
+	}
+
+	for _, plan := range plans {
+		if plan.ID == 0 {
+			r.nextID++
+			plan.ID = r.nextID
+		} else if plan.ID > r.nextID {
+			r.nextID = plan.ID
+		}
+		plan.PlanAmountFormatted = plan.AmountForDisplay()
+		r.plans[plan.ID] = plan
+	}
+
+	return r
+}
+
+// GetAll returns every plan, ordered by id
+func (r *MemoryPlanRepository) GetAll(_ context.Context) ([]*Plan, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	plans := make([]*Plan, 0, len(r.plans))
+	for _, plan := range r.plans {
+		plan := plan
+		plans = append(plans, &plan)
+	}
+
+	sort.Slice(plans, func(i, j int) bool { return plans[i].ID < plans[j].ID })
+
+	return plans, nil
+}
+
+// GetOne returns one plan by id, or sql.ErrNoRows
+func (r *MemoryPlanRepository) GetOne(_ context.Context, id int) (*Plan, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	plan, ok := r.plans[id]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+
+	return &plan, nil
+}
+
+// Insert adds a plan and returns its new ID
+func (r *MemoryPlanRepository) Insert(_ context.Context, plan Plan) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.nextID++
+	plan.ID = r.nextID
+	plan.PlanAmountFormatted = plan.AmountForDisplay()
+	plan.CreatedAt = time.Now()
+	plan.UpdatedAt = time.Now()
+	r.plans[plan.ID] = plan
+
+	return plan.ID, nil
+}
+
+// Update replaces the stored plan with the same ID as p
+func (r *MemoryPlanRepository) Update(_ context.Context, p Plan) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.plans[p.ID]; !ok {
+		return sql.ErrNoRows
+	}
+
+	p.PlanAmountFormatted = p.AmountForDisplay()
+	p.UpdatedAt = time.Now()
+	r.plans[p.ID] = p
+
+	return nil
+}
+
+// SubscribeUserToPlan records that the user is on plan, replacing any plan they had
+func (r *MemoryPlanRepository) SubscribeUserToPlan(_ context.Context, user User, plan Plan) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.plans[plan.ID]; !ok {
+		return sql.ErrNoRows
+	}
+
+	r.subscriptions[user.ID] = plan.ID
+
+	return nil
+}
+
+// planFor returns the plan the user is subscribed to, if any
+func (r *MemoryPlanRepository) planFor(userID int) *Plan {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	plan, ok := r.plans[r.subscriptions[userID]]
+	if !ok {
+		return nil
+	}
+
+	return &plan
+}
+
+// MemoryUserRepository is a UserRepository that keeps everything in memory.
+// It is meant for tests, which can run handlers against it without Postgres.
+// Passwords are hashed with the lowest bcrypt cost to keep tests fast.
+type MemoryUserRepository struct {
+	mu     sync.Mutex
+	users  map[int]User
+	nextID int
+
+	// Plans, if set, is where users' plans are looked up
+	Plans *MemoryPlanRepository
+	// Invoices, if set, is checked before deleting a user, as Postgres does
+	Invoices *MemoryInvoiceRepository
+}
+
+// NewMemoryUserRepository returns an empty MemoryUserRepository that looks
+// up users' plans in plans, which may be nil
+func NewMemoryUserRepository(plans *MemoryPlanRepository) *MemoryUserRepository {
+	return &MemoryUserRepository{
+		users: make(map[int]User),
+		Plans: plans,
+	}
+}
+
+// GetAll returns every user, sorted by last name. Like the Postgres
+// repository, it doesn't load their plans.
+func (r *MemoryUserRepository) GetAll(_ context.Context) ([]*User, error) {
+	r.mu.Lock()
+	users := make([]*User, 0, len(r.users))
+	for _, user := range r.users {
+		user := user
+		users = append(users, &user)
+	}
+	r.mu.Unlock()
+
+	sortUsers(users)
+
+	return users, nil
+}
+
+// Search returns one page of users whose email or name contains term, and
+// the total number of matching users
+func (r *MemoryUserRepository) Search(_ context.Context, term string, limit, offset int) ([]*User, int, error) {
+	r.mu.Lock()
+	var matches []*User
+	term = strings.ToLower(term)
+	for _, user := range r.users {
+		if strings.Contains(strings.ToLower(user.Email), term) ||
+			strings.Contains(strings.ToLower(user.FirstName), term) ||
+			strings.Contains(strings.ToLower(user.LastName), term) {
+			user := user
+			matches = append(matches, r.withPlan(&user))
+		}
+	}
+	r.mu.Unlock()
+
+	sortUsers(matches)
+
+	total := len(matches)
+	if offset > total {
+		offset = total
+	}
+	end := total
+	if limit < total-offset {
+		end = offset + limit
+	}
+
+	return matches[offset:end], total, nil
+}
+
+// GetByEmail returns one user by email, ignoring case, with their plan, or sql.ErrNoRows
+func (r *MemoryUserRepository) GetByEmail(_ context.Context, email string) (*User, error) {
+	r.mu.Lock()
+	var found *User
+	for _, user := range r.users {
+		if strings.EqualFold(user.Email, email) {
+			user := user
+			found = &user
+			break
+		}
+	}
+	r.mu.Unlock()
+
+	if found == nil {
+		return nil, sql.ErrNoRows
+	}
+
+	return r.withPlan(found), nil
+}
+
+// GetOne returns one user by id, with their plan, or sql.ErrNoRows
+func (r *MemoryUserRepository) GetOne(_ context.Context, id int) (*User, error) {
+	r.mu.Lock()
+	user, ok := r.users[id]
+	r.mu.Unlock()
+
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+
+	return r.withPlan(&user), nil
+}
+
+// Update replaces the stored user with the same ID as u. The password is left
+// as it was, and the email is normalised as by NormalizeEmail.
+func (r *MemoryUserRepository) Update(_ context.Context, u User) error {
+	u.Email = NormalizeEmail(u.Email)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	existing, ok := r.users[u.ID]
+	if !ok {
+		return sql.ErrNoRows
+	}
+	if r.emailTaken(u.Email, u.ID) {
+		return ErrDuplicateEmail
+	}
+
+	u.Password = existing.Password
+	u.CreatedAt = existing.CreatedAt
+	u.UpdatedAt = time.Now()
+	u.Plan = nil
+	r.users[u.ID] = u
+
+	return nil
+}
+
+// Delete deletes one user, by User.ID
+func (r *MemoryUserRepository) Delete(ctx context.Context, u User) error {
+	return r.DeleteByID(ctx, u.ID)
+}
+
+// DeleteByID deletes one user, by ID. Returns ErrUserHasInvoices if the user has been invoiced.
+func (r *MemoryUserRepository) DeleteByID(_ context.Context, id int) error {
+	if r.Invoices != nil && r.Invoices.hasUser(id) {
+		return ErrUserHasInvoices
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	delete(r.users, id)
+
+	return nil
+}
+
+// Insert adds a user, hashing their password and normalising their email, and returns their new ID
+func (r *MemoryUserRepository) Insert(_ context.Context, user User) (int, error) {
+	user.Email = NormalizeEmail(user.Email)
+
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(user.Password), bcrypt.MinCost)
+	if err != nil {
+		return 0, err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.emailTaken(user.Email, 0) {
+		return 0, ErrDuplicateEmail
+	}
+
+	r.nextID++
+	user.ID = r.nextID
+	user.Password = string(hashedPassword)
+	user.CreatedAt = time.Now()
+	user.UpdatedAt = time.Now()
+	user.Plan = nil
+	r.users[user.ID] = user
+
+	return user.ID, nil
+}
+
+// setPassword changes a user's password, as redeeming a reset token does
+func (r *MemoryUserRepository) setPassword(id int, password string) error {
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+	if err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	user, ok := r.users[id]
+	if !ok {
+		return sql.ErrNoRows
+	}
+
+	user.Password = string(hashedPassword)
+	r.users[id] = user
+
+	return nil
+}
+
+// sortUsers sorts users by last name, then first name, then ID
+func sortUsers(users []*User) {
+	sort.Slice(users, func(i, j int) bool {
+		a, b := users[i], users[j]
+		if a.LastName != b.LastName {
+			return a.LastName < b.LastName
+		}
+		if a.FirstName != b.FirstName {
+			return a.FirstName < b.FirstName
+		}
+		return a.ID < b.ID
+	})
+}
+
+// emailTaken reports whether a user other than exceptID has the email, ignoring
+// case, as the unique index does in Postgres. r.mu must be held.
+func (r *MemoryUserRepository) emailTaken(email string, exceptID int) bool {
+	for id, user := range r.users {
+		if id != exceptID && strings.EqualFold(user.Email, email) {
+			return true
+		}
+	}
+	return false
+}
+
+// withPlan sets the user's plan from r.Plans
+func (r *MemoryUserRepository) withPlan(user *User) *User {
+	if r.Plans != nil {
+		user.Plan = r.Plans.planFor(user.ID)
+	}
+	return user
+}
+
+// MemoryInvoiceRepository is an InvoiceRepository that keeps everything in memory
+type MemoryInvoiceRepository struct {
+	mu       sync.Mutex
+	invoices map[int]Invoice
+	nextID   int
+}
+
+// NewMemoryInvoiceRepository returns an empty MemoryInvoiceRepository
+func NewMemoryInvoiceRepository() *MemoryInvoiceRepository {
+	return &MemoryInvoiceRepository{invoices: make(map[int]Invoice)}
+}
+
+// hasUser reports whether any invoice belongs to the user
+func (r *MemoryInvoiceRepository) hasUser(userID int) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, invoice := range r.invoices {
+		if invoice.UserID == userID {
+			return true
+		}
+	}
+	return false
+}
+
+// Insert adds an invoice, assigning it the next invoice number, and returns its new ID
+func (r *MemoryInvoiceRepository) Insert(_ context.Context, invoice Invoice) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.nextID++
+	invoice.ID = r.nextID
+	invoice.InvoiceNumber = fmt.Sprintf("INV-%06d", invoice.ID)
+	if invoice.IssuedAt.IsZero() {
+		invoice.IssuedAt = time.Now()
+	}
+	invoice.CreatedAt = time.Now()
+	invoice.UpdatedAt = time.Now()
+	invoice.User = nil
+	invoice.Plan = nil
+	r.invoices[invoice.ID] = invoice
+
+	return invoice.ID, nil
+}
+
+// GetOne returns one invoice by id, or sql.ErrNoRows
+func (r *MemoryInvoiceRepository) GetOne(_ context.Context, id int) (*Invoice, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	invoice, ok := r.invoices[id]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+
+	return &invoice, nil
+}
+
+// GetAllForUser returns all invoices issued to a user, newest first
+func (r *MemoryInvoiceRepository) GetAllForUser(_ context.Context, userID int) ([]*Invoice, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var invoices []*Invoice
+	for _, invoice := range r.invoices {
+		if invoice.UserID == userID {
+			invoice := invoice
+			invoices = append(invoices, &invoice)
+		}
+	}
+
+	sort.Slice(invoices, func(i, j int) bool {
+		if !invoices[i].IssuedAt.Equal(invoices[j].IssuedAt) {
+			return invoices[i].IssuedAt.After(invoices[j].IssuedAt)
+		}
+		return invoices[i].ID > invoices[j].ID
+	})
+
+	return invoices, nil
+}
+
+// MemoryOutboxRepository is an OutboxRepository that keeps everything in memory.
+// Claims are made under one lock, so concurrent workers never share a message.
+type MemoryOutboxRepository struct {
+	mu          sync.Mutex
+	messages    map[int]*OutboxMessage
+	lockedUntil map[int]time.Time
+	nextID      int
+}
+
+// NewMemoryOutboxRepository returns an empty MemoryOutboxRepository
+func NewMemoryOutboxRepository() *MemoryOutboxRepository {
+	return &MemoryOutboxRepository{
+		messages:    make(map[int]*OutboxMessage),
+		lockedUntil: make(map[int]time.Time),
+	}
+}
+
+// Enqueue stores a new message, ready to send immediately, and returns its ID
+func (r *MemoryOutboxRepository) Enqueue(_ context.Context, payload []byte, maxAttempts int) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	r.nextID++
+	r.messages[r.nextID] = &OutboxMessage{
+		ID:            r.nextID,
+		Payload:       payload,
+		Status:        OutboxPending,
+		MaxAttempts:   maxAttempts,
+		NextAttemptAt: now,
+		CreatedAt:     now,
+		UpdatedAt:     now,
+	}
+
+	return r.nextID, nil
+}
+
+// ClaimNext leases the oldest due message to the caller, as the Postgres
+// repository does. Returns sql.ErrNoRows when nothing is due.
+func (r *MemoryOutboxRepository) ClaimNext(_ context.Context, lease time.Duration) (*OutboxMessage, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+
+	var next *OutboxMessage
+	for _, msg := range r.messages {
+		due := (msg.Status == OutboxPending && !msg.NextAttemptAt.After(now)) ||
+			(msg.Status == OutboxSending && !r.lockedUntil[msg.ID].After(now))
+		if !due {
+			continue
+		}
+		if next == nil || msg.NextAttemptAt.Before(next.NextAttemptAt) ||
+			(msg.NextAttemptAt.Equal(next.NextAttemptAt) && msg.ID < next.ID) {
+			next = msg
+		}
+	}
+
+	if next == nil {
+		return nil, sql.ErrNoRows
+	}
+
+	next.Status = OutboxSending
+	next.Attempts++
+	next.UpdatedAt = now
+	r.lockedUntil[next.ID] = now.Add(lease)
+
+	msg := *next
+	return &msg, nil
+}
+
+// MarkSent records that a message was delivered
+func (r *MemoryOutboxRepository) MarkSent(_ context.Context, id int) error {
+	return r.update(id, func(msg *OutboxMessage) {
+		msg.Status = OutboxSent
+	})
+}
+
+// MarkFailed records a failed delivery and schedules the message to be retried at retryAt
+func (r *MemoryOutboxRepository) MarkFailed(_ context.Context, id int, lastError string, retryAt time.Time) error {
+	return r.update(id, func(msg *OutboxMessage) {
+		msg.Status = OutboxPending
+		msg.NextAttemptAt = retryAt
+		msg.LastError = lastError
+	})
+}
+
+// MarkDead moves a message to the dead letter state
+func (r *MemoryOutboxRepository) MarkDead(_ context.Context, id int, lastError string) error {
+	return r.update(id, func(msg *OutboxMessage) {
+		msg.Status = OutboxDead
+		msg.LastError = lastError
+	})
+}
+
+// Postpone hands a claimed message back without counting the attempt
+func (r *MemoryOutboxRepository) Postpone(_ context.Context, id int, at time.Time) error {
+	return r.update(id, func(msg *OutboxMessage) {
+		msg.Status = OutboxPending
+		if msg.Attempts > 0 {
+			msg.Attempts--
+		}
+		msg.NextAttemptAt = at
+	})
+}
+
+// CountUnsent returns the number of messages waiting to be sent or being sent, up to limit
+func (r *MemoryOutboxRepository) CountUnsent(_ context.Context, limit int) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	count := 0
+	for _, msg := range r.messages {
+		if count < limit && (msg.Status == OutboxPending || msg.Status == OutboxSending) {
+			count++
+		}
+	}
+
+	return count, nil
+}
+
+// CountByStatus returns how many messages are pending, being sent and dead
+func (r *MemoryOutboxRepository) CountByStatus(_ context.Context) (map[string]int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	counts := make(map[string]int)
+	for _, msg := range r.messages {
+		if msg.Status != OutboxSent {
+			counts[msg.Status]++
+		}
+	}
+
+	return counts, nil
+}
+
+// Messages returns a copy of every message in the outbox, ordered by ID
+func (r *MemoryOutboxRepository) Messages() []OutboxMessage {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	messages := make([]OutboxMessage, 0, len(r.messages))
+	for _, msg := range r.messages {
+		messages = append(messages, *msg)
+	}
+
+	sort.Slice(messages, func(i, j int) bool { return messages[i].ID < messages[j].ID })
+
+	return messages
+}
+
+// update applies fn to a message and releases its lease
+func (r *MemoryOutboxRepository) update(id int, fn func(msg *OutboxMessage)) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	msg, ok := r.messages[id]
+	if !ok {
+		return sql.ErrNoRows
+	}
+
+	fn(msg)
+	msg.UpdatedAt = time.Now()
+	delete(r.lockedUntil, id)
+
+	return nil
+}
+
+// MemoryPasswordResetRepository is a PasswordResetRepository that keeps
+// everything in memory. Redeem sets passwords in Users.
+type MemoryPasswordResetRepository struct {
+	mu     sync.Mutex
+	resets map[string]PasswordReset // by token hash
+	nextID int
+
+	Users *MemoryUserRepository
+}
+
+// NewMemoryPasswordResetRepository returns an empty MemoryPasswordResetRepository
+// that sets passwords in users
+func NewMemoryPasswordResetRepository(users *MemoryUserRepository) *MemoryPasswordResetRepository {
+	return &MemoryPasswordResetRepository{
+		resets: make(map[string]PasswordReset),
+		Users:  users,
+	}
+}
+
+// New creates a reset token for the user that expires after ttl. Any earlier
+// unused tokens for the user stop working.
+func (r *MemoryPasswordResetRepository) New(_ context.Context, userID int, ttl time.Duration) (string, error) {
+	token, err := newResetToken()
+	if err != nil {
+		return "", err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	for hash, reset := range r.resets {
+		if reset.UserID == userID && reset.UsedAt == nil {
+			reset.UsedAt = &now
+			r.resets[hash] = reset
+		}
+	}
+
+	r.nextID++
+	r.resets[HashToken(token)] = PasswordReset{
+		ID:        r.nextID,
+		UserID:    userID,
+		TokenHash: HashToken(token),
+		ExpiresAt: now.Add(ttl),
+		CreatedAt: now,
+	}
+
+	return token, nil
+}
+
+// GetValid returns the reset for a token that is unused and unexpired, or sql.ErrNoRows
+func (r *MemoryPasswordResetRepository) GetValid(_ context.Context, token string) (*PasswordReset, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	reset, ok := r.resets[HashToken(token)]
+	if !ok || reset.UsedAt != nil || !reset.ExpiresAt.After(time.Now()) {
+		return nil, sql.ErrNoRows
+	}
+
+	return &reset, nil
+}
+
+// Redeem uses up a valid token and sets the password of the user it belongs to.
+// Returns sql.ErrNoRows for an invalid, expired or already used token.
+func (r *MemoryPasswordResetRepository) Redeem(_ context.Context, token, password string) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	hash := HashToken(token)
+	reset, ok := r.resets[hash]
+	if !ok || reset.UsedAt != nil || !reset.ExpiresAt.After(time.Now()) {
+		return 0, sql.ErrNoRows
+	}
+
+	if err := r.Users.setPassword(reset.UserID, password); err != nil {
+		return 0, err
+	}
+
+	now := time.Now()
+	reset.UsedAt = &now
+	r.resets[hash] = reset
+
+	return reset.UserID, nil
+}
+
+// MemoryTwoFactorRepository is a TwoFactorRepository that keeps everything in
+// memory. Every user starts with two-factor authentication disabled.
+type MemoryTwoFactorRepository struct {
+	mu       sync.Mutex
+	settings map[int]TwoFactor
+	codes    map[int]map[string]bool // user id to code hash to whether it was used
+}
+
+// NewMemoryTwoFactorRepository returns an empty MemoryTwoFactorRepository
+func NewMemoryTwoFactorRepository() *MemoryTwoFactorRepository {
+	return &MemoryTwoFactorRepository{
+		settings: make(map[int]TwoFactor),
+		codes:    make(map[int]map[string]bool),
+	}
+}
+
+// Get returns the two-factor settings for a user
+func (r *MemoryTwoFactorRepository) Get(_ context.Context, userID int) (*TwoFactor, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	tf := r.settings[userID]
+	tf.UserID = userID
+
+	return &tf, nil
+}
+
+// Enable turns two-factor authentication on for a user with the given secret,
+// marks step used and returns a fresh set of recovery codes
+func (r *MemoryTwoFactorRepository) Enable(_ context.Context, userID int, secret string, step int64) ([]string, error) {
+	codes, err := newRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.settings[userID] = TwoFactor{UserID: userID, Secret: secret, Enabled: 1, LastStep: step}
+	r.setRecoveryCodes(userID, codes)
+
+	return codes, nil
+}
+
+// Disable turns two-factor authentication off for a user and throws away their secret and recovery codes
+func (r *MemoryTwoFactorRepository) Disable(_ context.Context, userID int) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	delete(r.settings, userID)
+	delete(r.codes, userID)
+
+	return nil
+}
+
+// UseStep records that the code for a TOTP time step has been used. It returns
+// false if that step, or a later one, was already used.
+func (r *MemoryTwoFactorRepository) UseStep(_ context.Context, userID int, step int64) (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	tf := r.settings[userID]
+	if tf.LastStep >= step {
+		return false, nil
+	}
+
+	tf.UserID = userID
+	tf.LastStep = step
+	r.settings[userID] = tf
+
+	return true, nil
+}
+
+// NewRecoveryCodes replaces a user's recovery codes with a fresh set and returns them
+func (r *MemoryTwoFactorRepository) NewRecoveryCodes(_ context.Context, userID int) ([]string, error) {
+	codes, err := newRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.setRecoveryCodes(userID, codes)
+
+	return codes, nil
+}
+
+// setRecoveryCodes replaces a user's recovery codes with codes. r.mu must be held.
+func (r *MemoryTwoFactorRepository) setRecoveryCodes(userID int, codes []string) {
+	r.codes[userID] = make(map[string]bool, len(codes))
+	for _, code := range codes {
+		r.codes[userID][HashToken(code)] = false
+	}
+}
+
+// UseRecoveryCode uses up one of the user's recovery codes. It returns false if
+// the code doesn't belong to the user or was already used.
+func (r *MemoryTwoFactorRepository) UseRecoveryCode(_ context.Context, userID int, code string) (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	hash := HashToken(normalizeRecoveryCode(code))
+	used, ok := r.codes[userID][hash]
+	if !ok || used {
+		return false, nil
+	}
+
+	r.codes[userID][hash] = true
+
+	return true, nil
+}
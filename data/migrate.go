@@ -0,0 +1,323 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+)
+
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// migrationLockID is the key of the Postgres advisory lock held while
+// migrating, so only one instance changes the schema at a time. The number
+// itself is arbitrary; it only has to be the same everywhere.
+const migrationLockID = 7261536
+
+// migrationName matches files such as 0001_initial_schema.up.sql
+var migrationName = regexp.MustCompile(`^(\d+)_(\w+)\.(up|down)\.sql$`)
+
+// Migration is one numbered schema change, with the SQL that applies it and
+// the SQL that reverts it
+type Migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+// MigrationStatus describes one migration and whether it has been applied
+type MigrationStatus struct {
+	Migration
+	AppliedAt *time.Time
+}
+
+// Migrations returns every embedded migration, ordered by version. Every
+// migration must have both an up and a down file.
+func Migrations() ([]Migration, error) {
+	return loadMigrations(migrationFiles)
+}
+
+// loadMigrations reads the migrations in the migrations directory of fsys
+func loadMigrations(fsys fs.FS) ([]Migration, error) {
+	entries, err := fs.ReadDir(fsys, "migrations")
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := make(map[int]*Migration)
+	for _, entry := range entries {
+		m := migrationName.FindStringSubmatch(entry.Name())
+		if m == nil {
+			return nil, fmt.Errorf("migration %s: name must look like 0001_description.up.sql", entry.Name())
+		}
+
+		version, _ := strconv.Atoi(m[1])
+		body, err := fs.ReadFile(fsys, path.Join("migrations", entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+
+		mig, ok := byVersion[version]
+		if !ok {
+			mig = &Migration{Version: version, Name: m[2]}
+			byVersion[version] = mig
+		}
+		if mig.Name != m[2] {
+			return nil, fmt.Errorf("migration %d has two names: %s and %s", version, mig.Name, m[2])
+		}
+
+		if m[3] == "up" {
+			mig.Up = string(body)
+		} else {
+			mig.Down = string(body)
+		}
+	}
+
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, mig := range byVersion {
+		if mig.Up == "" || mig.Down == "" {
+			return nil, fmt.Errorf("migration %04d_%s needs both an up and a down file", mig.Version, mig.Name)
+		}
+		migrations = append(migrations, *mig)
+	}
+
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+
+	return migrations, nil
+}
+
+// MigrateUp applies every migration that hasn't been applied yet, in order, and
+// returns the ones it applied. Each migration runs in its own transaction.
+func MigrateUp(ctx context.Context, conn *sql.DB) ([]Migration, error) {
+	migrations, err := Migrations()
+	if err != nil {
+		return nil, err
+	}
+
+	var done []Migration
+	err = withMigrationLock(ctx, conn, func(c *sql.Conn) error {
+		applied, err := appliedMigrations(ctx, c)
+		if err != nil {
+			return err
+		}
+
+		for _, mig := range migrations {
+			if _, ok := applied[mig.Version]; ok {
+				continue
+			}
+
+			err := runMigration(ctx, c, mig.Up,
+				`insert into schema_migrations (version, name, applied_at) values ($1, $2, $3)`,
+				mig.Version, mig.Name, time.Now())
+			if err != nil {
+				return fmt.Errorf("migration %04d_%s: %w", mig.Version, mig.Name, err)
+			}
+
+			done = append(done, mig)
+		}
+
+		return nil
+	})
+
+	return done, err
+}
+
+// MigrateDown reverts the n most recently applied migrations, newest first,
+// and returns the ones it reverted
+func MigrateDown(ctx context.Context, conn *sql.DB, n int) ([]Migration, error) {
+	if n < 1 {
+		return nil, errors.New("number of migrations to revert must be at least 1")
+	}
+
+	migrations, err := Migrations()
+	if err != nil {
+		return nil, err
+	}
+
+	var done []Migration
+	err = withMigrationLock(ctx, conn, func(c *sql.Conn) error {
+		applied, err := appliedMigrations(ctx, c)
+		if err != nil {
+			return err
+		}
+
+		for i := len(migrations) - 1; i >= 0 && len(done) < n; i-- {
+			mig := migrations[i]
+			if _, ok := applied[mig.Version]; !ok {
+				continue
+			}
+
+			err := runMigration(ctx, c, mig.Down,
+				`delete from schema_migrations where version = $1`, mig.Version)
+			if err != nil {
+				return fmt.Errorf("migration %04d_%s: %w", mig.Version, mig.Name, err)
+			}
+
+			done = append(done, mig)
+		}
+
+		return nil
+	})
+
+	return done, err
+}
+
+// MigrateBaseline records every migration up to and including version as
+// applied, without running it, and returns the ones it recorded. It is for
+// databases created before migrations existed, whose schema is already at
+// that version.
+func MigrateBaseline(ctx context.Context, conn *sql.DB, version int) ([]Migration, error) {
+	migrations, err := Migrations()
+	if err != nil {
+		return nil, err
+	}
+
+	known := false
+	for _, mig := range migrations {
+		known = known || mig.Version == version
+	}
+	if !known {
+		return nil, fmt.Errorf("no migration has version %d", version)
+	}
+
+	var done []Migration
+	err = withMigrationLock(ctx, conn, func(c *sql.Conn) error {
+		applied, err := appliedMigrations(ctx, c)
+		if err != nil {
+			return err
+		}
+
+		for _, mig := range migrations {
+			if _, ok := applied[mig.Version]; ok || mig.Version > version {
+				continue
+			}
+
+			_, err := c.ExecContext(ctx,
+				`insert into schema_migrations (version, name, applied_at) values ($1, $2, $3)`,
+				mig.Version, mig.Name, time.Now())
+			if err != nil {
+				return fmt.Errorf("migration %04d_%s: %w", mig.Version, mig.Name, err)
+			}
+
+			done = append(done, mig)
+		}
+
+		return nil
+	})
+
+	return done, err
+}
+
+// GetMigrationStatus lists every embedded migration and when, if ever, it was applied
+func GetMigrationStatus(ctx context.Context, conn *sql.DB) ([]MigrationStatus, error) {
+	migrations, err := Migrations()
+	if err != nil {
+		return nil, err
+	}
+
+	var status []MigrationStatus
+	err = withMigrationLock(ctx, conn, func(c *sql.Conn) error {
+		applied, err := appliedMigrations(ctx, c)
+		if err != nil {
+			return err
+		}
+
+		for _, mig := range migrations {
+			s := MigrationStatus{Migration: mig}
+			if at, ok := applied[mig.Version]; ok {
+				s.AppliedAt = &at
+			}
+			status = append(status, s)
+		}
+
+		return nil
+	})
+
+	return status, err
+}
+
+// withMigrationLock runs fn on a single connection while holding the
+// migration advisory lock, creating the schema_migrations table if needed.
+// Advisory locks belong to a session, so everything must use the same connection.
+func withMigrationLock(ctx context.Context, conn *sql.DB, fn func(c *sql.Conn) error) error {
+	c, err := conn.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	_, err = c.ExecContext(ctx, `select pg_advisory_lock($1)`, migrationLockID)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		// use a fresh context so the lock is released even if ctx was cancelled
+		unlockCtx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+		defer cancel()
+		_, _ = c.ExecContext(unlockCtx, `select pg_advisory_unlock($1)`, migrationLockID)
+	}()
+
+	stmt := `create table if not exists schema_migrations (
+		version integer primary key,
+		name character varying(255) not null,
+		applied_at timestamp without time zone not null
+	)`
+	_, err = c.ExecContext(ctx, stmt)
+	if err != nil {
+		return err
+	}
+
+	return fn(c)
+}
+
+// appliedMigrations returns when each applied migration was applied, by version
+func appliedMigrations(ctx context.Context, c *sql.Conn) (map[int]time.Time, error) {
+	rows, err := c.QueryContext(ctx, `select version, applied_at from schema_migrations`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	applied := make(map[int]time.Time)
+	for rows.Next() {
+		var version int
+		var at time.Time
+		if err := rows.Scan(&version, &at); err != nil {
+			return nil, err
+		}
+		applied[version] = at
+	}
+
+	return applied, rows.Err()
+}
+
+// runMigration runs a migration's SQL and the statement that records it in
+// schema_migrations in one transaction, so a failed migration leaves no trace
+func runMigration(ctx context.Context, c *sql.Conn, script, record string, args ...any) error {
+	tx, err := c.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	if _, err := tx.ExecContext(ctx, script); err != nil {
+		return err
+	}
+
+	if _, err := tx.ExecContext(ctx, record, args...); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
@@ -0,0 +1,252 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	_ "github.com/jackc/pgx/v5/stdlib"
+)
+
+func TestMigrations(t *testing.T) {
+	migrations, err := Migrations()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// versions run from 1 with no gaps, so a missing file is noticed
+	for i, mig := range migrations {
+		if mig.Version != i+1 {
+			t.Fatalf("migration %d has version %d, want %d", i, mig.Version, i+1)
+		}
+		if strings.TrimSpace(mig.Up) == "" || strings.TrimSpace(mig.Down) == "" {
+			t.Errorf("migration %04d_%s has an empty up or down file", mig.Version, mig.Name)
+		}
+	}
+}
+
+func TestLoadMigrations(t *testing.T) {
+	file := func(body string) *fstest.MapFile { return &fstest.MapFile{Data: []byte(body)} }
+
+	tests := []struct {
+		name     string
+		files    fstest.MapFS
+		versions []int
+		wantErr  string
+	}{
+		{
+			name: "ordered by number, not name",
+			files: fstest.MapFS{
+				"migrations/0010_ten.up.sql":   file("up 10"),
+				"migrations/0010_ten.down.sql": file("down 10"),
+				"migrations/2_two.up.sql":      file("up 2"),
+				"migrations/2_two.down.sql":    file("down 2"),
+				"migrations/0001_one.up.sql":   file("up 1"),
+				"migrations/0001_one.down.sql": file("down 1"),
+			},
+			versions: []int{1, 2, 10},
+		},
+		{
+			name: "missing down",
+			files: fstest.MapFS{
+				"migrations/0001_one.up.sql": file("up 1"),
+			},
+			wantErr: "needs both an up and a down file",
+		},
+		{
+			name: "two names for one version",
+			files: fstest.MapFS{
+				"migrations/0001_one.up.sql":   file("up 1"),
+				"migrations/0001_uno.down.sql": file("down 1"),
+			},
+			wantErr: "has two names",
+		},
+		{
+			name: "badly named file",
+			files: fstest.MapFS{
+				"migrations/one.sql": file("up 1"),
+			},
+			wantErr: "name must look like",
+		},
+		{
+			name:  "no migrations",
+			files: fstest.MapFS{"migrations": &fstest.MapFile{Mode: os.ModeDir}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			migrations, err := loadMigrations(tt.files)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("got %v, want an error saying %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var versions []int
+			for _, mig := range migrations {
+				versions = append(versions, mig.Version)
+			}
+			if len(versions) != len(tt.versions) {
+				t.Fatalf("got versions %v, want %v", versions, tt.versions)
+			}
+			for i := range versions {
+				if versions[i] != tt.versions[i] {
+					t.Fatalf("got versions %v, want %v", versions, tt.versions)
+				}
+			}
+			for _, mig := range migrations {
+				if !strings.HasSuffix(mig.Up, "up "+strconv.Itoa(mig.Version)) || !strings.HasSuffix(mig.Down, "down "+strconv.Itoa(mig.Version)) {
+					t.Errorf("migration %d has up %q and down %q", mig.Version, mig.Up, mig.Down)
+				}
+			}
+		})
+	}
+}
+
+// TestMigratePostgres runs the migrations against the empty Postgres database
+// in TEST_DB_DSN, and reverts them all afterwards. It is skipped without one.
+func TestMigratePostgres(t *testing.T) {
+	dsn := os.Getenv("TEST_DB_DSN")
+	if dsn == "" {
+		t.Skip("TEST_DB_DSN is not set")
+	}
+
+	db, err := sql.Open("pgx", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	ctx := context.Background()
+	all, err := Migrations()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	status, err := GetMigrationStatus(ctx, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range status {
+		if s.AppliedAt != nil {
+			t.Fatal("TEST_DB_DSN must be an empty database, but it has migrations applied")
+		}
+	}
+	t.Cleanup(func() {
+		if _, err := MigrateDown(context.Background(), db, len(all)); err != nil {
+			t.Errorf("reverting every migration: %v", err)
+		}
+	})
+
+	t.Run("waits for the lock", func(t *testing.T) {
+		holder, err := db.Conn(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer holder.Close()
+
+		if _, err := holder.ExecContext(ctx, `select pg_advisory_lock($1)`, migrationLockID); err != nil {
+			t.Fatal(err)
+		}
+
+		waitCtx, cancel := context.WithTimeout(ctx, 200*time.Millisecond)
+		defer cancel()
+		if _, err := MigrateUp(waitCtx, db); err == nil {
+			t.Fatal("migrated while another session held the lock")
+		}
+
+		if _, err := holder.ExecContext(ctx, `select pg_advisory_unlock($1)`, migrationLockID); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("concurrent up applies each migration once", func(t *testing.T) {
+		var mu sync.Mutex
+		applied := make(map[int]int)
+
+		var wg sync.WaitGroup
+		for i := 0; i < 3; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+
+				done, err := MigrateUp(ctx, db)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+
+				mu.Lock()
+				defer mu.Unlock()
+				for _, mig := range done {
+					applied[mig.Version]++
+				}
+			}()
+		}
+		wg.Wait()
+
+		for _, mig := range all {
+			if n := applied[mig.Version]; n != 1 {
+				t.Errorf("migration %04d_%s applied %d times, want once", mig.Version, mig.Name, n)
+			}
+		}
+	})
+
+	t.Run("up again does nothing", func(t *testing.T) {
+		done, err := MigrateUp(ctx, db)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(done) != 0 {
+			t.Errorf("applied %d migrations again", len(done))
+		}
+	})
+
+	t.Run("down reverts the newest first", func(t *testing.T) {
+		done, err := MigrateDown(ctx, db, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(done) != 2 || done[0].Version != all[len(all)-1].Version || done[1].Version != all[len(all)-2].Version {
+			t.Fatalf("reverted %v, want the last two, newest first", done)
+		}
+
+		status, err := GetMigrationStatus(ctx, db)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, s := range status {
+			if want := i < len(all)-2; (s.AppliedAt != nil) != want {
+				t.Errorf("migration %04d_%s applied = %v, want %v", s.Version, s.Name, s.AppliedAt != nil, want)
+			}
+		}
+
+		done, err = MigrateUp(ctx, db)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(done) != 2 {
+			t.Errorf("applied %d migrations, want the 2 that were reverted", len(done))
+		}
+	})
+
+	t.Run("bad arguments", func(t *testing.T) {
+		if _, err := MigrateDown(ctx, db, 0); err == nil {
+			t.Error("down 0: got no error")
+		}
+		if _, err := MigrateBaseline(ctx, db, len(all)+1); err == nil {
+			t.Error("baseline to an unknown version: got no error")
+		}
+	})
+}
@@ -0,0 +1,7 @@
+DROP TABLE IF EXISTS public.user_plans;
+
+DROP TABLE IF EXISTS public.users;
+
+DROP TABLE IF EXISTS public.plans;
+
+DROP SEQUENCE IF EXISTS public.user_id_seq;
@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS public.invoices;
+
+DROP SEQUENCE IF EXISTS public.invoice_id_seq;
@@ -0,0 +1,39 @@
+--
+-- Name: invoice_id_seq; Type: SEQUENCE; Schema: public; Owner: -
+--
+
+CREATE SEQUENCE public.invoice_id_seq
+    START WITH 1
+    INCREMENT BY 1
+    NO MINVALUE
+    NO MAXVALUE
+    CACHE 1;
+
+
+--
+-- Name: invoices; Type: TABLE; Schema: public; Owner: -
+--
+
+CREATE TABLE public.invoices (
+                                 id integer DEFAULT nextval('public.invoice_id_seq'::regclass) NOT NULL,
+                                 invoice_number character varying(32) NOT NULL,
+                                 user_id integer NOT NULL,
+                                 plan_id integer NOT NULL,
+                                 amount integer NOT NULL,
+                                 tax integer NOT NULL DEFAULT 0,
+                                 issued_at timestamp without time zone NOT NULL,
+                                 created_at timestamp without time zone,
+                                 updated_at timestamp without time zone
+);
+
+ALTER TABLE ONLY public.invoices
+    ADD CONSTRAINT invoices_pkey PRIMARY KEY (id);
+
+ALTER TABLE ONLY public.invoices
+    ADD CONSTRAINT invoices_invoice_number_key UNIQUE (invoice_number);
+
+ALTER TABLE ONLY public.invoices
+    ADD CONSTRAINT invoices_user_id_fkey FOREIGN KEY (user_id) REFERENCES public.users(id) ON UPDATE RESTRICT ON DELETE CASCADE;
+
+ALTER TABLE ONLY public.invoices
+    ADD CONSTRAINT invoices_plan_id_fkey FOREIGN KEY (plan_id) REFERENCES public.plans(id) ON UPDATE RESTRICT ON DELETE RESTRICT;
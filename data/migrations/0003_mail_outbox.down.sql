@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS public.mail_outbox;
+
+DROP SEQUENCE IF EXISTS public.mail_outbox_id_seq;
@@ -0,0 +1,34 @@
+--
+-- Name: mail_outbox_id_seq; Type: SEQUENCE; Schema: public; Owner: -
+--
+
+CREATE SEQUENCE public.mail_outbox_id_seq
+    START WITH 1
+    INCREMENT BY 1
+    NO MINVALUE
+    NO MAXVALUE
+    CACHE 1;
+
+
+--
+-- Name: mail_outbox; Type: TABLE; Schema: public; Owner: -
+--
+
+CREATE TABLE public.mail_outbox (
+                                    id integer DEFAULT nextval('public.mail_outbox_id_seq'::regclass) NOT NULL,
+                                    payload jsonb NOT NULL,
+                                    status character varying(16) NOT NULL DEFAULT 'pending',
+                                    attempts integer NOT NULL DEFAULT 0,
+                                    max_attempts integer NOT NULL DEFAULT 5,
+                                    next_attempt_at timestamp without time zone NOT NULL,
+                                    locked_until timestamp without time zone,
+                                    last_error text,
+                                    sent_at timestamp without time zone,
+                                    created_at timestamp without time zone,
+                                    updated_at timestamp without time zone
+);
+
+ALTER TABLE ONLY public.mail_outbox
+    ADD CONSTRAINT mail_outbox_pkey PRIMARY KEY (id);
+
+CREATE INDEX mail_outbox_due_idx ON public.mail_outbox USING btree (status, next_attempt_at);
@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS public.password_resets;
+
+DROP SEQUENCE IF EXISTS public.password_resets_id_seq;
@@ -0,0 +1,8 @@
+DROP TABLE IF EXISTS public.user_recovery_codes;
+
+DROP SEQUENCE IF EXISTS public.user_recovery_codes_id_seq;
+
+ALTER TABLE public.users
+    DROP COLUMN IF EXISTS totp_secret,
+    DROP COLUMN IF EXISTS totp_enabled,
+    DROP COLUMN IF EXISTS totp_last_step;
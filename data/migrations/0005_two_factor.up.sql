@@ -0,0 +1,39 @@
+--
+-- Name: users two factor columns; Type: TABLE; Schema: public; Owner: -
+--
+
+ALTER TABLE public.users
+    ADD COLUMN totp_secret text,
+    ADD COLUMN totp_enabled integer DEFAULT 0 NOT NULL,
+    ADD COLUMN totp_last_step bigint DEFAULT 0 NOT NULL;
+
+
+--
+-- Name: user_recovery_codes_id_seq; Type: SEQUENCE; Schema: public; Owner: -
+--
+
+CREATE SEQUENCE public.user_recovery_codes_id_seq
+    START WITH 1
+    INCREMENT BY 1
+    NO MINVALUE
+    NO MAXVALUE
+    CACHE 1;
+
+
+--
+-- Name: user_recovery_codes; Type: TABLE; Schema: public; Owner: -
+--
+
+CREATE TABLE public.user_recovery_codes (
+                                            id integer DEFAULT nextval('public.user_recovery_codes_id_seq'::regclass) NOT NULL,
+                                            user_id integer NOT NULL,
+                                            code_hash character(64) NOT NULL,
+                                            used_at timestamp without time zone,
+                                            created_at timestamp without time zone
+);
+
+ALTER TABLE ONLY public.user_recovery_codes
+    ADD CONSTRAINT user_recovery_codes_pkey PRIMARY KEY (id);
+
+ALTER TABLE ONLY public.user_recovery_codes
+    ADD CONSTRAINT user_recovery_codes_user_id_fkey FOREIGN KEY (user_id) REFERENCES public.users(id) ON UPDATE RESTRICT ON DELETE CASCADE;
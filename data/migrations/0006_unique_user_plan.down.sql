@@ -0,0 +1,2 @@
+ALTER TABLE ONLY public.user_plans
+    DROP CONSTRAINT IF EXISTS user_plans_user_id_key;
@@ -0,0 +1,13 @@
+--
+-- A user has at most one plan. Keep only the newest row for anyone who
+-- ended up with more than one before the constraint existed.
+--
+
+DELETE FROM public.user_plans a
+    USING public.user_plans b
+    WHERE a.user_id = b.user_id
+      AND a.id < b.id;
+
+
+ALTER TABLE ONLY public.user_plans
+    ADD CONSTRAINT user_plans_user_id_key UNIQUE (user_id);
@@ -0,0 +1,8 @@
+--
+-- Email addresses are unique, ignoring case. This fails if two accounts
+-- already share an address; merge or rename them first.
+--
+
+UPDATE public.users SET email = lower(trim(email));
+
+CREATE UNIQUE INDEX users_email_lower_key ON public.users USING btree (lower(email));
@@ -0,0 +1,10 @@
+--
+-- Name: users disabled_at; Type: TABLE; Schema: public; Owner: -
+--
+-- An account an administrator has deactivated is disabled, which isn't the
+-- same as one whose email hasn't been confirmed yet: the activation link
+-- only works for the second. Accounts that are inactive before this runs
+-- can't be told apart, so they are left as unconfirmed.
+--
+
+ALTER TABLE public.users ADD COLUMN disabled_at timestamp without time zone;
@@ -0,0 +1,5 @@
+ALTER TABLE ONLY public.invoices
+    DROP CONSTRAINT invoices_user_id_fkey;
+
+ALTER TABLE ONLY public.invoices
+    ADD CONSTRAINT invoices_user_id_fkey FOREIGN KEY (user_id) REFERENCES public.users(id) ON UPDATE RESTRICT ON DELETE CASCADE;
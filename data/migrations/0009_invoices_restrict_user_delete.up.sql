@@ -0,0 +1,12 @@
+--
+-- Name: invoices invoices_user_id_fkey; Type: FK CONSTRAINT; Schema: public; Owner: -
+--
+-- Invoices are financial records, so deleting a user must not take their
+-- invoices with it. A user who has been invoiced can only be deactivated.
+--
+
+ALTER TABLE ONLY public.invoices
+    DROP CONSTRAINT invoices_user_id_fkey;
+
+ALTER TABLE ONLY public.invoices
+    ADD CONSTRAINT invoices_user_id_fkey FOREIGN KEY (user_id) REFERENCES public.users(id) ON UPDATE RESTRICT ON DELETE RESTRICT;
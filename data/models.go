@@ -1,29 +1,75 @@
 package data
 
 import (
+	"context"
 	"database/sql"
+	"fmt"
 	"time"
 )
 
+// dbTimeout is the default upper bound on how long any one model method may
+// spend in the database, used when a repository has no Timeout of its own
 const dbTimeout = time.Second * 3
 
-var db *sql.DB
-
 // New is the function used to create an instance of the data package. It returns the type
-// Model, which embeds all the types we want to be available to our application.
-func New(dbPool *sql.DB) Models {
-	db = dbPool
-
+// Models, holding a Postgres backed repository for each of our models, all sharing dbPool.
+// timeout caps how long each model method may take, on top of the caller's context;
+// zero means dbTimeout.
+func New(dbPool *sql.DB, timeout time.Duration) Models {
 	return Models{
-		User: User{},
-		Plan: Plan{},
+		User:          &PostgresUserRepository{DB: dbPool, Timeout: timeout},
+		Plan:          &PostgresPlanRepository{DB: dbPool, Timeout: timeout},
+		Invoice:       &PostgresInvoiceRepository{DB: dbPool, Timeout: timeout},
+		Outbox:        &PostgresOutboxRepository{DB: dbPool, Timeout: timeout},
+		PasswordReset: &PostgresPasswordResetRepository{DB: dbPool, Timeout: timeout},
+		TwoFactor:     &PostgresTwoFactorRepository{DB: dbPool, Timeout: timeout},
 	}
 }
 
 // Models is the type for this package. Note that any model that is included as a member
 // in this type is available to us throughout the application, anywhere that the
 // app variable is used, provided that the model is also added in the New function.
+// Every member is an interface, so tests can swap in the in-memory repositories.
 type Models struct {
-	User User
-	Plan Plan
+	User          UserRepository
+	Plan          PlanRepository
+	Invoice       InvoiceRepository
+	Outbox        OutboxRepository
+	PasswordReset PasswordResetRepository
+	TwoFactor     TwoFactorRepository
+}
+
+// WithTx runs fn inside a database transaction. The transaction is committed if
+// fn returns nil, and rolled back if it returns an error or panics, so model
+// methods that run several statements either make all of their changes or none.
+func WithTx(ctx context.Context, db *sql.DB, fn func(tx *sql.Tx) error) (err error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		if p := recover(); p != nil {
+			_ = tx.Rollback()
+			panic(p)
+		}
+	}()
+
+	if err := fn(tx); err != nil {
+		if rbErr := tx.Rollback(); rbErr != nil {
+			return fmt.Errorf("%w (rollback failed: %v)", err, rbErr)
+		}
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// withTimeout returns a context that is cancelled when ctx is, or after timeout,
+// whichever comes first. A timeout of zero means dbTimeout.
+func withTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		timeout = dbTimeout
+	}
+	return context.WithTimeout(ctx, timeout)
 }
@@ -0,0 +1,224 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// Statuses a message in the mail outbox moves through. A message is pending until
+// a worker claims it, sending while the worker holds its lease, and then either
+// sent, back to pending for a retry, or dead once it has used up its attempts.
+const (
+	OutboxPending = "pending"
+	OutboxSending = "sending"
+	OutboxSent    = "sent"
+	OutboxDead    = "dead"
+)
+
+// OutboxMessage is the type for one email waiting in the durable mail outbox.
+// Payload holds the JSON encoded message; the data package doesn't need to know its shape.
+type OutboxMessage struct {
+	ID            int
+	Payload       []byte
+	Status        string
+	Attempts      int
+	MaxAttempts   int
+	NextAttemptAt time.Time
+	LastError     string
+	CreatedAt     time.Time
+	UpdatedAt     time.Time
+}
+
+// OutboxRepository is the durable queue that outgoing email is delivered from
+type OutboxRepository interface {
+	Enqueue(ctx context.Context, payload []byte, maxAttempts int) (int, error)
+	ClaimNext(ctx context.Context, lease time.Duration) (*OutboxMessage, error)
+	MarkSent(ctx context.Context, id int) error
+	MarkFailed(ctx context.Context, id int, lastError string, retryAt time.Time) error
+	MarkDead(ctx context.Context, id int, lastError string) error
+	Postpone(ctx context.Context, id int, at time.Time) error
+	CountUnsent(ctx context.Context, limit int) (int, error)
+	CountByStatus(ctx context.Context) (map[string]int, error)
+}
+
+// PostgresOutboxRepository is the Postgres backed outbox that queued email is delivered from
+type PostgresOutboxRepository struct {
+	DB      *sql.DB
+	Timeout time.Duration
+}
+
+// Enqueue stores a new message in the outbox, ready to send immediately, and
+// returns the ID of the newly inserted row
+func (r *PostgresOutboxRepository) Enqueue(ctx context.Context, payload []byte, maxAttempts int) (int, error) {
+	ctx, cancel := withTimeout(ctx, r.Timeout)
+	defer cancel()
+
+	var newID int
+	stmt := `insert into mail_outbox (payload, status, attempts, max_attempts, next_attempt_at, created_at, updated_at)
+		values ($1, $2, 0, $3, $4, $5, $6) returning id`
+
+	now := time.Now()
+	err := r.DB.QueryRowContext(ctx, stmt, payload, OutboxPending, maxAttempts, now, now, now).Scan(&newID)
+	if err != nil {
+		return 0, err
+	}
+
+	return newID, nil
+}
+
+// ClaimNext locks the oldest message that is due for sending, counts the attempt,
+// and leases it to the caller for the given duration. If the worker dies before
+// marking the message, it becomes claimable again once the lease runs out.
+// Rows locked by other workers are skipped, so any number of workers, in any
+// number of processes, can claim concurrently. Returns sql.ErrNoRows when nothing is due.
+func (r *PostgresOutboxRepository) ClaimNext(ctx context.Context, lease time.Duration) (*OutboxMessage, error) {
+	ctx, cancel := withTimeout(ctx, r.Timeout)
+	defer cancel()
+
+	query := `
+		update mail_outbox set
+			status = $1,
+			attempts = attempts + 1,
+			locked_until = $2,
+			updated_at = $3
+		where id = (
+			select id from mail_outbox
+			where (status = $4 and next_attempt_at <= $3)
+			   or (status = $1 and locked_until <= $3)
+			order by next_attempt_at
+			limit 1
+			for update skip locked
+		)
+		returning id, payload, status, attempts, max_attempts, next_attempt_at, coalesce(last_error, ''), created_at, updated_at`
+
+	now := time.Now()
+
+	var msg OutboxMessage
+	err := r.DB.QueryRowContext(ctx, query, OutboxSending, now.Add(lease), now, OutboxPending).Scan(
+		&msg.ID,
+		&msg.Payload,
+		&msg.Status,
+		&msg.Attempts,
+		&msg.MaxAttempts,
+		&msg.NextAttemptAt,
+		&msg.LastError,
+		&msg.CreatedAt,
+		&msg.UpdatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return &msg, nil
+}
+
+// MarkSent records that a message was delivered
+func (r *PostgresOutboxRepository) MarkSent(ctx context.Context, id int) error {
+	ctx, cancel := withTimeout(ctx, r.Timeout)
+	defer cancel()
+
+	stmt := `update mail_outbox set status = $1, locked_until = null, sent_at = $2, updated_at = $2 where id = $3`
+
+	_, err := r.DB.ExecContext(ctx, stmt, OutboxSent, time.Now(), id)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// MarkFailed records a failed delivery and schedules the message to be retried at retryAt
+func (r *PostgresOutboxRepository) MarkFailed(ctx context.Context, id int, lastError string, retryAt time.Time) error {
+	ctx, cancel := withTimeout(ctx, r.Timeout)
+	defer cancel()
+
+	stmt := `update mail_outbox set status = $1, locked_until = null, next_attempt_at = $2, last_error = $3, updated_at = $4
+		where id = $5`
+
+	_, err := r.DB.ExecContext(ctx, stmt, OutboxPending, retryAt, lastError, time.Now(), id)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// MarkDead moves a message to the dead letter state; it will not be retried again
+func (r *PostgresOutboxRepository) MarkDead(ctx context.Context, id int, lastError string) error {
+	ctx, cancel := withTimeout(ctx, r.Timeout)
+	defer cancel()
+
+	stmt := `update mail_outbox set status = $1, locked_until = null, last_error = $2, updated_at = $3 where id = $4`
+
+	_, err := r.DB.ExecContext(ctx, stmt, OutboxDead, lastError, time.Now(), id)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Postpone hands a claimed message back without counting the attempt, to be
+// picked up again at the given time
+func (r *PostgresOutboxRepository) Postpone(ctx context.Context, id int, at time.Time) error {
+	ctx, cancel := withTimeout(ctx, r.Timeout)
+	defer cancel()
+
+	stmt := `update mail_outbox set status = $1, locked_until = null, attempts = greatest(attempts - 1, 0),
+		next_attempt_at = $2, updated_at = $3 where id = $4`
+
+	_, err := r.DB.ExecContext(ctx, stmt, OutboxPending, at, time.Now(), id)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// CountUnsent returns the number of messages that are waiting to be sent or
+// being sent, counting no further than limit so the query stays cheap however
+// large the backlog grows
+func (r *PostgresOutboxRepository) CountUnsent(ctx context.Context, limit int) (int, error) {
+	ctx, cancel := withTimeout(ctx, r.Timeout)
+	defer cancel()
+
+	query := `select count(*) from (
+		select 1 from mail_outbox where status in ($1, $2) limit $3
+	) as unsent`
+
+	var count int
+	err := r.DB.QueryRowContext(ctx, query, OutboxPending, OutboxSending, limit).Scan(&count)
+	if err != nil {
+		return 0, err
+	}
+
+	return count, nil
+}
+
+// CountByStatus returns how many messages are pending, being sent and dead.
+// Sent messages aren't counted, since they only ever grow.
+func (r *PostgresOutboxRepository) CountByStatus(ctx context.Context) (map[string]int, error) {
+	ctx, cancel := withTimeout(ctx, r.Timeout)
+	defer cancel()
+
+	query := `select status, count(*) from mail_outbox where status in ($1, $2, $3) group by status`
+
+	rows, err := r.DB.QueryContext(ctx, query, OutboxPending, OutboxSending, OutboxDead)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	counts := make(map[string]int)
+	for rows.Next() {
+		var status string
+		var count int
+		if err := rows.Scan(&status, &count); err != nil {
+			return nil, err
+		}
+		counts[status] = count
+	}
+
+	return counts, rows.Err()
+}
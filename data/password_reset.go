@@ -0,0 +1,146 @@
+package data
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"time"
+)
+
+// PasswordReset is the type for a single-use password reset token. Only the
+// SHA-256 hash of the token is stored, so a leaked table can't be used to reset passwords.
+type PasswordReset struct {
+	ID        int
+	UserID    int
+	TokenHash string
+	ExpiresAt time.Time
+	UsedAt    *time.Time
+	CreatedAt time.Time
+}
+
+// PasswordResetRepository stores password reset tokens
+type PasswordResetRepository interface {
+	New(ctx context.Context, userID int, ttl time.Duration) (string, error)
+	GetValid(ctx context.Context, token string) (*PasswordReset, error)
+	Redeem(ctx context.Context, token, password string) (int, error)
+}
+
+// PostgresPasswordResetRepository stores password reset tokens in Postgres
+type PostgresPasswordResetRepository struct {
+	DB      *sql.DB
+	Timeout time.Duration
+}
+
+// New creates a reset token for the user that expires after ttl, and returns
+// the plain text token to put in the emailed link. Any earlier unused tokens
+// for the user stop working.
+func (r *PostgresPasswordResetRepository) New(ctx context.Context, userID int, ttl time.Duration) (string, error) {
+	ctx, cancel := withTimeout(ctx, r.Timeout)
+	defer cancel()
+
+	token, err := newResetToken()
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+
+	err = WithTx(ctx, r.DB, func(tx *sql.Tx) error {
+		stmt := `update password_resets set used_at = $1 where user_id = $2 and used_at is null`
+		_, err := tx.ExecContext(ctx, stmt, now, userID)
+		if err != nil {
+			return err
+		}
+
+		stmt = `insert into password_resets (user_id, token_hash, expires_at, created_at) values ($1, $2, $3, $4)`
+		_, err = tx.ExecContext(ctx, stmt, userID, HashToken(token), now.Add(ttl), now)
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return token, nil
+}
+
+// GetValid returns the reset for a token that is unused and unexpired, without using it up.
+// Returns sql.ErrNoRows for any other token.
+func (r *PostgresPasswordResetRepository) GetValid(ctx context.Context, token string) (*PasswordReset, error) {
+	ctx, cancel := withTimeout(ctx, r.Timeout)
+	defer cancel()
+
+	query := `select id, user_id, token_hash, expires_at, used_at, created_at
+		from password_resets where token_hash = $1 and used_at is null and expires_at > $2`
+
+	var reset PasswordReset
+	row := r.DB.QueryRowContext(ctx, query, HashToken(token), time.Now())
+
+	err := row.Scan(
+		&reset.ID,
+		&reset.UserID,
+		&reset.TokenHash,
+		&reset.ExpiresAt,
+		&reset.UsedAt,
+		&reset.CreatedAt,
+	)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &reset, nil
+}
+
+// Redeem uses up a valid token, sets the password of the user it belongs to
+// and returns the user's ID. Both happen in one transaction, so the token is
+// never used up without the password changing. Checking and marking the token
+// happen in one statement, so it can only ever be used once, even by
+// concurrent requests. Returns sql.ErrNoRows for an invalid, expired or
+// already used token.
+func (r *PostgresPasswordResetRepository) Redeem(ctx context.Context, token, password string) (int, error) {
+	ctx, cancel := withTimeout(ctx, r.Timeout)
+	defer cancel()
+
+	// hash before the transaction starts, as bcrypt is slow on purpose
+	hashedPassword, err := hashPassword(password)
+	if err != nil {
+		return 0, err
+	}
+
+	var userID int
+	err = WithTx(ctx, r.DB, func(tx *sql.Tx) error {
+		stmt := `update password_resets set used_at = $1
+			where token_hash = $2 and used_at is null and expires_at > $1
+			returning user_id`
+		if err := tx.QueryRowContext(ctx, stmt, time.Now(), HashToken(token)).Scan(&userID); err != nil {
+			return err
+		}
+
+		_, err := tx.ExecContext(ctx, `update users set password = $1 where id = $2`, hashedPassword, userID)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return userID, nil
+}
+
+// newResetToken returns a random, URL safe reset token
+func newResetToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// HashToken returns the hex encoded SHA-256 hash of a token
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
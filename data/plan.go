@@ -2,8 +2,8 @@ package data
 
 import (
 	"context"
+	"database/sql"
 	"fmt"
-	"log"
 	"time"
 )
 
@@ -17,14 +17,51 @@ type Plan struct {
 	UpdatedAt           time.Time
 }
 
-func (p *Plan) GetAll() ([]*Plan, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+// PlanRepository stores and retrieves subscription plans and the users subscribed to them
+type PlanRepository interface {
+	GetAll(ctx context.Context) ([]*Plan, error)
+	GetOne(ctx context.Context, id int) (*Plan, error)
+	Insert(ctx context.Context, plan Plan) (int, error)
+	Update(ctx context.Context, p Plan) error
+	SubscribeUserToPlan(ctx context.Context, user User, plan Plan) error
+}
+
+// PostgresPlanRepository is the PlanRepository backed by Postgres
+type PostgresPlanRepository struct {
+	DB      *sql.DB
+	Timeout time.Duration
+}
+
+// planColumns are the plans columns read by scanPlan, in order
+const planColumns = `id, plan_name, plan_amount, created_at, updated_at`
+
+// scanPlan reads the planColumns of one row into a Plan
+func scanPlan(row rowScanner) (*Plan, error) {
+	var plan Plan
+	err := row.Scan(
+		&plan.ID,
+		&plan.PlanName,
+		&plan.PlanAmount,
+		&plan.CreatedAt,
+		&plan.UpdatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	plan.PlanAmountFormatted = plan.AmountForDisplay()
+
+	return &plan, nil
+}
+
+// GetAll returns every plan, ordered by id
+func (r *PostgresPlanRepository) GetAll(ctx context.Context) ([]*Plan, error) {
+	ctx, cancel := withTimeout(ctx, r.Timeout)
 	defer cancel()
 
-	query := `select id, plan_name, plan_amount, created_at, updated_at
-	from plans order by id`
+	query := `select ` + planColumns + ` from plans order by id`
 
-	rows, err := db.QueryContext(ctx, query)
+	rows, err := r.DB.QueryContext(ctx, query)
 	if err != nil {
 		return nil, err
 	}
@@ -33,74 +70,105 @@ func (p *Plan) GetAll() ([]*Plan, error) {
 	var plans []*Plan
 
 	for rows.Next() {
-		var plan Plan
-		err := rows.Scan(
-			&plan.ID,
-			&plan.PlanName,
-			&plan.PlanAmount,
-			&plan.CreatedAt,
-			&plan.UpdatedAt,
-		)
-
-		plan.PlanAmountFormatted = plan.AmountForDisplay()
+		plan, err := scanPlan(rows)
 		if err != nil {
-			log.Println("Error scanning", err)
 			return nil, err
 		}
 
-		plans = append(plans, &plan)
+		plans = append(plans, plan)
 	}
 
-	return plans, nil
+	return plans, rows.Err()
 }
 
 // GetOne returns one plan by id
-func (p *Plan) GetOne(id int) (*Plan, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+func (r *PostgresPlanRepository) GetOne(ctx context.Context, id int) (*Plan, error) {
+	ctx, cancel := withTimeout(ctx, r.Timeout)
 	defer cancel()
 
-	query := `select id, plan_name, plan_amount, created_at, updated_at from plans where id = $1`
+	query := `select ` + planColumns + ` from plans where id = $1`
 
-	var plan Plan
-	row := db.QueryRowContext(ctx, query, id)
+	return scanPlan(r.DB.QueryRowContext(ctx, query, id))
+}
 
-	err := row.Scan(
-		&plan.ID,
-		&plan.PlanName,
-		&plan.PlanAmount,
-		&plan.CreatedAt,
-		&plan.UpdatedAt,
-	)
+// Insert inserts a new plan into the database, and returns the ID of the newly inserted row
+func (r *PostgresPlanRepository) Insert(ctx context.Context, plan Plan) (int, error) {
+	ctx, cancel := withTimeout(ctx, r.Timeout)
+	defer cancel()
+
+	var newID int
+	stmt := `insert into plans (plan_name, plan_amount, created_at, updated_at)
+		values ($1, $2, $3, $4) returning id`
+
+	err := r.DB.QueryRowContext(ctx, stmt,
+		plan.PlanName,
+		plan.PlanAmount,
+		time.Now(),
+		time.Now(),
+	).Scan(&newID)
 
 	if err != nil {
-		return nil, err
+		return 0, err
 	}
 
-	return &plan, nil
+	return newID, nil
 }
 
-// SubscribeUserToPlan subscribes a user to one plan by insert
-// values into user_plans table
-func (p *Plan) SubscribeUserToPlan(user User, plan Plan) error {
-	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+// Update updates one plan in the database, using the information stored in p
+func (r *PostgresPlanRepository) Update(ctx context.Context, p Plan) error {
+	ctx, cancel := withTimeout(ctx, r.Timeout)
 	defer cancel()
 
-	// delete existing plan, if any
-	stmt := `delete from user_plans where user_id = $1`
-	_, err := db.ExecContext(ctx, stmt, user.ID)
+	stmt := `update plans set
+		plan_name = $1,
+		plan_amount = $2,
+		updated_at = $3
+		where id = $4`
+
+	_, err := r.DB.ExecContext(ctx, stmt,
+		p.PlanName,
+		p.PlanAmount,
+		time.Now(),
+		p.ID,
+	)
+
 	if err != nil {
 		return err
 	}
 
-	// subscribe to new plan
-	stmt = `insert into user_plans (user_id, plan_id, created_at, updated_at)
+	return nil
+}
+
+// SubscribeUserToPlan subscribes a user to one plan, replacing any plan they
+// already have. The user's row is locked for the length of the transaction, so
+// concurrent changes for the same user are applied one after the other, and the
+// unique constraint on user_plans.user_id guarantees they never end up with two plans.
+func (r *PostgresPlanRepository) SubscribeUserToPlan(ctx context.Context, user User, plan Plan) error {
+	ctx, cancel := withTimeout(ctx, r.Timeout)
+	defer cancel()
+
+	return WithTx(ctx, r.DB, func(tx *sql.Tx) error {
+		stmt := `select id from users where id = $1 for update`
+		var id int
+		err := tx.QueryRowContext(ctx, stmt, user.ID).Scan(&id)
+		if err != nil {
+			return err
+		}
+
+		// delete existing plan, if any
+		stmt = `delete from user_plans where user_id = $1`
+		_, err = tx.ExecContext(ctx, stmt, user.ID)
+		if err != nil {
+			return err
+		}
+
+		// subscribe to new plan
+		stmt = `insert into user_plans (user_id, plan_id, created_at, updated_at)
 			values ($1, $2, $3, $4)`
 
-	_, err = db.ExecContext(ctx, stmt, user.ID, plan.ID, time.Now(), time.Now())
-	if err != nil {
+		_, err = tx.ExecContext(ctx, stmt, user.ID, plan.ID, time.Now(), time.Now())
 		return err
-	}
-	return nil
+	})
 }
 
 // AmountForDisplay formats the price we have in the DB as a currency string
@@ -0,0 +1,218 @@
+package data
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base32"
+	"strings"
+	"time"
+)
+
+// recoveryCodeCount is how many recovery codes a user gets when they enroll
+const recoveryCodeCount = 10
+
+// TwoFactor is the type for a user's TOTP two-factor settings, stored on the
+// users table. Secret is encrypted by the caller before it is stored; this
+// package never sees it in plain text.
+type TwoFactor struct {
+	UserID   int
+	Secret   string
+	Enabled  int
+	LastStep int64
+}
+
+// TwoFactorRepository stores users' two-factor secrets and recovery codes
+type TwoFactorRepository interface {
+	Get(ctx context.Context, userID int) (*TwoFactor, error)
+	Enable(ctx context.Context, userID int, secret string, step int64) ([]string, error)
+	Disable(ctx context.Context, userID int) error
+	UseStep(ctx context.Context, userID int, step int64) (bool, error)
+	NewRecoveryCodes(ctx context.Context, userID int) ([]string, error)
+	UseRecoveryCode(ctx context.Context, userID int, code string) (bool, error)
+}
+
+// PostgresTwoFactorRepository stores users' two-factor secrets and recovery codes in Postgres
+type PostgresTwoFactorRepository struct {
+	DB      *sql.DB
+	Timeout time.Duration
+}
+
+// Get returns the two-factor settings for a user
+func (r *PostgresTwoFactorRepository) Get(ctx context.Context, userID int) (*TwoFactor, error) {
+	ctx, cancel := withTimeout(ctx, r.Timeout)
+	defer cancel()
+
+	query := `select id, coalesce(totp_secret, ''), totp_enabled, totp_last_step from users where id = $1`
+
+	var tf TwoFactor
+	row := r.DB.QueryRowContext(ctx, query, userID)
+
+	err := row.Scan(
+		&tf.UserID,
+		&tf.Secret,
+		&tf.Enabled,
+		&tf.LastStep,
+	)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &tf, nil
+}
+
+// Enable turns two-factor authentication on for a user, with the encrypted
+// secret they have proved they can generate codes with, and gives them a
+// fresh set of recovery codes, all in one transaction. step is the TOTP time
+// step of the code they proved it with, so that code can't be used again.
+// The recovery codes are returned in plain text so they can be shown to the
+// user, once.
+func (r *PostgresTwoFactorRepository) Enable(ctx context.Context, userID int, secret string, step int64) ([]string, error) {
+	ctx, cancel := withTimeout(ctx, r.Timeout)
+	defer cancel()
+
+	codes, err := newRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+
+	err = WithTx(ctx, r.DB, func(tx *sql.Tx) error {
+		stmt := `update users set totp_secret = $1, totp_enabled = 1, totp_last_step = $2, updated_at = $3 where id = $4`
+		_, err := tx.ExecContext(ctx, stmt, secret, step, time.Now(), userID)
+		if err != nil {
+			return err
+		}
+
+		return replaceRecoveryCodes(ctx, tx, userID, codes)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return codes, nil
+}
+
+// Disable turns two-factor authentication off for a user and throws away their secret and recovery codes
+func (r *PostgresTwoFactorRepository) Disable(ctx context.Context, userID int) error {
+	ctx, cancel := withTimeout(ctx, r.Timeout)
+	defer cancel()
+
+	return WithTx(ctx, r.DB, func(tx *sql.Tx) error {
+		stmt := `update users set totp_secret = null, totp_enabled = 0, totp_last_step = 0, updated_at = $1 where id = $2`
+		_, err := tx.ExecContext(ctx, stmt, time.Now(), userID)
+		if err != nil {
+			return err
+		}
+
+		stmt = `delete from user_recovery_codes where user_id = $1`
+		_, err = tx.ExecContext(ctx, stmt, userID)
+		return err
+	})
+}
+
+// UseStep records that the code for a TOTP time step has been used. It returns
+// false if that step, or a later one, was already used, so each code only works once.
+func (r *PostgresTwoFactorRepository) UseStep(ctx context.Context, userID int, step int64) (bool, error) {
+	ctx, cancel := withTimeout(ctx, r.Timeout)
+	defer cancel()
+
+	stmt := `update users set totp_last_step = $1 where id = $2 and totp_last_step < $1`
+
+	result, err := r.DB.ExecContext(ctx, stmt, step, userID)
+	if err != nil {
+		return false, err
+	}
+
+	n, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return n == 1, nil
+}
+
+// NewRecoveryCodes replaces a user's recovery codes with a fresh set, and
+// returns the codes in plain text so they can be shown to the user, once.
+// Only their hashes are stored.
+func (r *PostgresTwoFactorRepository) NewRecoveryCodes(ctx context.Context, userID int) ([]string, error) {
+	ctx, cancel := withTimeout(ctx, r.Timeout)
+	defer cancel()
+
+	codes, err := newRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+
+	err = WithTx(ctx, r.DB, func(tx *sql.Tx) error {
+		return replaceRecoveryCodes(ctx, tx, userID, codes)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return codes, nil
+}
+
+// replaceRecoveryCodes stores the hashes of codes as the user's recovery codes, in place of any they had
+func replaceRecoveryCodes(ctx context.Context, tx *sql.Tx, userID int, codes []string) error {
+	stmt := `delete from user_recovery_codes where user_id = $1`
+	_, err := tx.ExecContext(ctx, stmt, userID)
+	if err != nil {
+		return err
+	}
+
+	stmt = `insert into user_recovery_codes (user_id, code_hash, created_at) values ($1, $2, $3)`
+	for _, code := range codes {
+		_, err = tx.ExecContext(ctx, stmt, userID, HashToken(code), time.Now())
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// UseRecoveryCode uses up one of the user's recovery codes. It returns false if
+// the code doesn't belong to the user or was already used.
+func (r *PostgresTwoFactorRepository) UseRecoveryCode(ctx context.Context, userID int, code string) (bool, error) {
+	ctx, cancel := withTimeout(ctx, r.Timeout)
+	defer cancel()
+
+	code = normalizeRecoveryCode(code)
+
+	stmt := `update user_recovery_codes set used_at = $1 where user_id = $2 and code_hash = $3 and used_at is null`
+
+	result, err := r.DB.ExecContext(ctx, stmt, time.Now(), userID, HashToken(code))
+	if err != nil {
+		return false, err
+	}
+
+	n, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return n > 0, nil
+}
+
+// newRecoveryCodes generates a set of recovery codes, such as "abcd-efgh"
+func newRecoveryCodes() ([]string, error) {
+	codes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		b := make([]byte, 5)
+		if _, err := rand.Read(b); err != nil {
+			return nil, err
+		}
+		code := strings.ToLower(base32.StdEncoding.EncodeToString(b))
+		codes[i] = code[:4] + "-" + code[4:]
+	}
+
+	return codes, nil
+}
+
+// normalizeRecoveryCode returns a recovery code as the user typed it in the
+// form it was generated in
+func normalizeRecoveryCode(code string) string {
+	return strings.ToLower(strings.TrimSpace(code))
+}
@@ -2,12 +2,45 @@ package data
 
 import (
 	"context"
+	"database/sql"
 	"errors"
-	"golang.org/x/crypto/bcrypt"
-	"log"
+	"strings"
 	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"golang.org/x/crypto/bcrypt"
 )
 
+// passwordCost is the bcrypt cost used for every stored password
+const passwordCost = 12
+
+// emailIndex is the unique index that stops two users sharing an email, ignoring case
+const emailIndex = "users_email_lower_key"
+
+// ErrDuplicateEmail is returned by Insert and Update when another user already has the email
+var ErrDuplicateEmail = errors.New("data: another user has that email address")
+
+// ErrUserHasInvoices is returned by Delete and DeleteByID for a user who has
+// been invoiced. Invoices are kept, so such a user can only be deactivated.
+var ErrUserHasInvoices = errors.New("data: the user has invoices")
+
+// dummyHash is the hash DummyPasswordCheck compares against. It is made at
+// startup, so the first unknown email isn't slower than the rest.
+var dummyHash []byte
+
+func init() {
+	var err error
+	dummyHash, err = hashPassword("not a real password")
+	if err != nil {
+		panic(err)
+	}
+}
+
+// hashPassword returns the bcrypt hash a password is stored as
+func hashPassword(plainText string) ([]byte, error) {
+	return bcrypt.GenerateFromPassword([]byte(plainText), passwordCost)
+}
+
 // User is the structure which holds one user from the database.
 type User struct {
 	ID        int
@@ -20,85 +53,59 @@ type User struct {
 	CreatedAt time.Time
 	UpdatedAt time.Time
 	Plan      *Plan
-}
 
-// GetAll returns a slice of all users, sorted by last name
-func (u *User) GetAll() ([]*User, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
-	defer cancel()
-
-	query := `
-	select 
-    	id, 
-       	email, 
-       	first_name, 
-       	last_name, 
-       	password, 
-       	user_active, 
-       	is_admin, 
-       	created_at, 
-       	updated_at
-	from 
-	    users 
-	order by 
-	    last_name`
-
-	rows, err := db.QueryContext(ctx, query)
-	if err != nil {
-		return nil, err
-	}
-	defer rows.Close()
-
-	var users []*User
-
-	for rows.Next() {
-		var user User
-		err := rows.Scan(
-			&user.ID,
-			&user.Email,
-			&user.FirstName,
-			&user.LastName,
-			&user.Password,
-			&user.Active,
-			&user.IsAdmin,
-			&user.CreatedAt,
-			&user.UpdatedAt,
-		)
-		if err != nil {
-			log.Println("Error scanning", err)
-			return nil, err
-		}
+	// DisabledAt is when an administrator deactivated the account, or nil.
+	// A disabled account is inactive, but unlike one whose email hasn't been
+	// confirmed yet, it can't be activated with an activation link.
+	DisabledAt *time.Time
+}
 
-		users = append(users, &user)
-	}
+// Disabled reports whether an administrator has deactivated the account
+func (u *User) Disabled() bool {
+	return u.DisabledAt != nil
+}
 
-	return users, nil
+// UserRepository stores and retrieves users
+type UserRepository interface {
+	GetAll(ctx context.Context) ([]*User, error)
+	Search(ctx context.Context, term string, limit, offset int) ([]*User, int, error)
+	GetByEmail(ctx context.Context, email string) (*User, error)
+	GetOne(ctx context.Context, id int) (*User, error)
+	Update(ctx context.Context, u User) error
+	Delete(ctx context.Context, u User) error
+	DeleteByID(ctx context.Context, id int) error
+	Insert(ctx context.Context, user User) (int, error)
 }
 
-// GetByEmail returns one user by email
-func (u *User) GetByEmail(email string) (*User, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
-	defer cancel()
+// PostgresUserRepository is the UserRepository backed by Postgres
+type PostgresUserRepository struct {
+	DB      *sql.DB
+	Timeout time.Duration
+}
 
-	query := `
-			select 
-			    id, 
-			    email, 
-			    first_name, 
-			    last_name, 
-			    password, 
-			    user_active, 
-			    is_admin, 
-			    created_at, 
-			    updated_at 
-			from 
-			    users 
-			where 
-			    email = $1`
+// userColumns are the users columns read by scanUser, in order
+const userColumns = `u.id, u.email, u.first_name, u.last_name, u.password, u.user_active, u.is_admin, u.created_at, u.updated_at, u.disabled_at`
+
+// userWithPlanQuery selects users along with their plan, if they have one, in
+// the column order scanUserWithPlan expects. Each user has at most one row in
+// user_plans, so this returns exactly one row per user.
+const userWithPlanQuery = `
+	select
+		` + userColumns + `,
+		p.id, p.plan_name, p.plan_amount, p.created_at, p.updated_at
+	from
+		users u
+		left join user_plans up on (up.user_id = u.id)
+		left join plans p on (p.id = up.plan_id)`
+
+// rowScanner is satisfied by both *sql.Row and *sql.Rows
+type rowScanner interface {
+	Scan(dest ...any) error
+}
 
+// scanUser reads the userColumns of one row into a User
+func scanUser(row rowScanner) (*User, error) {
 	var user User
-	row := db.QueryRowContext(ctx, query, email)
-
 	err := row.Scan(
 		&user.ID,
 		&user.Email,
@@ -109,47 +116,26 @@ func (u *User) GetByEmail(email string) (*User, error) {
 		&user.IsAdmin,
 		&user.CreatedAt,
 		&user.UpdatedAt,
+		&user.DisabledAt,
 	)
-
 	if err != nil {
 		return nil, err
 	}
 
-	// get plan, if any
-	query = `select p.id, p.plan_name, p.plan_amount, p.created_at, p.updated_at from 
-			plans p
-			left join user_plans up on (p.id = up.plan_id)
-			where up.user_id = $1`
-
-	var plan Plan
-	row = db.QueryRowContext(ctx, query, user.ID)
-
-	err = row.Scan(
-		&plan.ID,
-		&plan.PlanName,
-		&plan.PlanAmount,
-		&plan.CreatedAt,
-		&plan.UpdatedAt,
-	)
-
-	if err == nil {
-		user.Plan = &plan
-	}
-
 	return &user, nil
 }
 
-// GetOne returns one user by id
-func (u *User) GetOne(id int) (*User, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
-	defer cancel()
-
-	query := `select id, email, first_name, last_name, password, user_active, is_admin, created_at, updated_at 
-				from users 
-				where id = $1`
-
+// scanUserWithPlan reads one row of userWithPlanQuery into a User. The user's
+// Plan is nil if they aren't subscribed to one.
+func scanUserWithPlan(row rowScanner) (*User, error) {
 	var user User
-	row := db.QueryRowContext(ctx, query, id)
+	var (
+		planID        sql.NullInt64
+		planName      sql.NullString
+		planAmount    sql.NullInt64
+		planCreatedAt sql.NullTime
+		planUpdatedAt sql.NullTime
+	)
 
 	err := row.Scan(
 		&user.ID,
@@ -161,42 +147,122 @@ func (u *User) GetOne(id int) (*User, error) {
 		&user.IsAdmin,
 		&user.CreatedAt,
 		&user.UpdatedAt,
+		&user.DisabledAt,
+		&planID,
+		&planName,
+		&planAmount,
+		&planCreatedAt,
+		&planUpdatedAt,
 	)
+	if err != nil {
+		return nil, err
+	}
+
+	if planID.Valid {
+		user.Plan = &Plan{
+			ID:         int(planID.Int64),
+			PlanName:   planName.String,
+			PlanAmount: int(planAmount.Int64),
+			CreatedAt:  planCreatedAt.Time,
+			UpdatedAt:  planUpdatedAt.Time,
+		}
+		user.Plan.PlanAmountFormatted = user.Plan.AmountForDisplay()
+	}
+
+	return &user, nil
+}
 
+// collectUsers reads every remaining row with scan
+func collectUsers(rows *sql.Rows, scan func(rowScanner) (*User, error)) ([]*User, error) {
+	defer rows.Close()
+
+	var users []*User
+	for rows.Next() {
+		user, err := scan(rows)
+		if err != nil {
+			return nil, err
+		}
+
+		users = append(users, user)
+	}
+
+	return users, rows.Err()
+}
+
+// GetAll returns a slice of all users, sorted by last name. Their plans
+// aren't loaded; use Search for that.
+func (r *PostgresUserRepository) GetAll(ctx context.Context) ([]*User, error) {
+	ctx, cancel := withTimeout(ctx, r.Timeout)
+	defer cancel()
+
+	query := `select ` + userColumns + ` from users u order by u.last_name`
+
+	rows, err := r.DB.QueryContext(ctx, query)
 	if err != nil {
 		return nil, err
 	}
 
-	// get plan, if any
-	query = `select p.id, p.plan_name, p.plan_amount, p.created_at, p.updated_at from 
-			plans p
-			left join user_plans up on (p.id = up.plan_id)
-			where up.user_id = $1`
-
-	var plan Plan
-	row = db.QueryRowContext(ctx, query, user.ID)
-
-	err = row.Scan(
-		&plan.ID,
-		&plan.PlanName,
-		&plan.PlanAmount,
-		&plan.CreatedAt,
-		&plan.UpdatedAt,
-	)
+	return collectUsers(rows, scanUser)
+}
+
+// Search returns one page of users whose email or name contains term, sorted
+// by last name, along with the total number of matching users. An empty term
+// matches everyone. Each user is returned with their plan, if any.
+func (r *PostgresUserRepository) Search(ctx context.Context, term string, limit, offset int) ([]*User, int, error) {
+	ctx, cancel := withTimeout(ctx, r.Timeout)
+	defer cancel()
 
-	if err == nil {
-		user.Plan = &plan
-	} else {
-		log.Println("Error getting plan", err)
+	pattern := "%" + escapeLike(term) + "%"
+	where := ` where u.email ilike $1 or u.first_name ilike $1 or u.last_name ilike $1`
+
+	var total int
+	err := r.DB.QueryRowContext(ctx, `select count(*) from users u`+where, pattern).Scan(&total)
+	if err != nil {
+		return nil, 0, err
 	}
 
-	return &user, nil
+	query := userWithPlanQuery + where + `
+	order by
+		u.last_name, u.first_name, u.id
+	limit $2 offset $3`
+
+	rows, err := r.DB.QueryContext(ctx, query, pattern, limit, offset)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	users, err := collectUsers(rows, scanUserWithPlan)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return users, total, nil
 }
 
-// Update updates one user in the database, using the information
-// stored in the receiver u
-func (u *User) Update() error {
-	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+// GetByEmail returns one user by email, ignoring case, with their plan, if any
+func (r *PostgresUserRepository) GetByEmail(ctx context.Context, email string) (*User, error) {
+	ctx, cancel := withTimeout(ctx, r.Timeout)
+	defer cancel()
+
+	query := userWithPlanQuery + ` where lower(u.email) = lower($1)`
+
+	return scanUserWithPlan(r.DB.QueryRowContext(ctx, query, email))
+}
+
+// GetOne returns one user by id, with their plan, if any
+func (r *PostgresUserRepository) GetOne(ctx context.Context, id int) (*User, error) {
+	ctx, cancel := withTimeout(ctx, r.Timeout)
+	defer cancel()
+
+	query := userWithPlanQuery + ` where u.id = $1`
+
+	return scanUserWithPlan(r.DB.QueryRowContext(ctx, query, id))
+}
+
+// Update updates one user in the database, using the information stored in u.
+// The email is stored normalised, as by NormalizeEmail.
+func (r *PostgresUserRepository) Update(ctx context.Context, u User) error {
+	ctx, cancel := withTimeout(ctx, r.Timeout)
 	defer cancel()
 
 	stmt := `update users set
@@ -204,18 +270,25 @@ func (u *User) Update() error {
 		first_name = $2,
 		last_name = $3,
 		user_active = $4,
-		updated_at = $5
-		where id = $6`
+		is_admin = $5,
+		disabled_at = $6,
+		updated_at = $7
+		where id = $8`
 
-	_, err := db.ExecContext(ctx, stmt,
-		u.Email,
+	_, err := r.DB.ExecContext(ctx, stmt,
+		NormalizeEmail(u.Email),
 		u.FirstName,
 		u.LastName,
 		u.Active,
+		u.IsAdmin,
+		u.DisabledAt,
 		time.Now(),
 		u.ID,
 	)
 
+	if isDuplicateEmail(err) {
+		return ErrDuplicateEmail
+	}
 	if err != nil {
 		return err
 	}
@@ -223,14 +296,18 @@ func (u *User) Update() error {
 	return nil
 }
 
-// Delete deletes one user from the database, by User.ID
-func (u *User) Delete() error {
-	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+// Delete deletes one user from the database, by User.ID. Returns
+// ErrUserHasInvoices if the user has been invoiced.
+func (r *PostgresUserRepository) Delete(ctx context.Context, u User) error {
+	ctx, cancel := withTimeout(ctx, r.Timeout)
 	defer cancel()
 
 	stmt := `delete from users where id = $1`
 
-	_, err := db.ExecContext(ctx, stmt, u.ID)
+	_, err := r.DB.ExecContext(ctx, stmt, u.ID)
+	if isInvoicedUser(err) {
+		return ErrUserHasInvoices
+	}
 	if err != nil {
 		return err
 	}
@@ -238,14 +315,18 @@ func (u *User) Delete() error {
 	return nil
 }
 
-// DeleteByID deletes one user from the database, by ID
-func (u *User) DeleteByID(id int) error {
-	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+// DeleteByID deletes one user from the database, by ID. Returns
+// ErrUserHasInvoices if the user has been invoiced.
+func (r *PostgresUserRepository) DeleteByID(ctx context.Context, id int) error {
+	ctx, cancel := withTimeout(ctx, r.Timeout)
 	defer cancel()
 
 	stmt := `delete from users where id = $1`
 
-	_, err := db.ExecContext(ctx, stmt, id)
+	_, err := r.DB.ExecContext(ctx, stmt, id)
+	if isInvoicedUser(err) {
+		return ErrUserHasInvoices
+	}
 	if err != nil {
 		return err
 	}
@@ -253,12 +334,13 @@ func (u *User) DeleteByID(id int) error {
 	return nil
 }
 
-// Insert inserts a new user into the database, and returns the ID of the newly inserted row
-func (u *User) Insert(user User) (int, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+// Insert inserts a new user into the database, and returns the ID of the newly
+// inserted row. The email is stored normalised, as by NormalizeEmail.
+func (r *PostgresUserRepository) Insert(ctx context.Context, user User) (int, error) {
+	ctx, cancel := withTimeout(ctx, r.Timeout)
 	defer cancel()
 
-	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(user.Password), 12)
+	hashedPassword, err := hashPassword(user.Password)
 	if err != nil {
 		return 0, err
 	}
@@ -267,8 +349,8 @@ func (u *User) Insert(user User) (int, error) {
 	stmt := `insert into users (email, first_name, last_name, password, user_active, created_at, updated_at)
 		values ($1, $2, $3, $4, $5, $6, $7) returning id`
 
-	err = db.QueryRowContext(ctx, stmt,
-		user.Email,
+	err = r.DB.QueryRowContext(ctx, stmt,
+		NormalizeEmail(user.Email),
 		user.FirstName,
 		user.LastName,
 		hashedPassword,
@@ -277,6 +359,9 @@ func (u *User) Insert(user User) (int, error) {
 		time.Now(),
 	).Scan(&newID)
 
+	if isDuplicateEmail(err) {
+		return 0, ErrDuplicateEmail
+	}
 	if err != nil {
 		return 0, err
 	}
@@ -284,25 +369,6 @@ func (u *User) Insert(user User) (int, error) {
 	return newID, nil
 }
 
-// ResetPassword is the method we will use to change a user's password.
-func (u *User) ResetPassword(password string) error {
-	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
-	defer cancel()
-
-	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), 12)
-	if err != nil {
-		return err
-	}
-
-	stmt := `update users set password = $1 where id = $2`
-	_, err = db.ExecContext(ctx, stmt, hashedPassword, u.ID)
-	if err != nil {
-		return err
-	}
-
-	return nil
-}
-
 // PasswordMatches uses Go's bcrypt package to compare a user supplied password
 // with the hash we have stored for a given user in the database. If the password
 // and hash match, we return true; otherwise, we return false.
@@ -320,3 +386,34 @@ func (u *User) PasswordMatches(plainText string) (bool, error) {
 
 	return true, nil
 }
+
+// NormalizeEmail returns the form of an email address that is stored and
+// compared: trimmed and lower case
+func NormalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+// isDuplicateEmail reports whether err is a violation of the unique email index
+func isDuplicateEmail(err error) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == "23505" && pgErr.ConstraintName == emailIndex
+}
+
+// isInvoicedUser reports whether err is Postgres refusing to delete a user who has invoices
+func isInvoicedUser(err error) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == "23503" && pgErr.ConstraintName == "invoices_user_id_fkey"
+}
+
+// escapeLike escapes the characters that have a special meaning in a LIKE pattern
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(s)
+}
+
+// DummyPasswordCheck runs a bcrypt comparison against a throwaway hash of the
+// same cost as real passwords. Calling it when no user matches an email makes
+// a failed login take as long as a wrong password, so response times don't
+// reveal which emails are registered.
+func DummyPasswordCheck(plainText string) {
+	_ = bcrypt.CompareHashAndPassword(dummyHash, []byte(plainText))
+}
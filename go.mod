@@ -1,34 +1,35 @@
 module concurrent-subscriptions
 
-go 1.19
+go 1.21
 
 require (
+	github.com/alexedwards/scs/redisstore v0.0.0-20230327161757-10d4299e3b24
+	github.com/alexedwards/scs/v2 v2.5.1
+	github.com/go-chi/chi/v5 v5.0.8
 	github.com/go-redis/redis/v8 v8.11.5
+	github.com/gomodule/redigo v1.8.0
+	github.com/jackc/pgconn v1.14.0
+	github.com/jackc/pgx/v5 v5.3.1
 	github.com/joho/godotenv v1.5.1
+	github.com/vanng822/go-premailer v1.20.1
+	github.com/xhit/go-simple-mail/v2 v2.13.0
+	golang.org/x/crypto v0.6.0
+	rsc.io/qr v0.2.0
 )
 
 require (
 	github.com/PuerkitoBio/goquery v1.5.1 // indirect
-	github.com/alexedwards/scs/redisstore v0.0.0-20230327161757-10d4299e3b24 // indirect
-	github.com/alexedwards/scs/v2 v2.5.1 // indirect
 	github.com/andybalholm/cascadia v1.1.0 // indirect
 	github.com/cespare/xxhash/v2 v2.1.2 // indirect
 	github.com/dgryski/go-rendezvous v0.0.0-20200823014737-9f7001d12a5f // indirect
-	github.com/go-chi/chi/v5 v5.0.8 // indirect
-	github.com/gomodule/redigo v1.8.0 // indirect
 	github.com/gorilla/css v1.0.0 // indirect
 	github.com/jackc/chunkreader/v2 v2.0.1 // indirect
-	github.com/jackc/pgconn v1.14.0 // indirect
 	github.com/jackc/pgio v1.0.0 // indirect
 	github.com/jackc/pgpassfile v1.0.0 // indirect
 	github.com/jackc/pgproto3/v2 v2.3.2 // indirect
 	github.com/jackc/pgservicefile v0.0.0-20221227161230-091c0ba34f0a // indirect
-	github.com/jackc/pgx/v5 v5.3.1 // indirect
 	github.com/toorop/go-dkim v0.0.0-20201103131630-e1cd1a0a5208 // indirect
 	github.com/vanng822/css v1.0.1 // indirect
-	github.com/vanng822/go-premailer v1.20.1 // indirect
-	github.com/xhit/go-simple-mail/v2 v2.13.0 // indirect
-	golang.org/x/crypto v0.6.0 // indirect
 	golang.org/x/net v0.6.0 // indirect
 	golang.org/x/text v0.7.0 // indirect
 )